@@ -0,0 +1,247 @@
+package pawapay
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// redacted replaces the values hidden by RedactFields
+const redacted = "REDACTED"
+
+// DefaultAnnotationHeaders are the response headers captured when AnnotationPolicy.Headers is not set, the ids
+// pawapay support asks for and the rate limit headers
+var DefaultAnnotationHeaders = []string{"X-Request-Id", "X-Correlation-Id", "Retry-After", "X-RateLimit-Limit",
+	"X-RateLimit-Remaining", "X-RateLimit-Reset"}
+
+// AnnotationPolicy picks what the APIAnnotation of a request captures. The zero value captures the url and the
+// response payload, and the request payload only when LogRequest is set
+type AnnotationPolicy struct {
+	// OmitURL leaves the url out of annotations
+	OmitURL bool
+	// RequestPayload captures the request payload even when LogRequest is not set
+	RequestPayload bool
+	// OmitResponsePayload leaves the response payload out of annotations
+	OmitResponsePayload bool
+	// Redact, when set, is applied to the payloads captured, eg RedactPhoneNumbers
+	Redact func(payload string) string
+	// OmitTiming leaves the start, end and duration out of annotations
+	OmitTiming bool
+	// Headers names the response headers captured, defaults to DefaultAnnotationHeaders
+	Headers []string
+	// OmitHeaders leaves every response header out of annotations
+	OmitHeaders bool
+}
+
+// annotate captures a single attempt, res is nil when pawapay could not be reached
+func (p AnnotationPolicy) annotate(req *http.Request, requestPayload []byte, res *http.Response, responsePayload []byte,
+	started, ended time.Time) APIAnnotation {
+	annotation := APIAnnotation{Method: req.Method}
+	if !p.OmitURL {
+		annotation.URL = req.URL.String()
+	}
+	annotation.RequestPayload = p.redact(string(requestPayload))
+	if !p.OmitTiming {
+		annotation.StartedAt, annotation.EndedAt, annotation.Duration = started, ended, ended.Sub(started)
+	}
+	if res == nil {
+		return annotation
+	}
+
+	annotation.ResponseCode = res.StatusCode
+	if !p.OmitResponsePayload {
+		annotation.ResponsePayload = p.redact(string(responsePayload))
+	}
+	headers := p.Headers
+	if headers == nil {
+		headers = DefaultAnnotationHeaders
+	}
+	if p.OmitHeaders {
+		headers = nil
+	}
+	for _, name := range headers {
+		if value := res.Header.Get(name); value != "" {
+			if annotation.Headers == nil {
+				annotation.Headers = map[string]string{}
+			}
+			annotation.Headers[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+	return annotation
+}
+
+func (p AnnotationPolicy) redact(payload string) string {
+	if p.Redact == nil || payload == "" {
+		return payload
+	}
+	return p.Redact(payload)
+}
+
+// RedactPhoneNumbers hides the recipient and payer addresses of payloads, they hold the phone numbers
+var RedactPhoneNumbers = RedactFields("address")
+
+// RedactFields returns a redactor that hides the values of the named json fields wherever they are nested. Payloads
+// that are not json are left as they are
+func RedactFields(names ...string) func(payload string) string {
+	hidden := map[string]bool{}
+	for _, name := range names {
+		hidden[name] = true
+	}
+
+	var walk func(v interface{}) interface{}
+	walk = func(v interface{}) interface{} {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, field := range v {
+				if hidden[k] {
+					v[k] = redacted
+					continue
+				}
+				v[k] = walk(field)
+			}
+		case []interface{}:
+			for i, item := range v {
+				v[i] = walk(item)
+			}
+		}
+		return v
+	}
+
+	return func(payload string) string {
+		var v interface{}
+		if err := json.Unmarshal([]byte(payload), &v); err != nil {
+			return payload
+		}
+		b, err := json.Marshal(walk(v))
+		if err != nil {
+			return payload
+		}
+		return string(b)
+	}
+}
+
+// AuditPhase tells whether an AuditRecord was written before or after its request was sent
+type AuditPhase string
+
+const (
+	// AuditIntent records are written before a request that is not a GET is sent, their annotation only names the
+	// method and operation
+	AuditIntent AuditPhase = "INTENT"
+	// AuditOutcome records are written once a request was sent, with the annotation of its last attempt
+	AuditOutcome AuditPhase = "OUTCOME"
+)
+
+// AuditRecord is what an AuditSink receives for every request sent to pawapay. Resource and Request are the path and
+// payload sent as is, the annotation policy does not apply to them
+type AuditRecord struct {
+	Phase      AuditPhase    `json:"phase"`
+	Tenant     string        `json:"tenant,omitempty"`
+	Caller     string        `json:"caller,omitempty"`
+	Resource   string        `json:"resource"`
+	Request    string        `json:"request,omitempty"`
+	Annotation APIAnnotation `json:"annotation"`
+	Err        string        `json:"error,omitempty"`
+}
+
+// AuditSink persists the annotation of every request sent to pawapay, eg for incidents escalated to pawapay
+// support. The context passed to it carries the values of the service's context but is never cancelled, so that a
+// call cancelled while it was in flight is still audited. Implementations must be safe for concurrent use
+type AuditSink interface {
+	Audit(ctx context.Context, record AuditRecord) error
+}
+
+// AuditSinkFunc adapts a func to an AuditSink
+type AuditSinkFunc func(ctx context.Context, record AuditRecord) error
+
+// Audit implements AuditSink
+func (f AuditSinkFunc) Audit(ctx context.Context, record AuditRecord) error { return f(ctx, record) }
+
+// JSONAuditSink writes every record as a line of json
+type JSONAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONAuditSink returns a sink writing to w
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{w: w}
+}
+
+// Audit implements AuditSink
+func (j *JSONAuditSink) Audit(_ context.Context, record AuditRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.w.Write(append(b, '\n'))
+	return err
+}
+
+type callerKey struct{}
+
+// WithCaller returns a copy of ctx naming who a request is made for, eg the user of a back office. It is recorded
+// in the AuditRecord of requests made by a service bound to it with WithContext
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFromContext returns the caller set by WithCaller, empty when there is none
+func CallerFromContext(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// detachedContext keeps the values of its parent but is never cancelled and has no deadline
+type detachedContext struct{ parent context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (d detachedContext) Value(key interface{}) interface{} { return d.parent.Value(key) }
+
+func (s *Service) auditRecord(ctx context.Context, phase AuditPhase, resource string, reqBody interface{},
+	annotation APIAnnotation, err error) AuditRecord {
+	record := AuditRecord{Phase: phase, Tenant: s.config.Tenant, Caller: CallerFromContext(ctx), Resource: resource,
+		Annotation: annotation, Err: errString(err)}
+	if reqBody != nil {
+		b, _ := json.Marshal(reqBody)
+		record.Request = string(b)
+	}
+	return record
+}
+
+// auditIntent audits a request that is not a GET before it is sent. The error is only returned when
+// Config.AuditRequired is set, the request must not be sent then
+func (s *Service) auditIntent(ctx context.Context, method, resource string, reqBody interface{}) error {
+	if s.config.AuditSink == nil || method == http.MethodGet {
+		return nil
+	}
+	annotation := APIAnnotation{Method: method, Operation: operationName(method, resource)}
+	record := s.auditRecord(ctx, AuditIntent, resource, reqBody, annotation, nil)
+	if err := s.config.AuditSink.Audit(detachedContext{ctx}, record); err != nil {
+		if s.config.AuditRequired {
+			return errors.Wrap(err, "client - unable to audit request")
+		}
+		log.Printf("pawapay: unable to audit %s %s: %s", annotation.Method, annotation.Operation, err)
+	}
+	return nil
+}
+
+// audit audits the outcome of a request that was sent. Its error is only logged, the request cannot be taken back
+func (s *Service) audit(ctx context.Context, resource string, reqBody interface{}, annotation APIAnnotation, err error) {
+	if s.config.AuditSink == nil {
+		return
+	}
+	record := s.auditRecord(ctx, AuditOutcome, resource, reqBody, annotation, err)
+	if err := s.config.AuditSink.Audit(detachedContext{ctx}, record); err != nil {
+		log.Printf("pawapay: unable to audit %s %s: %s", annotation.Method, annotation.Operation, err)
+	}
+}
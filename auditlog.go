@@ -0,0 +1,208 @@
+package pawapay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AuditedOperations are the operations, as named in APIAnnotation.Operation, that move money and are written to an
+// AuditLog
+var AuditedOperations = map[string]bool{
+	"payouts.create":        true,
+	"payouts.bulk":          true,
+	"payouts.fail-enqueued": true,
+	"deposits.create":       true,
+	"deposits.bulk":         true,
+	"refunds.create":        true,
+}
+
+// AuditEntry is a single line of an AuditLog. Hash is the sha256 of the entry's json with an empty Hash, it covers
+// PrevHash so that every entry is chained to the one before it
+type AuditEntry struct {
+	Sequence uint64      `json:"sequence"`
+	At       time.Time   `json:"at"`
+	Record   AuditRecord `json:"record"`
+	PrevHash string      `json:"prevHash"`
+	Hash     string      `json:"hash"`
+}
+
+func (e AuditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog is an AuditSink appending the money moving calls of a service to a file, one json entry per line.
+// Entries are hash chained so that VerifyAuditLog detects an entry that was altered, removed or inserted
+type AuditLog struct {
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	sequence uint64
+	lastHash string
+}
+
+// OpenAuditLog opens the audit log at path, creating it when it does not exist. New entries continue the chain of
+// those already in the file. A last line without a line feed is an entry whose write was interrupted, eg by a crash,
+// and was never acknowledged: it is cut off the file so that the chain continues from the entry before it. Any
+// other last line that is not an audit log entry is returned as an *AuditLogError
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open audit log")
+	}
+	l := &AuditLog{file: file}
+	if err := l.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// load reads the last entry of the log and cuts off an interrupted write
+func (l *AuditLog) load() error {
+	reader := bufio.NewReader(l.file)
+	var (
+		last            []byte
+		lastLine, lines int
+	)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return errors.Wrap(err, "unable to read audit log")
+		}
+		if len(line) > 0 && line[len(line)-1] != '\n' {
+			log.Printf("pawapay: cutting %d bytes of an interrupted write off the end of audit log %s", len(line),
+				l.file.Name())
+			if err := l.file.Truncate(l.size); err != nil {
+				return errors.Wrap(err, "unable to cut interrupted write off audit log")
+			}
+			break
+		}
+		l.size += int64(len(line))
+		if len(line) > 0 {
+			lines++
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			last, lastLine = append(last[:0], trimmed...), lines
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if last != nil {
+		var entry AuditEntry
+		if err := json.Unmarshal(last, &entry); err != nil {
+			return &AuditLogError{Line: lastLine, Reason: fmt.Sprintf("not an audit log entry: %s", err)}
+		}
+		l.sequence, l.lastHash = entry.Sequence, entry.Hash
+	}
+	return nil
+}
+
+// Close closes the file of the log
+func (l *AuditLog) Close() error { return l.file.Close() }
+
+// Audit implements AuditSink, records of operations that are not in AuditedOperations are skipped. Every entry is
+// synced to disk before Audit returns
+func (l *AuditLog) Audit(_ context.Context, record AuditRecord) error {
+	if !AuditedOperations[record.Annotation.Operation] {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := AuditEntry{Sequence: l.sequence + 1, At: time.Now().UTC(), Record: record, PrevHash: l.lastHash}
+	hash, err := entry.computeHash()
+	if err != nil {
+		return errors.Wrap(err, "unable to hash audit log entry")
+	}
+	entry.Hash = hash
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal audit log entry")
+	}
+	n, err := l.file.Write(append(b, '\n'))
+	if err != nil {
+		// a partly written entry would be glued to the next one
+		if n > 0 {
+			l.file.Truncate(l.size)
+		}
+		return errors.Wrap(err, "unable to write audit log entry")
+	}
+	// the entry is in the file even when it could not be synced, the next one must be chained to it
+	l.size += int64(n)
+	l.sequence, l.lastHash = entry.Sequence, entry.Hash
+	if err := l.file.Sync(); err != nil {
+		return errors.Wrap(err, "unable to sync audit log")
+	}
+	return nil
+}
+
+// AuditLogError is the first entry of an audit log that breaks its chain, Line counts from 1
+type AuditLogError struct {
+	Line   int
+	Reason string
+}
+
+func (e *AuditLogError) Error() string {
+	return fmt.Sprintf("pawapay: audit log line %d: %s", e.Line, e.Reason)
+}
+
+// VerifyAuditLog checks the chain of an audit log and returns its last entry. An *AuditLogError is returned for the
+// first entry that was altered or that does not follow the one before it. Entries removed from the end of the log
+// can only be detected by keeping the hash of the last entry somewhere else and comparing it with the one returned
+func VerifyAuditLog(r io.Reader) (AuditEntry, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+
+	var previous AuditEntry
+	for line := 1; scanner.Scan(); line++ {
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+
+		var entry AuditEntry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			return previous, &AuditLogError{Line: line, Reason: fmt.Sprintf("not an audit log entry: %s", err)}
+		}
+		switch {
+		case entry.Sequence != previous.Sequence+1:
+			return previous, &AuditLogError{Line: line,
+				Reason: fmt.Sprintf("sequence %d follows %d, entries are missing", entry.Sequence, previous.Sequence)}
+		case entry.PrevHash != previous.Hash:
+			return previous, &AuditLogError{Line: line, Reason: "previous hash does not match the entry before it"}
+		}
+		hash, err := entry.computeHash()
+		if err != nil {
+			return previous, errors.Wrap(err, "unable to hash audit log entry")
+		}
+		if hash != entry.Hash {
+			return previous, &AuditLogError{Line: line, Reason: "hash does not match, the entry was altered"}
+		}
+		previous = entry
+	}
+	if err := scanner.Err(); err != nil {
+		return previous, errors.Wrap(err, "unable to read audit log")
+	}
+	return previous, nil
+}
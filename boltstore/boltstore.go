@@ -0,0 +1,93 @@
+// Package boltstore is a pawapay.TransactionStore backed by an embedded bolt database, it is kept apart so that the
+// pawapay package does not depend on bolt
+package boltstore
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/Uchencho/pawapay"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var transactionsBucket = []byte("transactions")
+
+// TransactionStore is a pawapay.TransactionStore backed by an embedded bolt database file
+type TransactionStore struct {
+	db *bolt.DB
+}
+
+// NewTransactionStore opens, or creates, the bolt database at path. Close it when done
+func NewTransactionStore(path string) (*TransactionStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open transaction database")
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(transactionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "unable to create transactions bucket")
+	}
+	return &TransactionStore{db: db}, nil
+}
+
+// Close closes the underlying database
+func (b *TransactionStore) Close() error { return b.db.Close() }
+
+// RecordEvent implements pawapay.TransactionStore
+func (b *TransactionStore) RecordEvent(e pawapay.TransactionEvent) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(transactionsBucket)
+
+		var r pawapay.TransactionRecord
+		if v := bucket.Get([]byte(e.ID)); v != nil {
+			if err := json.Unmarshal(v, &r); err != nil {
+				return errors.Wrap(err, "unable to unmarshal transaction")
+			}
+		}
+		r.Apply(e)
+
+		v, err := json.Marshal(r)
+		if err != nil {
+			return errors.Wrap(err, "unable to marshal transaction")
+		}
+		return bucket.Put([]byte(e.ID), v)
+	})
+}
+
+// GetTransaction implements pawapay.TransactionStore
+func (b *TransactionStore) GetTransaction(id string) (pawapay.TransactionRecord, error) {
+	var r pawapay.TransactionRecord
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(transactionsBucket).Get([]byte(id))
+		if v == nil {
+			return pawapay.ErrTransactionNotFound
+		}
+		return errors.Wrap(json.Unmarshal(v, &r), "unable to unmarshal transaction")
+	})
+	return r, err
+}
+
+// FindTransactions implements pawapay.TransactionStore, it goes through every record
+func (b *TransactionStore) FindTransactions(q pawapay.TransactionQuery) ([]pawapay.TransactionRecord, error) {
+	var found []pawapay.TransactionRecord
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(transactionsBucket).ForEach(func(_, v []byte) error {
+			var r pawapay.TransactionRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return errors.Wrap(err, "unable to unmarshal transaction")
+			}
+			if q.Matches(r) {
+				found = append(found, r)
+			}
+			return nil
+		})
+	})
+	sort.Slice(found, func(i, j int) bool { return found[i].StatusSince.Before(found[j].StatusSince) })
+	return found, err
+}
@@ -0,0 +1,61 @@
+package boltstore_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Uchencho/pawapay"
+	"github.com/Uchencho/pawapay/boltstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionStore(t *testing.T) {
+	const payoutId = "7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01"
+	path := filepath.Join(t.TempDir(), "transactions.db")
+	created := time.Date(2023, 2, 24, 10, 0, 0, 0, time.UTC)
+
+	store, err := boltstore.NewTransactionStore(path)
+	assert.NoError(t, err)
+	for i, status := range []string{"ACCEPTED", "SUBMITTED", "COMPLETED"} {
+		assert.NoError(t, store.RecordEvent(pawapay.TransactionEvent{ID: payoutId, Type: pawapay.PayoutTransaction,
+			Correspondent: "MTN_MOMO_GHA", Currency: "GHS", Country: "GHA", Amount: "100", Status: status,
+			Source: pawapay.SourceGet, At: created.Add(time.Duration(i) * time.Minute)}))
+	}
+	assert.NoError(t, store.Close())
+
+	store, err = boltstore.NewTransactionStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	t.Run("Records survive reopening the database with their history", func(t *testing.T) {
+		record, err := store.GetTransaction(payoutId)
+		assert.NoError(t, err)
+		assert.Equal(t, "COMPLETED", record.Status)
+		assert.Equal(t, "GHS", record.Currency)
+		assert.Equal(t, created.Add(2*time.Minute), record.StatusSince)
+		statuses := []string{}
+		for _, transition := range record.History {
+			statuses = append(statuses, transition.Status)
+		}
+		assert.Equal(t, []string{"ACCEPTED", "SUBMITTED", "COMPLETED"}, statuses)
+	})
+
+	t.Run("Records are found by query", func(t *testing.T) {
+		found, err := store.FindTransactions(pawapay.TransactionQuery{Type: pawapay.PayoutTransaction,
+			Statuses: []string{"completed"}})
+		assert.NoError(t, err)
+		if assert.Len(t, found, 1) {
+			assert.Equal(t, payoutId, found[0].ID)
+		}
+
+		found, err = store.FindTransactions(pawapay.TransactionQuery{Type: pawapay.DepositTransaction})
+		assert.NoError(t, err)
+		assert.Empty(t, found)
+	})
+
+	t.Run("Unknown transactions are not found", func(t *testing.T) {
+		_, err := store.GetTransaction("unknown")
+		assert.ErrorIs(t, err, pawapay.ErrTransactionNotFound)
+	})
+}
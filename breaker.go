@@ -0,0 +1,245 @@
+package pawapay
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Operation types as listed for each correspondent in momo.json
+const (
+	PayoutOperation  = "PAYOUT"
+	DepositOperation = "DEPOSIT"
+)
+
+// BreakerState is the state of a correspondent's circuit
+type BreakerState string
+
+const (
+	// BreakerClosed lets requests through
+	BreakerClosed BreakerState = "CLOSED"
+	// BreakerOpen fails requests fast until the cool-down has elapsed
+	BreakerOpen BreakerState = "OPEN"
+	// BreakerHalfOpen lets a single trial request through to decide whether to close or re-open
+	BreakerHalfOpen BreakerState = "HALF_OPEN"
+)
+
+// CircuitBreakerConfig configures when a circuit trips
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures that opens a circuit, defaults to 5
+	FailureThreshold int
+	// CoolDown is how long a circuit stays open before a trial request is let through, defaults to 1 minute
+	CoolDown time.Duration
+	// RejectionCodes are the rejection codes returned by pawapay that count as an operator failure.
+	// Defaults to CORRESPONDENT_TEMPORARILY_UNAVAILABLE
+	RejectionCodes []string
+}
+
+// CircuitStatus is a snapshot of a single circuit
+type CircuitStatus struct {
+	Correspondent       string
+	OperationType       string
+	State               BreakerState
+	ConsecutiveFailures int
+	OpenedAt            time.Time
+	RetryAt             time.Time
+}
+
+// CircuitOpenError is returned when a request is not sent because its correspondent's circuit is open
+type CircuitOpenError struct {
+	Correspondent string
+	OperationType string
+	RetryAt       time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return "pawapay: " + e.Correspondent + " is temporarily unavailable for " + strings.ToLower(e.OperationType) +
+		", retry after " + e.RetryAt.Format(time.RFC3339)
+}
+
+type circuitKey struct {
+	correspondent string
+	operationType string
+}
+
+type circuit struct {
+	state     BreakerState
+	failures  int
+	openedAt  time.Time
+	trialSent bool
+}
+
+// CircuitBreaker tracks the health of each correspondent and operation type pair
+type CircuitBreaker struct {
+	config CircuitBreakerConfig
+	now    TimeProviderFunc
+
+	mu       sync.Mutex
+	circuits map[circuitKey]*circuit
+}
+
+// NewCircuitBreaker returns a circuit breaker, pass it to the service through Config.CircuitBreaker
+func NewCircuitBreaker(c CircuitBreakerConfig) *CircuitBreaker {
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = 5
+	}
+	if c.CoolDown <= 0 {
+		c.CoolDown = time.Minute
+	}
+	if len(c.RejectionCodes) == 0 {
+		c.RejectionCodes = []string{"CORRESPONDENT_TEMPORARILY_UNAVAILABLE"}
+	}
+	return &CircuitBreaker{config: c, now: time.Now, circuits: map[circuitKey]*circuit{}}
+}
+
+func (b *CircuitBreaker) get(key circuitKey) *circuit {
+	c, ok := b.circuits[key]
+	if !ok {
+		c = &circuit{state: BreakerClosed}
+		b.circuits[key] = c
+	}
+	if c.state == BreakerOpen && !b.now().Before(c.openedAt.Add(b.config.CoolDown)) {
+		c.state = BreakerHalfOpen
+		c.trialSent = false
+	}
+	return c
+}
+
+// State returns the current state of a correspondent's circuit
+func (b *CircuitBreaker) State(correspondent, operationType string) BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.get(circuitKey{correspondent, operationType}).state
+}
+
+// Statuses returns a snapshot of every circuit the breaker has seen
+func (b *CircuitBreaker) Statuses() []CircuitStatus {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	statuses := make([]CircuitStatus, 0, len(b.circuits))
+	for key := range b.circuits {
+		c := b.get(key)
+		st := CircuitStatus{
+			Correspondent:       key.correspondent,
+			OperationType:       key.operationType,
+			State:               c.state,
+			ConsecutiveFailures: c.failures,
+		}
+		if c.state != BreakerClosed {
+			st.OpenedAt = c.openedAt
+			st.RetryAt = c.openedAt.Add(b.config.CoolDown)
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+// breakerOutcome is what a request says about the health of its correspondent
+type breakerOutcome int
+
+const (
+	outcomeHealthy breakerOutcome = iota
+	outcomeDegraded
+	// outcomeNeutral tells nothing, eg a cancelled request or one refused as invalid. A half-open circuit stays
+	// half-open and lets the next request through as its trial
+	outcomeNeutral
+)
+
+// allow reports whether a request may be sent. The returned func must be called with the outcome of the request
+func (b *CircuitBreaker) allow(correspondent, operationType string) (func(breakerOutcome), error) {
+	if b == nil {
+		return func(breakerOutcome) {}, nil
+	}
+	key := circuitKey{correspondent, operationType}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.get(key)
+	if err := b.refuse(key, c); err != nil {
+		return nil, err
+	}
+	if c.state == BreakerHalfOpen {
+		c.trialSent = true
+	}
+
+	return func(outcome breakerOutcome) { b.record(key, outcome) }, nil
+}
+
+// check returns the error allow would return, without taking the trial of a half-open circuit
+func (b *CircuitBreaker) check(correspondent, operationType string) error {
+	if b == nil {
+		return nil
+	}
+	key := circuitKey{correspondent, operationType}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.refuse(key, b.get(key))
+}
+
+func (b *CircuitBreaker) refuse(key circuitKey, c *circuit) error {
+	if c.state == BreakerOpen || c.state == BreakerHalfOpen && c.trialSent {
+		return &CircuitOpenError{Correspondent: key.correspondent, OperationType: key.operationType,
+			RetryAt: c.openedAt.Add(b.config.CoolDown)}
+	}
+	return nil
+}
+
+func (b *CircuitBreaker) record(key circuitKey, outcome breakerOutcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.get(key)
+	switch outcome {
+	case outcomeNeutral:
+		c.trialSent = false
+		return
+	case outcomeHealthy:
+		c.state, c.failures, c.trialSent = BreakerClosed, 0, false
+		return
+	}
+
+	c.failures++
+	if c.state == BreakerHalfOpen || c.failures >= b.config.FailureThreshold {
+		c.state, c.openedAt, c.trialSent = BreakerOpen, b.now(), false
+	}
+}
+
+// outcome decides what the outcome of a request says about its correspondent. Requests pawapay refuses as invalid
+// are the caller's fault and, like cancelled requests, prove nothing either way
+func (b *CircuitBreaker) outcome(err error, status string, reason RejectionReason) breakerOutcome {
+	if b == nil {
+		return outcomeNeutral
+	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) || IsNotSent(err) {
+			return outcomeNeutral
+		}
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode < http.StatusInternalServerError {
+			return outcomeNeutral
+		}
+		return outcomeDegraded
+	}
+	if !strings.EqualFold(status, "rejected") {
+		return outcomeHealthy
+	}
+	for _, code := range b.config.RejectionCodes {
+		if strings.EqualFold(code, reason.RejectionCode) {
+			return outcomeDegraded
+		}
+	}
+	return outcomeNeutral
+}
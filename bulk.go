@@ -0,0 +1,122 @@
+package pawapay
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultBulkChunkSize is the maximum number of transactions pawapay accepts in a single bulk request
+	DefaultBulkChunkSize = 100
+	// DefaultBulkConcurrency is the number of bulk chunks sent at the same time
+	DefaultBulkConcurrency = 4
+)
+
+// BulkItemOutcome is what happened to a single row of a bulk call
+type BulkItemOutcome string
+
+const (
+	// BulkItemAccepted means pawapay accepted the transaction for processing
+	BulkItemAccepted BulkItemOutcome = "ACCEPTED"
+	// BulkItemRejected means pawapay rejected the transaction, see the response for the reason
+	BulkItemRejected BulkItemOutcome = "REJECTED"
+	// BulkItemDuplicate means pawapay already knows the transaction and ignored it
+	BulkItemDuplicate BulkItemOutcome = "DUPLICATE_IGNORED"
+	// BulkItemInvalid means the row failed local validation and was never sent
+	BulkItemInvalid BulkItemOutcome = "INVALID"
+	// BulkItemFailed means the request carrying the row failed, see Err. Resolve it with a get before resending
+	BulkItemFailed BulkItemOutcome = "FAILED"
+	// BulkItemUnknown means pawapay answered the row with a status that is empty or not one of the above. Resolve it
+	// with a get before resending
+	BulkItemUnknown BulkItemOutcome = "UNKNOWN"
+)
+
+// BulkOptions configures how bulk calls are split up
+type BulkOptions struct {
+	// ChunkSize is the number of rows per request, defaults to DefaultBulkChunkSize
+	ChunkSize int
+	// Concurrency is the number of requests in flight at once, defaults to DefaultBulkConcurrency
+	Concurrency int
+}
+
+// BulkError is returned alongside the result of a bulk call when some of its rows failed validation, failed to send
+// or came back with an unknown status. Rows pawapay rejected are not counted, their rejection is in the result. The
+// rows of the other chunks have already been sent when it is returned and the result always holds the outcome of
+// every row
+type BulkError struct {
+	Invalid int
+	Failed  int
+	Unknown int
+}
+
+func (e *BulkError) Error() string {
+	return fmt.Sprintf("pawapay: bulk call incomplete, %d rows failed validation, %d rows failed to send and %d rows "+
+		"have an unknown outcome", e.Invalid, e.Failed, e.Unknown)
+}
+
+func bulkOutcome(status string) BulkItemOutcome {
+	for _, outcome := range []BulkItemOutcome{BulkItemAccepted, BulkItemRejected, BulkItemDuplicate} {
+		if strings.EqualFold(status, string(outcome)) {
+			return outcome
+		}
+	}
+	return BulkItemUnknown
+}
+
+func bulkError(outcomes []BulkItemOutcome) error {
+	var e BulkError
+	for _, o := range outcomes {
+		switch o {
+		case BulkItemInvalid:
+			e.Invalid++
+		case BulkItemFailed:
+			e.Failed++
+		case BulkItemUnknown:
+			e.Unknown++
+		}
+	}
+	if e.Invalid == 0 && e.Failed == 0 && e.Unknown == 0 {
+		return nil
+	}
+	return &e
+}
+
+// forEachChunk splits n rows into chunks and calls fn for each of them, with at most Concurrency calls at once
+func (s *Service) forEachChunk(n int, fn func(chunk, start, end int)) {
+	size := s.config.Bulk.ChunkSize
+	if size <= 0 {
+		size = DefaultBulkChunkSize
+	}
+	concurrency := s.config.Bulk.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBulkConcurrency
+	}
+
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, concurrency)
+	)
+	for chunk, start := 0, 0; start < n; chunk, start = chunk+1, start+size {
+		end := start + size
+		if end > n {
+			end = n
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(chunk, start, end int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(chunk, start, end)
+		}(chunk, start, end)
+	}
+	wg.Wait()
+}
+
+func chunkCount(n, size int) int {
+	if size <= 0 {
+		size = DefaultBulkChunkSize
+	}
+	return (n + size - 1) / size
+}
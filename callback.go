@@ -0,0 +1,162 @@
+package pawapay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// TransactionType identifies the kind of a transaction
+type TransactionType string
+
+const (
+	PayoutTransaction  TransactionType = "payout"
+	DepositTransaction TransactionType = "deposit"
+	RefundTransaction  TransactionType = "refund"
+)
+
+// CallbackType identifies the kind of transaction a callback is about
+type CallbackType = TransactionType
+
+const (
+	PayoutCallback  = PayoutTransaction
+	DepositCallback = DepositTransaction
+	RefundCallback  = RefundTransaction
+)
+
+// Callback is a decoded pawapay callback, only the field matching Type is populated
+type Callback struct {
+	Type    CallbackType
+	Payout  Payout
+	Deposit Deposit
+	Refund  Refund
+}
+
+// Status returns the status of the transaction the callback is about
+func (c Callback) Status() string {
+	switch c.Type {
+	case PayoutCallback:
+		return c.Payout.Status
+	case DepositCallback:
+		return c.Deposit.Status
+	case RefundCallback:
+		return c.Refund.Status
+	}
+	return ""
+}
+
+// ID returns the id of the transaction the callback is about
+func (c Callback) ID() string {
+	switch c.Type {
+	case PayoutCallback:
+		return c.Payout.PayoutID
+	case DepositCallback:
+		return c.Deposit.DepositId
+	case RefundCallback:
+		return c.Refund.RefundId
+	}
+	return ""
+}
+
+// Metadata returns the metadata of the transaction the callback is about
+func (c Callback) Metadata() map[string]string {
+	switch c.Type {
+	case PayoutCallback:
+		return c.Payout.Metadata
+	case DepositCallback:
+		return c.Deposit.Metadata
+	case RefundCallback:
+		return c.Refund.Metadata
+	}
+	return nil
+}
+
+// ParseCallback decodes the body of a callback sent by pawapay
+// See docs https://docs.pawapay.co.uk/#operation/payoutsCallback for more details
+func (s *Service) ParseCallback(callbackType CallbackType, r io.Reader) (Callback, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return Callback{}, errors.Wrap(err, "unable to read callback body")
+	}
+	cb, err := decodeCallback(callbackType, b)
+	if err != nil {
+		return Callback{}, err
+	}
+	s.observeCallback(cb)
+
+	switch callbackType {
+	case PayoutCallback:
+		s.recordEvents([]TransactionEvent{payoutEvent(cb.Payout, SourceCallback)})
+	case DepositCallback:
+		s.recordEvents([]TransactionEvent{depositEvent(cb.Deposit, SourceCallback)})
+	case RefundCallback:
+		s.recordEvents([]TransactionEvent{refundEvent(cb.Refund, SourceCallback)})
+	}
+
+	return cb, nil
+}
+
+// decodeCallback decodes a callback body without observing or recording it
+func decodeCallback(callbackType CallbackType, b []byte) (Callback, error) {
+	cb := Callback{Type: callbackType}
+
+	var target interface{}
+	switch callbackType {
+	case PayoutCallback:
+		target = &cb.Payout
+	case DepositCallback:
+		target = &cb.Deposit
+	case RefundCallback:
+		target = &cb.Refund
+	default:
+		return Callback{}, fmt.Errorf("unknown callback type %q", callbackType)
+	}
+
+	if err := json.Unmarshal(b, target); err != nil {
+		return Callback{}, errors.Wrap(err, "unable to unmarshal callback body")
+	}
+	return cb, nil
+}
+
+// CallbackHandler returns a http handler that decodes callbacks of the given type and passes them to fn.
+// pawapay is acknowledged with a 200 once fn returns without an error, otherwise the callback is retried by them
+func (s *Service) CallbackHandler(callbackType CallbackType, fn func(Callback) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		cb, err := s.ParseCallback(callbackType, req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := fn(cb); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func (s *Service) observeCallback(cb Callback) {
+	if s.metrics == nil {
+		return
+	}
+
+	o := CallbackObservation{Tenant: s.config.Tenant, Type: cb.Type}
+	switch cb.Type {
+	case PayoutCallback:
+		p := cb.Payout
+		o.Correspondent, o.Currency, o.Country, o.Status = p.Correspondent, p.Currency, p.Country, p.Status
+		o.FailureCode, o.Amount = p.FailureReason.FailureCode, parseAmount(p.Amount)
+	case DepositCallback:
+		d := cb.Deposit
+		o.Correspondent, o.Currency, o.Country, o.Status = d.Correspondent, d.Currency, d.Country, d.Status
+		o.FailureCode, o.Amount = d.FailureReason.FailureCode, parseAmount(d.DepositedAmount)
+	case RefundCallback:
+		f := cb.Refund
+		o.Correspondent, o.Currency, o.Country, o.Status = f.Correspondent, f.Currency, f.Country, f.Status
+		o.FailureCode, o.Amount = f.FailureReason.FailureCode, parseAmount(f.Amount)
+	}
+	s.metrics.ObserveCallback(o)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	"github.com/Uchencho/pawapay"
+)
+
+func listCorrespondents(args []string, stdout, stderr io.Writer) error {
+	fs, opts := newFlagSet("correspondents list", stderr)
+	country := fs.String("country", "", "only list the correspondents of this country, eg GHA")
+	if err := parse(fs, opts, args, 0); err != nil {
+		return err
+	}
+
+	mappings, err := pawapay.GetAllCorrespondents()
+	if err != nil {
+		return err
+	}
+
+	var listed []pawapay.MomoMapping
+	t := table{header: []string{"COUNTRY", "CORRESPONDENT", "OPERATIONS"}}
+	for _, m := range mappings {
+		if *country != "" && !strings.EqualFold(*country, m.Country) {
+			continue
+		}
+		listed = append(listed, m)
+		for _, c := range m.Correspondents {
+			var operations []string
+			for _, o := range c.OperationTypes {
+				operations = append(operations, o.OperationType+":"+o.Status)
+			}
+			t.add(m.Country, c.Correspondent, strings.Join(operations, " "))
+		}
+	}
+	return write(stdout, opts.output, listed, t)
+}
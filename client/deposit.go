@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/Uchencho/pawapay"
+)
+
+// depositsFromFlags builds the deposits of a create command from -file or from the single deposit flags. The ids it
+// generates are printed to stderr once the input is valid, before anything is sent
+func depositsFromFlags(s *pawapay.Service, stderr io.Writer, file, reference string,
+	req pawapay.DepositRequest) ([]pawapay.DepositRequest, error) {
+	var (
+		deposits  []pawapay.DepositRequest
+		generated []string
+	)
+	switch {
+	case file == "":
+		if req.DepositId == "" {
+			req.DepositId = s.NewID(reference)
+			generated = append(generated, req.DepositId)
+		}
+		deposits = []pawapay.DepositRequest{req}
+	case isCSV(file):
+		rows, err := readCSVFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			deposit := pawapay.DepositRequest{
+				DepositId:     row["id"],
+				Amount:        pawapay.Amount{Value: row["amount"], Currency: row["currency"]},
+				Description:   row["description"],
+				PhoneNumber:   pawapay.PhoneNumber{CountryCode: row["country_code"], Number: row["phone"]},
+				Correspondent: row["correspondent"],
+				PreAuthCode:   row["pre_auth_code"],
+				Metadata:      csvMetadata(row),
+			}
+			if deposit.DepositId == "" {
+				deposit.DepositId = s.NewID(row["reference"])
+				generated = append(generated, deposit.DepositId)
+			}
+			deposits = append(deposits, deposit)
+		}
+	default:
+		if err := readJSONFile(file, &deposits); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(deposits) == 0 {
+		return nil, validationErrorf("no deposits to create")
+	}
+	for _, d := range deposits {
+		if err := validateTransaction("depositId", d.DepositId, d.Amount, d.PhoneNumber, d.Correspondent, d.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	announceIDs(stderr, "depositId", generated)
+	return deposits, nil
+}
+
+func createDeposit(args []string, stdout, stderr io.Writer) error {
+	fs, opts := newFlagSet("deposit create", stderr)
+	var (
+		req             pawapay.DepositRequest
+		metadata        metadataFlag
+		file, reference string
+	)
+	fs.StringVar(&req.DepositId, "id", "", "deposit id, generated from -reference when empty")
+	fs.StringVar(&reference, "reference", "", "caller side reference the deposit id is generated from")
+	fs.StringVar(&req.Amount.Value, "amount", "", "amount to collect")
+	fs.StringVar(&req.Amount.Currency, "currency", "", "currency of the amount, eg GHS")
+	fs.StringVar(&req.PhoneNumber.CountryCode, "country-code", "", "calling code of the payer, eg 233")
+	fs.StringVar(&req.PhoneNumber.Number, "phone", "", "phone number of the payer without the calling code")
+	fs.StringVar(&req.Correspondent, "correspondent", "", "correspondent of the payer, eg MTN_MOMO_GHA")
+	fs.StringVar(&req.Description, "description", "", "statement description")
+	fs.StringVar(&req.PreAuthCode, "pre-auth-code", "", "pre authorisation code, for correspondents that require one")
+	fs.Var(&metadata, "metadata", "metadata field as name=value, may be repeated")
+	fs.StringVar(&file, "file", "", "json or csv file of deposits, sent as a bulk deposit when it holds more than one")
+	if err := parse(fs, opts, args, 0); err != nil {
+		return err
+	}
+	req.Metadata = metadata
+
+	s, err := opts.service()
+	if err != nil {
+		return err
+	}
+	deposits, err := depositsFromFlags(s, stderr, file, reference, req)
+	if err != nil {
+		return err
+	}
+
+	if len(deposits) == 1 {
+		response, err := s.InitiateDeposit(time.Now, deposits[0])
+		if err != nil {
+			return err
+		}
+		return writeResults(stdout, opts.output, []result{{ID: deposits[0].DepositId, Status: response.Status,
+			Created: response.Created, RejectionCode: response.RejectionReason.RejectionCode,
+			RejectionMessage: response.RejectionReason.RejectionMessage}}, nil)
+	}
+
+	response, err := s.InitiateBulkDeposit(time.Now, deposits)
+	results := make([]result, 0, len(response.Items))
+	for _, item := range response.Items {
+		results = append(results, result{Index: item.Index, ID: item.Request.DepositId, Outcome: string(item.Outcome),
+			Status: item.Response.Status, Created: item.Response.Created,
+			RejectionCode:    item.Response.RejectionReason.RejectionCode,
+			RejectionMessage: item.Response.RejectionReason.RejectionMessage, Error: errString(item.Err)})
+	}
+	return writeResults(stdout, opts.output, results, err)
+}
+
+func getDeposit(args []string, stdout, stderr io.Writer) error {
+	fs, opts := newFlagSet("deposit get", stderr)
+	if err := parse(fs, opts, args, 1); err != nil {
+		return err
+	}
+	s, err := opts.service()
+	if err != nil {
+		return err
+	}
+
+	deposit, err := s.GetDeposit(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if deposit.IsNotFound() {
+		return rejectedErrorf("deposit %s not found", fs.Arg(0))
+	}
+
+	t := table{header: []string{"ID", "STATUS", "REQUESTED", "DEPOSITED", "CURRENCY", "CORRESPONDENT", "CREATED", "FAILURE"}}
+	t.add(deposit.DepositId, deposit.Status, deposit.RequestedAmount, deposit.DepositedAmount, deposit.Currency,
+		deposit.Correspondent, deposit.Created, deposit.FailureReason.FailureCode)
+	return write(stdout, opts.output, deposit, t)
+}
+
+func resendDepositCallback(args []string, stdout, stderr io.Writer) error {
+	fs, opts := newFlagSet("deposit resend-callback", stderr)
+	if err := parse(fs, opts, args, 1); err != nil {
+		return err
+	}
+	s, err := opts.service()
+	if err != nil {
+		return err
+	}
+
+	response, err := s.ResendDepositCallback(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return writeStatus(stdout, opts.output, fs.Arg(0), response.Status, response)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/Uchencho/pawapay"
+	"github.com/pkg/errors"
+)
+
+// validationError is an error found before anything was sent to pawapay
+type validationError struct{ err error }
+
+func (e validationError) Error() string { return e.err.Error() }
+func (e validationError) Unwrap() error { return e.err }
+
+func validationErrorf(format string, args ...interface{}) error {
+	return validationError{fmt.Errorf(format, args...)}
+}
+
+// rejectedError is returned when pawapay answered a request with a REJECTED status or does not know a transaction
+type rejectedError struct{ msg string }
+
+func (e rejectedError) Error() string { return e.msg }
+
+func rejectedErrorf(format string, args ...interface{}) error {
+	return rejectedError{fmt.Sprintf(format, args...)}
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	var (
+		validation    validationError
+		invalidID     *pawapay.InvalidIDError
+		duplicate     *pawapay.DuplicateIDError
+		metadata      *pawapay.MetadataError
+		callingCode   *pawapay.CallingCodeError
+		overRefund    *pawapay.OverRefundError
+		notRefundable *pawapay.DepositNotRefundableError
+		rejected      rejectedError
+		mismatch      *pawapay.IDMismatchError
+		statusErr     *pawapay.StatusError
+		circuit       *pawapay.CircuitOpenError
+		bulkErr       *pawapay.BulkError
+		netErr        net.Error
+	)
+	switch {
+	case errors.As(err, &validation), errors.As(err, &invalidID), errors.As(err, &duplicate),
+		errors.As(err, &metadata), errors.As(err, &callingCode), errors.As(err, &overRefund),
+		errors.As(err, &notRefundable):
+		return exitValidation
+	case errors.As(err, &rejected), errors.As(err, &mismatch):
+		return exitRejected
+	case errors.As(err, &statusErr):
+		if statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests {
+			return exitNetwork
+		}
+		return exitRejected
+	case errors.As(err, &circuit), errors.As(err, &netErr),
+		errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return exitNetwork
+	case errors.As(err, &bulkErr):
+		if bulkErr.Failed > 0 || bulkErr.Unknown > 0 {
+			return exitNetwork
+		}
+		return exitValidation
+	}
+	return exitFailure
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Uchencho/pawapay"
+	"github.com/pkg/errors"
+)
+
+// metadataFlag collects repeated -metadata name=value flags
+type metadataFlag []pawapay.MetadataField
+
+func (m *metadataFlag) String() string { return "" }
+
+func (m *metadataFlag) Set(value string) error {
+	name, fieldValue, ok := strings.Cut(value, "=")
+	if !ok {
+		return errors.Errorf("metadata %q is not in the name=value form", value)
+	}
+	*m = append(*m, pawapay.MetadataField{FieldName: name, FieldValue: fieldValue})
+	return nil
+}
+
+// readJSONFile decodes a json file holding either a single object or an array of them into a slice
+func readJSONFile(path string, v interface{}) error {
+	bb, err := os.ReadFile(path)
+	if err != nil {
+		return validationError{errors.Wrap(err, "unable to read input file")}
+	}
+	trimmed := strings.TrimSpace(string(bb))
+	if !strings.HasPrefix(trimmed, "[") {
+		trimmed = "[" + trimmed + "]"
+	}
+	if err := json.Unmarshal([]byte(trimmed), v); err != nil {
+		return validationError{errors.Wrap(err, "unable to unmarshal input file")}
+	}
+	return nil
+}
+
+// readCSVFile reads a csv file with a header row, every row is returned keyed by its lower cased column name.
+// Columns prefixed with metadata. keep the case of the field name that follows the prefix
+func readCSVFile(path string) ([]map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, validationError{errors.Wrap(err, "unable to open input file")}
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, validationError{errors.Wrap(err, "unable to read csv header")}
+	}
+
+	var rows []map[string]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, validationError{errors.Wrap(err, "unable to read csv row")}
+		}
+		row := map[string]string{}
+		for i, name := range header {
+			row[csvColumn(name)] = strings.TrimSpace(record[i])
+		}
+		rows = append(rows, row)
+	}
+}
+
+func csvColumn(name string) string {
+	name = strings.TrimSpace(name)
+	if strings.HasPrefix(strings.ToLower(name), "metadata.") {
+		return "metadata." + name[len("metadata."):]
+	}
+	return strings.ToLower(name)
+}
+
+func isCSV(path string) bool { return strings.EqualFold(filepath.Ext(path), ".csv") }
+
+// csvMetadata turns the columns prefixed with metadata. into metadata fields
+func csvMetadata(row map[string]string) []pawapay.MetadataField {
+	var names []string
+	for name, value := range row {
+		if strings.HasPrefix(name, "metadata.") && value != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var metadata []pawapay.MetadataField
+	for _, name := range names {
+		metadata = append(metadata, pawapay.MetadataField{FieldName: strings.TrimPrefix(name, "metadata."), FieldValue: row[name]})
+	}
+	return metadata
+}
@@ -1,57 +1,139 @@
+// Command pawapay is a command line client for the pawapay api, meant for operations teams.
+//
+//	pawapay payout create|get|resend-callback|fail-enqueued
+//	pawapay deposit create|get|resend-callback
+//	pawapay refund create|get|resend-callback
+//	pawapay correspondents list
+//
+// The config is read from the yaml or json file given with -config, see pawapay.FileConfig, and every option can be
+// overridden by its environment variable, eg PAWAPAY_ENVIRONMENT and PAWAPAY_API_KEY. Every command accepts
+// -output table|json.
 package main
 
 import (
-	"log"
-	"time"
+	"flag"
+	"fmt"
+	"io"
+	"os"
 
 	"github.com/Uchencho/pawapay"
+	"github.com/pkg/errors"
 )
 
-func main() {
-	cfg := pawapay.GetConfigFromEnvVars()
-	cfg.AllowRequestLogging() // only for debugging, would not advise this for production. Also not necessary, read on for why
-
-	/*
-		You can also explicitly declare the config
-		cfg := pawapay.Config{
-				APIKey:      "key",
-				BaseURL:     "url",
-				LogRequest:  os.Getenv("env") == "production",
-				LogResponse: strings.EqualFold(os.Getenv("env"), "production"),
-			}
-	*/
+// Exit codes, scripts can tell why a command failed without parsing its output
+const (
+	exitOK         = 0
+	exitFailure    = 1 // anything not covered below
+	exitValidation = 2 // bad usage or input, nothing was sent to pawapay
+	exitRejected   = 3 // pawapay answered and rejected the request
+	exitNetwork    = 4 // pawapay could not be reached or was unavailable
+)
 
-	service := pawapay.NewService(cfg)
+const usage = `usage: pawapay <command> <subcommand> [flags] [args]
 
-	amt := pawapay.Amount{Currency: "GHS", Value: "500"}
-	description := "sending money to all my children" // this will be truncated to the first 22 characters
-	pn := pawapay.PhoneNumber{CountryCode: "233", Number: "704584739348"}
+commands:
+  payout create|get|resend-callback|fail-enqueued
+  deposit create|get|resend-callback
+  refund create|get|resend-callback
+  correspondents list
 
-	allCorrespondentMappings, err := pawapay.GetAllCorrespondents()
-	if err != nil {
-		log.Fatal(err)
-	}
+run "pawapay <command> <subcommand> -h" for the flags of a subcommand
+`
+
+type command func(args []string, stdout, stderr io.Writer) error
+
+var commands = map[string]map[string]command{
+	"payout": {
+		"create":          createPayout,
+		"get":             getPayout,
+		"resend-callback": resendPayoutCallback,
+		"fail-enqueued":   failEnqueued,
+	},
+	"deposit": {
+		"create":          createDeposit,
+		"get":             getDeposit,
+		"resend-callback": resendDepositCallback,
+	},
+	"refund": {
+		"create":          createRefund,
+		"get":             getRefund,
+		"resend-callback": resendRefundCallback,
+	},
+	"correspondents": {
+		"list": listCorrespondents,
+	},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
 
-	// each mapping, think country, have a number of correspondents, pick the one you are trying to send money to
-	// ideally you will take this as an input and map to the correspondent of your choice
-	correspondent := allCorrespondentMappings[0].Correspondents[0]
-	req := pawapay.PayoutRequest{
-		Amount:        amt,
-		PhoneNumber:   pn,
-		Description:   description,
-		PayoutId:      "uniqueId",
-		Correspondent: correspondent.Correspondent,
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) < 2 {
+		fmt.Fprint(stderr, usage)
+		return exitValidation
+	}
+	cmd, ok := commands[args[0]][args[1]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0]+" "+args[1], usage)
+		return exitValidation
 	}
 
-	resp, err := service.CreatePayout(time.Now, req)
+	err := cmd(args[2:], stdout, stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
 	if err != nil {
-		log.Printf("something went wrong, we will confirm through their webhook")
+		fmt.Fprintf(stderr, "pawapay: %s\n", err)
+	}
+	return exitCode(err)
+}
+
+// options are the flags shared by every subcommand
+type options struct {
+	config string
+	output string
+	stderr io.Writer
+}
 
-		// even in error, depending on the error, you might have access to the annotation
+func newFlagSet(name string, stderr io.Writer) (*flag.FlagSet, *options) {
+	opts := &options{stderr: stderr}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&opts.config, "config", "", "yaml or json config file, its options are overridden by the PAWAPAY_* env vars")
+	fs.StringVar(&opts.output, "output", "table", "output format, table or json")
+	return fs, opts
+}
 
-		log.Printf("request failed with status code %v, response payload %s, error=%s",
-			resp.Annotation.ResponseCode, resp.Annotation.ResponsePayload, err)
+// parse parses the flags and checks that exactly nArgs positional arguments were given
+func parse(fs *flag.FlagSet, opts *options, args []string, nArgs int) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return validationError{err}
 	}
+	if fs.NArg() != nArgs {
+		return validationErrorf("%s expects %d argument(s), got %d", fs.Name(), nArgs, fs.NArg())
+	}
+	if opts.output != "table" && opts.output != "json" {
+		return validationErrorf("unknown output format %q", opts.output)
+	}
+	return nil
+}
 
-	log.Printf("response: %+v", resp)
+func (o *options) service() (*pawapay.Service, error) {
+	cfg, err := pawapay.LoadConfig(o.config)
+	if err != nil {
+		return nil, validationError{err}
+	}
+	warnings, err := cfg.Validate()
+	for _, w := range warnings {
+		fmt.Fprintf(o.stderr, "pawapay: warning: %s\n", w)
+	}
+	if err != nil {
+		return nil, validationError{err}
+	}
+	service := pawapay.NewService(cfg)
+	return &service, nil
 }
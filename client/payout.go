@@ -0,0 +1,168 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/Uchencho/pawapay"
+	"github.com/pkg/errors"
+)
+
+// payoutsFromFlags builds the payouts of a create command from -file or from the single payout flags. The ids it
+// generates are printed to stderr once the input is valid, before anything is sent
+func payoutsFromFlags(s *pawapay.Service, stderr io.Writer, file, reference string,
+	req pawapay.PayoutRequest) ([]pawapay.PayoutRequest, error) {
+	var (
+		payouts   []pawapay.PayoutRequest
+		generated []string
+	)
+	switch {
+	case file == "":
+		if req.PayoutId == "" {
+			req.PayoutId = s.NewID(reference)
+			generated = append(generated, req.PayoutId)
+		}
+		payouts = []pawapay.PayoutRequest{req}
+	case isCSV(file):
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, validationError{errors.Wrap(err, "unable to open input file")}
+		}
+		defer f.Close()
+
+		reader := pawapay.PayoutCSVReader{NewID: func(reference string) string {
+			id := s.NewID(reference)
+			generated = append(generated, id)
+			return id
+		}}
+		if payouts, err = reader.Read(f); err != nil {
+			return nil, validationError{err}
+		}
+	default:
+		if err := readJSONFile(file, &payouts); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(payouts) == 0 {
+		return nil, validationErrorf("no payouts to create")
+	}
+	for _, p := range payouts {
+		if err := validateTransaction("payoutId", p.PayoutId, p.Amount, p.PhoneNumber, p.Correspondent, p.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	announceIDs(stderr, "payoutId", generated)
+	return payouts, nil
+}
+
+func createPayout(args []string, stdout, stderr io.Writer) error {
+	fs, opts := newFlagSet("payout create", stderr)
+	var (
+		req             pawapay.PayoutRequest
+		metadata        metadataFlag
+		file, reference string
+	)
+	fs.StringVar(&req.PayoutId, "id", "", "payout id, generated from -reference when empty")
+	fs.StringVar(&reference, "reference", "", "caller side reference the payout id is generated from")
+	fs.StringVar(&req.Amount.Value, "amount", "", "amount to pay out")
+	fs.StringVar(&req.Amount.Currency, "currency", "", "currency of the amount, eg GHS")
+	fs.StringVar(&req.PhoneNumber.CountryCode, "country-code", "", "calling code of the recipient, eg 233")
+	fs.StringVar(&req.PhoneNumber.Number, "phone", "", "phone number of the recipient without the calling code")
+	fs.StringVar(&req.Correspondent, "correspondent", "", "correspondent of the recipient, eg MTN_MOMO_GHA")
+	fs.StringVar(&req.Description, "description", "", "statement description")
+	fs.Var(&metadata, "metadata", "metadata field as name=value, may be repeated")
+	fs.StringVar(&file, "file", "", "json or csv file of payouts, sent as a bulk payout when it holds more than one")
+	if err := parse(fs, opts, args, 0); err != nil {
+		return err
+	}
+	req.Metadata = metadata
+
+	s, err := opts.service()
+	if err != nil {
+		return err
+	}
+	payouts, err := payoutsFromFlags(s, stderr, file, reference, req)
+	if err != nil {
+		return err
+	}
+
+	if len(payouts) == 1 {
+		response, err := s.CreatePayout(time.Now, payouts[0])
+		if err != nil {
+			return err
+		}
+		return writeResults(stdout, opts.output, []result{{ID: payouts[0].PayoutId, Status: response.Status,
+			Created: response.Created, RejectionCode: response.RejectionReason.RejectionCode,
+			RejectionMessage: response.RejectionReason.RejectionMessage}}, nil)
+	}
+
+	response, err := s.CreateBulkPayout(time.Now, payouts)
+	results := make([]result, 0, len(response.Items))
+	for _, item := range response.Items {
+		results = append(results, result{Index: item.Index, ID: item.Request.PayoutId, Outcome: string(item.Outcome),
+			Status: item.Response.Status, Created: item.Response.Created,
+			RejectionCode:    item.Response.RejectionReason.RejectionCode,
+			RejectionMessage: item.Response.RejectionReason.RejectionMessage, Error: errString(item.Err)})
+	}
+	return writeResults(stdout, opts.output, results, err)
+}
+
+func getPayout(args []string, stdout, stderr io.Writer) error {
+	fs, opts := newFlagSet("payout get", stderr)
+	if err := parse(fs, opts, args, 1); err != nil {
+		return err
+	}
+	s, err := opts.service()
+	if err != nil {
+		return err
+	}
+
+	payout, err := s.GetPayout(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if payout.IsNotFound() {
+		return rejectedErrorf("payout %s not found", fs.Arg(0))
+	}
+
+	t := table{header: []string{"ID", "STATUS", "AMOUNT", "CURRENCY", "CORRESPONDENT", "CREATED", "FAILURE"}}
+	t.add(payout.PayoutID, payout.Status, payout.Amount, payout.Currency, payout.Correspondent, payout.Created,
+		payout.FailureReason.FailureCode)
+	return write(stdout, opts.output, payout, t)
+}
+
+func resendPayoutCallback(args []string, stdout, stderr io.Writer) error {
+	fs, opts := newFlagSet("payout resend-callback", stderr)
+	if err := parse(fs, opts, args, 1); err != nil {
+		return err
+	}
+	s, err := opts.service()
+	if err != nil {
+		return err
+	}
+
+	response, err := s.ResendPayoutCallback(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return writeStatus(stdout, opts.output, fs.Arg(0), response.Status, response)
+}
+
+func failEnqueued(args []string, stdout, stderr io.Writer) error {
+	fs, opts := newFlagSet("payout fail-enqueued", stderr)
+	if err := parse(fs, opts, args, 1); err != nil {
+		return err
+	}
+	s, err := opts.service()
+	if err != nil {
+		return err
+	}
+
+	response, err := s.FailEnqueued(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return writeStatus(stdout, opts.output, fs.Arg(0), response.Status, response)
+}
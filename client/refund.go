@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io"
+
+	"github.com/Uchencho/pawapay"
+)
+
+// refundsFromFlags builds the refunds of a create command from -file or from the single refund flags. The ids it
+// generates are printed to stderr once the input is valid, before anything is sent
+func refundsFromFlags(s *pawapay.Service, stderr io.Writer, file, reference string,
+	req pawapay.RefundRequest) ([]pawapay.RefundRequest, error) {
+	var (
+		refunds   []pawapay.RefundRequest
+		generated []string
+	)
+	switch {
+	case file == "":
+		if req.RefundId == "" {
+			req.RefundId = s.NewID(reference)
+			generated = append(generated, req.RefundId)
+		}
+		refunds = []pawapay.RefundRequest{req}
+	case isCSV(file):
+		rows, err := readCSVFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			refund := pawapay.RefundRequest{
+				RefundId:  row["id"],
+				DepositId: row["deposit_id"],
+				Amount:    row["amount"],
+				Currency:  row["currency"],
+				Metadata:  csvMetadata(row),
+			}
+			if refund.RefundId == "" {
+				refund.RefundId = s.NewID(row["reference"])
+				generated = append(generated, refund.RefundId)
+			}
+			refunds = append(refunds, refund)
+		}
+	default:
+		if err := readJSONFile(file, &refunds); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(refunds) == 0 {
+		return nil, validationErrorf("no refunds to create")
+	}
+	for _, r := range refunds {
+		if err := pawapay.ValidateID("refundId", r.RefundId); err != nil {
+			return nil, err
+		}
+		if err := pawapay.ValidateID("depositId", r.DepositId); err != nil {
+			return nil, err
+		}
+		if r.Amount == "" {
+			return nil, validationErrorf("refundId %s has no amount", r.RefundId)
+		}
+		if err := pawapay.ValidateMetadata(r.Metadata); err != nil {
+			return nil, validationErrorf("refundId %s: %s", r.RefundId, err)
+		}
+	}
+	announceIDs(stderr, "refundId", generated)
+	return refunds, nil
+}
+
+func createRefund(args []string, stdout, stderr io.Writer) error {
+	fs, opts := newFlagSet("refund create", stderr)
+	var (
+		req             pawapay.RefundRequest
+		metadata        metadataFlag
+		file, reference string
+	)
+	fs.StringVar(&req.RefundId, "id", "", "refund id, generated from -reference when empty")
+	fs.StringVar(&reference, "reference", "", "caller side reference the refund id is generated from")
+	fs.StringVar(&req.DepositId, "deposit-id", "", "id of the deposit to refund")
+	fs.StringVar(&req.Amount, "amount", "", "amount to refund")
+	fs.StringVar(&req.Currency, "currency", "", "currency of the amount, eg GHS, optional")
+	fs.Var(&metadata, "metadata", "metadata field as name=value, may be repeated")
+	fs.StringVar(&file, "file", "", "json or csv file of refunds, sent as a bulk refund when it holds more than one")
+	if err := parse(fs, opts, args, 0); err != nil {
+		return err
+	}
+	req.Metadata = metadata
+
+	s, err := opts.service()
+	if err != nil {
+		return err
+	}
+	refunds, err := refundsFromFlags(s, stderr, file, reference, req)
+	if err != nil {
+		return err
+	}
+
+	if len(refunds) == 1 {
+		r := refunds[0]
+		response, err := s.RequestRefund(r.RefundId, r.DepositId, pawapay.Amount{Value: r.Amount, Currency: r.Currency},
+			r.Metadata...)
+		if err != nil {
+			return err
+		}
+		return writeResults(stdout, opts.output, []result{{ID: r.RefundId, Status: response.Status,
+			Created: response.Created}}, nil)
+	}
+
+	response, err := s.RequestBulkRefund(refunds)
+	results := make([]result, 0, len(response.Items))
+	for _, item := range response.Items {
+		results = append(results, result{Index: item.Index, ID: item.Request.RefundId, Outcome: string(item.Outcome),
+			Status: item.Response.Status, Created: item.Response.Created, Error: errString(item.Err)})
+	}
+	return writeResults(stdout, opts.output, results, err)
+}
+
+func getRefund(args []string, stdout, stderr io.Writer) error {
+	fs, opts := newFlagSet("refund get", stderr)
+	if err := parse(fs, opts, args, 1); err != nil {
+		return err
+	}
+	s, err := opts.service()
+	if err != nil {
+		return err
+	}
+
+	refund, err := s.GetRefund(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if refund.IsNotFound() {
+		return rejectedErrorf("refund %s not found", fs.Arg(0))
+	}
+
+	t := table{header: []string{"ID", "STATUS", "AMOUNT", "CURRENCY", "CORRESPONDENT", "CREATED", "FAILURE"}}
+	t.add(refund.RefundId, refund.Status, refund.Amount, refund.Currency, refund.Correspondent, refund.Created,
+		refund.FailureReason.FailureCode)
+	return write(stdout, opts.output, refund, t)
+}
+
+func resendRefundCallback(args []string, stdout, stderr io.Writer) error {
+	fs, opts := newFlagSet("refund resend-callback", stderr)
+	if err := parse(fs, opts, args, 1); err != nil {
+		return err
+	}
+	s, err := opts.service()
+	if err != nil {
+		return err
+	}
+
+	response, err := s.ResendRefundCallback(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return writeStatus(stdout, opts.output, fs.Arg(0), response.Status, response)
+}
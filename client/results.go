@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/Uchencho/pawapay"
+	"github.com/pariz/gountries"
+)
+
+// result is the outcome of a single transaction sent by a create command
+type result struct {
+	Index            int    `json:"index"`
+	ID               string `json:"id"`
+	Outcome          string `json:"outcome,omitempty"`
+	Status           string `json:"status,omitempty"`
+	Created          string `json:"created,omitempty"`
+	RejectionCode    string `json:"rejectionCode,omitempty"`
+	RejectionMessage string `json:"rejectionMessage,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// writeResults prints the results of a create command, a rejectedError is returned when pawapay rejected any of
+// them and err is nil
+func writeResults(w io.Writer, format string, results []result, err error) error {
+	t := table{header: []string{"#", "ID", "OUTCOME", "STATUS", "CREATED", "REJECTION", "ERROR"}}
+	rejected := 0
+	for _, r := range results {
+		if strings.EqualFold(r.Status, "REJECTED") {
+			rejected++
+		}
+		t.add(strconv.Itoa(r.Index), r.ID, r.Outcome, r.Status, r.Created, r.RejectionCode, r.Error)
+	}
+	if writeErr := write(w, format, results, t); writeErr != nil {
+		return writeErr
+	}
+
+	if err == nil && rejected > 0 {
+		return rejectedErrorf("%d of %d transaction(s) were rejected", rejected, len(results))
+	}
+	return err
+}
+
+// writeStatus prints the answer to a resend-callback or fail-enqueued
+func writeStatus(w io.Writer, format, id, status string, v interface{}) error {
+	t := table{header: []string{"ID", "STATUS"}}
+	t.add(id, status)
+	if err := write(w, format, v, t); err != nil {
+		return err
+	}
+	if strings.EqualFold(status, "REJECTED") {
+		return rejectedErrorf("%s was rejected", id)
+	}
+	return nil
+}
+
+// announceIDs prints the ids the client generated before their transactions are sent, so that they can be looked
+// up even when the command fails or is interrupted before printing its results
+func announceIDs(w io.Writer, field string, ids []string) {
+	for _, id := range ids {
+		fmt.Fprintf(w, "pawapay: generated %s %s\n", field, id)
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// validateTransaction runs the checks pawapay would, so that invalid input never reaches it
+func validateTransaction(field, id string, amount pawapay.Amount, phone pawapay.PhoneNumber, correspondent string,
+	metadata []pawapay.MetadataField) error {
+	if err := pawapay.ValidateID(field, id); err != nil {
+		return err
+	}
+	if _, err := strconv.ParseFloat(amount.Value, 64); err != nil {
+		return validationErrorf("%s %s has an invalid amount %q", field, id, amount.Value)
+	}
+	if amount.Currency == "" {
+		return validationErrorf("%s %s has no currency", field, id)
+	}
+	if correspondent == "" {
+		return validationErrorf("%s %s has no correspondent", field, id)
+	}
+	if phone.Number == "" {
+		return validationErrorf("%s %s has no phone number", field, id)
+	}
+	if _, err := gountries.New().FindCountryByCallingCode(phone.CountryCode); err != nil {
+		return validationErrorf("%s %s has an unknown country code %q", field, id, phone.CountryCode)
+	}
+	if err := pawapay.ValidateMetadata(metadata); err != nil {
+		return validationError{fmt.Errorf("%s %s: %w", field, id, err)}
+	}
+	return nil
+}
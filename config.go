@@ -0,0 +1,306 @@
+package pawapay
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Environment names a pawapay environment
+type Environment string
+
+const (
+	Sandbox    Environment = "sandbox"
+	Production Environment = "production"
+)
+
+var environmentURLs = map[Environment]string{
+	Sandbox:    "https://api.sandbox.pawapay.cloud",
+	Production: "https://api.pawapay.cloud",
+}
+
+// BaseURL returns the api url of the environment, empty for an unknown environment
+func (e Environment) BaseURL() string {
+	return environmentURLs[Environment(strings.ToLower(string(e)))]
+}
+
+// environmentOf returns the environment whose api url is baseURL, empty when it is neither
+func environmentOf(baseURL string) Environment {
+	for env, u := range environmentURLs {
+		if strings.EqualFold(strings.TrimSuffix(baseURL, "/"), u) {
+			return env
+		}
+	}
+	return ""
+}
+
+// baseURL returns BaseURL, or the url of Environment when it is not set
+func (c Config) baseURL() string {
+	if c.BaseURL != "" {
+		return c.BaseURL
+	}
+	return c.Environment.BaseURL()
+}
+
+// ConfigError lists what makes a config unusable
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("pawapay: invalid config: %s", strings.Join(e.Problems, "; "))
+}
+
+// Validate checks the config before any request is made. What would make every request fail is returned as a
+// *ConfigError, doubts such as a production key used against the sandbox are returned as warnings
+func (c Config) Validate() (warnings []string, err error) {
+	var problems []string
+
+	if c.Environment != "" && c.Environment.BaseURL() == "" {
+		problems = append(problems, fmt.Sprintf("unknown environment %q, expected sandbox or production", c.Environment))
+	}
+
+	baseURL := c.baseURL()
+	u, parseErr := url.Parse(baseURL)
+	switch {
+	case baseURL == "":
+		problems = append(problems, "base url is not set, set BaseURL or Environment")
+	case parseErr != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http"):
+		problems = append(problems, fmt.Sprintf("base url %q is not an absolute http(s) url", baseURL))
+	case u.Scheme == "http" && !isLoopback(u.Hostname()):
+		warnings = append(warnings, fmt.Sprintf("base url %s is not https", baseURL))
+	}
+	if c.BaseURL != "" && c.Environment.BaseURL() != "" && environmentOf(c.BaseURL) != Environment(strings.ToLower(string(c.Environment))) {
+		warnings = append(warnings, fmt.Sprintf("base url %s overrides the %s url", c.BaseURL, c.Environment))
+	}
+
+	provider := newCredentials(c).provider
+	keys, keysErr := provider.APIKeys(context.Background())
+	switch {
+	case keysErr != nil:
+		problems = append(problems, fmt.Sprintf("unable to get api keys: %s", keysErr))
+	case len(keys) == 0 || (len(keys) == 1 && keys[0] == ""):
+		problems = append(problems, "api key is not set")
+	}
+	urlEnv := environmentOf(baseURL)
+	for i, key := range keys {
+		if key == "" {
+			continue
+		}
+		if strings.ContainsAny(key, " \t\r\n") {
+			problems = append(problems, fmt.Sprintf("api key %d contains whitespace", i+1))
+			continue
+		}
+		keyEnv, ok := keyEnvironment(key)
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("api key %d is not a pawapay api token", i+1))
+			continue
+		}
+		if keyEnv != "" && urlEnv != "" && keyEnv != urlEnv {
+			warnings = append(warnings, fmt.Sprintf("api key %d was issued for %s but is used against %s", i+1, keyEnv, urlEnv))
+		}
+	}
+
+	if len(problems) > 0 {
+		return warnings, &ConfigError{Problems: problems}
+	}
+	return warnings, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// keyEnvironment tells the environment a key was issued for. Keys are JWTs, the environment is read from their env
+// claim or from an issuer naming the sandbox and is empty when the claims do not tell. ok is false when key is not a
+// JWT at all
+func keyEnvironment(key string) (env Environment, ok bool) {
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", false
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", false
+	}
+
+	for _, name := range []string{"env", "environment"} {
+		if v, _ := claims[name].(string); v != "" {
+			switch strings.ToLower(v) {
+			case "sandbox", "test":
+				return Sandbox, true
+			case "production", "prod", "live":
+				return Production, true
+			}
+		}
+	}
+	if iss, _ := claims["iss"].(string); strings.Contains(strings.ToLower(iss), "sandbox") {
+		return Sandbox, true
+	}
+	return "", true
+}
+
+// FileConfig is the content of a yaml or json config file read by LoadConfig. Every option can be overridden by the
+// environment variable named in its env tag
+type FileConfig struct {
+	Environment Environment `json:"environment" yaml:"environment" env:"PAWAPAY_ENVIRONMENT"`
+	BaseURL     string      `json:"baseURL" yaml:"baseURL" env:"PAWAPAY_API_URL"`
+	APIKey      string      `json:"apiKey" yaml:"apiKey" env:"PAWAPAY_API_KEY"`
+	// APIKeyFile is read by FileCredentials, it takes precedence over APIKey
+	APIKeyFile  string `json:"apiKeyFile" yaml:"apiKeyFile" env:"PAWAPAY_API_KEY_FILE"`
+	LogRequest  bool   `json:"logRequest" yaml:"logRequest" env:"PAWAPAY_LOG_REQUEST"`
+	LogResponse bool   `json:"logResponse" yaml:"logResponse" env:"PAWAPAY_LOG_RESPONSE"`
+	Tenant      string `json:"tenant" yaml:"tenant" env:"PAWAPAY_TENANT"`
+	// Timeout of a request, eg 30s, defaults to 60 seconds
+	Timeout string `json:"timeout" yaml:"timeout" env:"PAWAPAY_TIMEOUT"`
+
+	RateLimit struct {
+		RequestsPerSecond float64 `json:"requestsPerSecond" yaml:"requestsPerSecond" env:"PAWAPAY_RATE_LIMIT_RPS"`
+		Burst             int     `json:"burst" yaml:"burst" env:"PAWAPAY_RATE_LIMIT_BURST"`
+		MaxInFlight       int     `json:"maxInFlight" yaml:"maxInFlight" env:"PAWAPAY_RATE_LIMIT_MAX_IN_FLIGHT"`
+		MaxRetries        int     `json:"maxRetries" yaml:"maxRetries" env:"PAWAPAY_RATE_LIMIT_MAX_RETRIES"`
+	} `json:"rateLimit" yaml:"rateLimit"`
+
+	Bulk struct {
+		ChunkSize   int `json:"chunkSize" yaml:"chunkSize" env:"PAWAPAY_BULK_CHUNK_SIZE"`
+		Concurrency int `json:"concurrency" yaml:"concurrency" env:"PAWAPAY_BULK_CONCURRENCY"`
+	} `json:"bulk" yaml:"bulk"`
+
+	Annotations struct {
+		OmitURL             bool `json:"omitURL" yaml:"omitURL" env:"PAWAPAY_ANNOTATION_OMIT_URL"`
+		RequestPayload      bool `json:"requestPayload" yaml:"requestPayload" env:"PAWAPAY_ANNOTATION_REQUEST_PAYLOAD"`
+		OmitResponsePayload bool `json:"omitResponsePayload" yaml:"omitResponsePayload" env:"PAWAPAY_ANNOTATION_OMIT_RESPONSE_PAYLOAD"`
+		// RedactPhoneNumbers applies RedactPhoneNumbers to the payloads captured
+		RedactPhoneNumbers bool `json:"redactPhoneNumbers" yaml:"redactPhoneNumbers" env:"PAWAPAY_ANNOTATION_REDACT_PHONE_NUMBERS"`
+		OmitTiming         bool `json:"omitTiming" yaml:"omitTiming" env:"PAWAPAY_ANNOTATION_OMIT_TIMING"`
+		OmitHeaders        bool `json:"omitHeaders" yaml:"omitHeaders" env:"PAWAPAY_ANNOTATION_OMIT_HEADERS"`
+	} `json:"annotations" yaml:"annotations"`
+}
+
+// LoadConfig reads the config file at path, as json when it ends in .json and as yaml otherwise, then applies the
+// environment variable overrides. Only the environment is read when path is empty. The config is not validated
+func LoadConfig(path string) (Config, error) {
+	var fc FileConfig
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, errors.Wrap(err, "unable to read config file")
+		}
+		if strings.EqualFold(filepath.Ext(path), ".json") {
+			decoder := json.NewDecoder(bytes.NewReader(b))
+			decoder.DisallowUnknownFields()
+			err = decoder.Decode(&fc)
+		} else {
+			decoder := yaml.NewDecoder(bytes.NewReader(b))
+			decoder.KnownFields(true)
+			err = decoder.Decode(&fc)
+		}
+		if err != nil {
+			return Config{}, errors.Wrapf(err, "unable to unmarshal config file %s", path)
+		}
+	}
+	if err := applyEnvOverrides(reflect.ValueOf(&fc).Elem()); err != nil {
+		return Config{}, err
+	}
+	return fc.Config()
+}
+
+// applyEnvOverrides sets every field of v whose env tag names a set environment variable
+func applyEnvOverrides(v reflect.Value) error {
+	for i := 0; i < v.NumField(); i++ {
+		field, f := v.Field(i), v.Type().Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvOverrides(field); err != nil {
+				return err
+			}
+			continue
+		}
+		name := f.Tag.Get("env")
+		value, ok := os.LookupEnv(name)
+		if name == "" || !ok {
+			continue
+		}
+
+		var err error
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(value)
+		case reflect.Bool:
+			var b bool
+			b, err = strconv.ParseBool(value)
+			field.SetBool(b)
+		case reflect.Int:
+			var n int64
+			n, err = strconv.ParseInt(value, 10, 64)
+			field.SetInt(n)
+		case reflect.Float64:
+			var n float64
+			n, err = strconv.ParseFloat(value, 64)
+			field.SetFloat(n)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "invalid value for %s", name)
+		}
+	}
+	return nil
+}
+
+// Config returns the service config described by the file
+func (fc FileConfig) Config() (Config, error) {
+	c := Config{
+		Environment: fc.Environment,
+		BaseURL:     fc.BaseURL,
+		APIKey:      fc.APIKey,
+		LogRequest:  fc.LogRequest,
+		LogResponse: fc.LogResponse,
+		Tenant:      fc.Tenant,
+		Bulk:        BulkOptions{ChunkSize: fc.Bulk.ChunkSize, Concurrency: fc.Bulk.Concurrency},
+		Annotations: AnnotationPolicy{OmitURL: fc.Annotations.OmitURL, RequestPayload: fc.Annotations.RequestPayload,
+			OmitResponsePayload: fc.Annotations.OmitResponsePayload, OmitTiming: fc.Annotations.OmitTiming,
+			OmitHeaders: fc.Annotations.OmitHeaders},
+	}
+	if fc.Annotations.RedactPhoneNumbers {
+		c.Annotations.Redact = RedactPhoneNumbers
+	}
+	if fc.APIKeyFile != "" {
+		credentials, err := NewFileCredentials(fc.APIKeyFile)
+		if err != nil {
+			return Config{}, err
+		}
+		c.Credentials = credentials
+	}
+	if fc.Timeout != "" {
+		timeout, err := time.ParseDuration(fc.Timeout)
+		if err != nil {
+			return Config{}, errors.Wrap(err, "invalid timeout")
+		}
+		c.HTTPClient = &http.Client{Timeout: timeout}
+	}
+	if r := fc.RateLimit; r.RequestsPerSecond > 0 || r.MaxInFlight > 0 || r.MaxRetries > 0 {
+		c.RateLimit = &RateLimit{Limit: Limit{RequestsPerSecond: r.RequestsPerSecond, Burst: r.Burst},
+			MaxInFlight: r.MaxInFlight, MaxRetries: r.MaxRetries}
+	}
+	return c, nil
+}
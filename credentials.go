@@ -0,0 +1,227 @@
+package pawapay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CredentialProvider supplies the api keys of a service. It is queried on every request so that keys can be rotated
+// without restarting the service. Keys are returned preferred first, while a rotation is in progress both the new and
+// the old key are returned so that a request pawapay rejects with one is retried with the other
+type CredentialProvider interface {
+	APIKeys(ctx context.Context) ([]string, error)
+}
+
+// CredentialRefresher is implemented by providers that cache keys. Refresh is called when pawapay rejects a key so
+// that the retry is made with freshly fetched keys
+type CredentialRefresher interface {
+	Refresh(ctx context.Context) error
+}
+
+// StaticCredentials are keys fixed for the lifetime of the service, Config.APIKey is used as such when
+// Config.Credentials is not set
+type StaticCredentials []string
+
+// APIKeys implements CredentialProvider
+func (c StaticCredentials) APIKeys(context.Context) ([]string, error) { return c, nil }
+
+// EnvCredentials reads keys from the named environment variables on every request, unset variables are skipped
+type EnvCredentials []string
+
+// DefaultEnvCredentials reads PAWAPAY_API_KEY, along with PAWAPAY_API_KEY_PREVIOUS while a rotation is in progress
+var DefaultEnvCredentials = EnvCredentials{"PAWAPAY_API_KEY", "PAWAPAY_API_KEY_PREVIOUS"}
+
+// APIKeys implements CredentialProvider
+func (c EnvCredentials) APIKeys(context.Context) ([]string, error) {
+	var keys []string
+	for _, name := range c {
+		if key := strings.TrimSpace(os.Getenv(name)); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// CredentialProviderFunc adapts a func, eg one reading a secret store, to a CredentialProvider
+type CredentialProviderFunc func(ctx context.Context) ([]string, error)
+
+// APIKeys implements CredentialProvider
+func (f CredentialProviderFunc) APIKeys(ctx context.Context) ([]string, error) { return f(ctx) }
+
+// FileCredentials reads keys from a file holding one key per line, preferred first. Blank lines and lines starting
+// with # are ignored. The file is read again whenever its modification time or size changes, so keys are rotated by
+// rewriting it
+type FileCredentials struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	keys    []string
+}
+
+// NewFileCredentials returns credentials read from the file at path, which must exist
+func NewFileCredentials(path string) (*FileCredentials, error) {
+	c := &FileCredentials{path: path}
+	if err := c.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// APIKeys implements CredentialProvider
+func (c *FileCredentials) APIKeys(context.Context) ([]string, error) {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to stat credentials file")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if info.ModTime().Equal(c.modTime) && info.Size() == c.size {
+		return c.keys, nil
+	}
+	return c.read()
+}
+
+// Refresh implements CredentialRefresher, the file is read again even when it looks unchanged
+func (c *FileCredentials) Refresh(context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.read()
+	return err
+}
+
+func (c *FileCredentials) read() ([]string, error) {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to stat credentials file")
+	}
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read credentials file")
+	}
+
+	var keys []string
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	c.modTime, c.size, c.keys = info.ModTime(), info.Size(), keys
+	return keys, nil
+}
+
+// CachedCredentials wraps a provider that is slow to query, eg a secret store, and reuses its keys for ttl
+type CachedCredentials struct {
+	provider CredentialProvider
+	ttl      time.Duration
+
+	mu        sync.Mutex
+	keys      []string
+	fetchedAt time.Time
+}
+
+// NewCachedCredentials returns provider cached for ttl
+func NewCachedCredentials(provider CredentialProvider, ttl time.Duration) *CachedCredentials {
+	return &CachedCredentials{provider: provider, ttl: ttl}
+}
+
+// APIKeys implements CredentialProvider
+func (c *CachedCredentials) APIKeys(ctx context.Context) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.fetchedAt.IsZero() && time.Since(c.fetchedAt) < c.ttl {
+		return c.keys, nil
+	}
+	keys, err := c.provider.APIKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.keys, c.fetchedAt = keys, time.Now()
+	return keys, nil
+}
+
+// Refresh implements CredentialRefresher, the next call to APIKeys queries the wrapped provider
+func (c *CachedCredentials) Refresh(ctx context.Context) error {
+	c.mu.Lock()
+	c.fetchedAt = time.Time{}
+	c.mu.Unlock()
+	if r, ok := c.provider.(CredentialRefresher); ok {
+		return r.Refresh(ctx)
+	}
+	return nil
+}
+
+// credentials picks the key of each request. It sticks to the last key pawapay accepted for as long as the provider
+// returns it, so that requests made while a rotation is in progress are not all rejected once before being retried
+type credentials struct {
+	provider CredentialProvider
+
+	mu       sync.Mutex
+	accepted string
+}
+
+func newCredentials(c Config) *credentials {
+	if c.Credentials != nil {
+		return &credentials{provider: c.Credentials}
+	}
+	return &credentials{provider: StaticCredentials{c.APIKey}}
+}
+
+// key returns the key to use, skipping the one pawapay just rejected
+func (c *credentials) key(ctx context.Context, rejected string) (string, error) {
+	keys, err := c.provider.APIKeys(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "client - unable to get api key")
+	}
+
+	c.mu.Lock()
+	accepted := c.accepted
+	c.mu.Unlock()
+
+	var candidates []string
+	for _, key := range keys {
+		if rejected != "" && key == rejected {
+			continue
+		}
+		if key == accepted {
+			return key, nil
+		}
+		candidates = append(candidates, key)
+	}
+	if len(candidates) == 0 {
+		return "", errors.New("client - no api key available")
+	}
+	return candidates[0], nil
+}
+
+func (c *credentials) accept(key string) {
+	c.mu.Lock()
+	c.accepted = key
+	c.mu.Unlock()
+}
+
+// retryKey returns the key to retry a request pawapay rejected with, once per request
+func (c *credentials) retryKey(ctx context.Context, rejected, previouslyRejected string) (string, bool) {
+	if previouslyRejected != "" {
+		return "", false
+	}
+	if r, ok := c.provider.(CredentialRefresher); ok {
+		if err := r.Refresh(ctx); err != nil {
+			return "", false
+		}
+	}
+	key, err := c.key(ctx, rejected)
+	return key, err == nil
+}
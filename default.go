@@ -2,6 +2,7 @@ package pawapay
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -47,6 +48,7 @@ type PayoutRequest struct {
 	Description   string
 	PhoneNumber   PhoneNumber
 	Correspondent string
+	Metadata      []MetadataField
 }
 
 type DepositRequest struct {
@@ -56,6 +58,7 @@ type DepositRequest struct {
 	PhoneNumber   PhoneNumber
 	Correspondent string
 	PreAuthCode   string
+	Metadata      []MetadataField
 }
 
 // PhoneNumber holds country code and number, eg countryCode:234, number: 7017238745
@@ -79,17 +82,29 @@ type APIAnnotation struct {
 	RequestPayload  string `json:"requestPayload"`
 	ResponsePayload string `json:"responsePayload"`
 	ResponseCode    int    `json:"responseCode"`
+
+	// Operation names the call, eg payouts.create
+	Operation string `json:"operation,omitempty"`
+	Method    string `json:"method,omitempty"`
+	// StartedAt is when the first attempt was sent and EndedAt when the last response was received
+	StartedAt time.Time     `json:"startedAt"`
+	EndedAt   time.Time     `json:"endedAt"`
+	Duration  time.Duration `json:"duration"`
+	// Headers holds the response headers picked by the annotation policy
+	Headers  map[string]string `json:"headers,omitempty"`
+	Attempts int               `json:"attempts,omitempty"`
 }
 
 type CreatePayoutRequest struct {
-	PayoutId             string    `json:"payoutId"`
-	Amount               string    `json:"amount"`
-	Currency             string    `json:"currency"`
-	Country              string    `json:"country"`
-	Correspondent        string    `json:"correspondent"`
-	Recipient            Recipient `json:"recipient"`
-	CustomerTimestamp    string    `json:"customerTimestamp"`
-	StatementDescription string    `json:"statementDescription"`
+	PayoutId             string          `json:"payoutId"`
+	Amount               string          `json:"amount"`
+	Currency             string          `json:"currency"`
+	Country              string          `json:"country"`
+	Correspondent        string          `json:"correspondent"`
+	Recipient            Recipient       `json:"recipient"`
+	CustomerTimestamp    string          `json:"customerTimestamp"`
+	StatementDescription string          `json:"statementDescription"`
+	Metadata             []MetadataField `json:"metadata,omitempty"`
 }
 
 type Payer struct {
@@ -97,16 +112,34 @@ type Payer struct {
 	Address Address `json:"address"`
 }
 
+type RejectionReason struct {
+	RejectionCode    string `json:"rejectionCode"`
+	RejectionMessage string `json:"rejectionMessage"`
+}
+
 type CreatePayoutResponse struct {
-	PayoutID   string `json:"payoutId"`
-	Status     string `json:"status"`
-	Created    string `json:"created"`
-	Annotation APIAnnotation
+	PayoutID        string          `json:"payoutId"`
+	Status          string          `json:"status"`
+	Created         string          `json:"created"`
+	RejectionReason RejectionReason `json:"rejectionReason"`
+	Annotation      APIAnnotation
+}
+
+// BulkPayoutItem is the outcome of a single row of a bulk payout
+type BulkPayoutItem struct {
+	Index    int
+	Request  PayoutRequest
+	Outcome  BulkItemOutcome
+	Response CreatePayoutResponse
+	Err      error
 }
 
+// CreateBulkPayoutResponse holds one item per row sent, Annotation is that of the first chunk
 type CreateBulkPayoutResponse struct {
-	Result     []CreatePayoutResponse
-	Annotation APIAnnotation
+	Result      []CreatePayoutResponse
+	Items       []BulkPayoutItem
+	Annotation  APIAnnotation
+	Annotations []APIAnnotation
 }
 
 type FailureReason struct {
@@ -127,6 +160,7 @@ type Payout struct {
 	StatementDescription string                 `json:"statementDescription"`
 	Status               string                 `json:"status"`
 	FailureReason        FailureReason          `json:"failureReason"`
+	Metadata             map[string]string      `json:"metadata"`
 	Annotation           APIAnnotation
 }
 
@@ -141,7 +175,7 @@ func (t Payout) IsPending() bool { return !t.IsSuccessful() && !t.IsFailed() &&
 
 // IsNotFound checks a payout response to see if the transaction is not found
 func (t Payout) IsNotFound() bool {
-	return t.Annotation.ResponseCode == 200 && t.Annotation.ResponsePayload == "[]"
+	return t.Annotation.ResponseCode == 200 && t.PayoutID == ""
 }
 
 type ResendCallbackRequest struct {
@@ -157,26 +191,28 @@ type PayoutStatusResponse struct {
 }
 
 type CreateDepositRequest struct {
-	DepositId            string `json:"depositId"`
-	Amount               string `json:"amount"`
-	Currency             string `json:"currency"`
-	Country              string `json:"country"`
-	Correspondent        string `json:"correspondent"`
-	Payer                Payer  `json:"payer"`
-	CustomerTimestamp    string `json:"customerTimestamp"`
-	StatementDescription string `json:"statementDescription"`
-	PreAuthorizationCode string `json:"preAuthorisationCode"`
+	DepositId            string          `json:"depositId"`
+	Amount               string          `json:"amount"`
+	Currency             string          `json:"currency"`
+	Country              string          `json:"country"`
+	Correspondent        string          `json:"correspondent"`
+	Payer                Payer           `json:"payer"`
+	CustomerTimestamp    string          `json:"customerTimestamp"`
+	StatementDescription string          `json:"statementDescription"`
+	PreAuthorizationCode string          `json:"preAuthorisationCode"`
+	Metadata             []MetadataField `json:"metadata,omitempty"`
 }
 
 type CreateDepositResponse struct {
-	DepositId  string `json:"depositId"`
-	Status     string `json:"status"`
-	Created    string `json:"created"`
-	Annotation APIAnnotation
+	DepositId       string          `json:"depositId"`
+	Status          string          `json:"status"`
+	Created         string          `json:"created"`
+	RejectionReason RejectionReason `json:"rejectionReason"`
+	Annotation      APIAnnotation
 }
 
 type InitiateRefundResponse struct {
-	RefundId   string `json:"depositId"`
+	RefundId   string `json:"refundId"`
 	Status     string `json:"status"`
 	Created    string `json:"created"`
 	Annotation APIAnnotation
@@ -198,24 +234,69 @@ type Deposit struct {
 	CorrespondentIds     map[string]interface{} `json:"correspondentIds"`
 	SuspiciousActivity   map[string]interface{} `json:"suspiciousActivityReport"`
 	FailureReason        FailureReason          `json:"failureReason"`
+	Metadata             map[string]string      `json:"metadata"`
 	Annotation           APIAnnotation
 }
 
+// IsSuccessful reports if a deposit is successful
+func (t Deposit) IsSuccessful() bool { return strings.EqualFold(t.Status, "completed") }
+
+// IsFailed reports if a deposit failed
+func (t Deposit) IsFailed() bool { return strings.EqualFold(t.Status, "failed") }
+
+// IsPending reports if a deposit is still pending
+func (t Deposit) IsPending() bool { return !t.IsSuccessful() && !t.IsFailed() && t.Status != "" }
+
+// IsNotFound checks a deposit response to see if the transaction is not found
+func (t Deposit) IsNotFound() bool {
+	return t.Annotation.ResponseCode == 200 && t.DepositId == ""
+}
+
 type DepositStatusResponse struct {
 	DepositId  string `json:"depositId"`
 	Status     string `json:"status"`
 	Annotation APIAnnotation
 }
 
+// RefundRequest is the payload of a refund. Currency is only sent by RequestBulkRefund, RequestRefund leaves it out
 type RefundRequest struct {
-	RefundId  string `json:"refundId"`
-	DepositId string `json:"depositId"`
-	Amount    string `json:"amount"`
+	RefundId  string          `json:"refundId"`
+	DepositId string          `json:"depositId"`
+	Amount    string          `json:"amount"`
+	Currency  string          `json:"currency,omitempty"`
+	Metadata  []MetadataField `json:"metadata,omitempty"`
 }
 
+// BulkDepositItem is the outcome of a single row of a bulk deposit
+type BulkDepositItem struct {
+	Index    int
+	Request  DepositRequest
+	Outcome  BulkItemOutcome
+	Response CreateDepositResponse
+	Err      error
+}
+
+// CreateBulkDepositResponse holds one item per row sent, Annotation is that of the first chunk
 type CreateBulkDepositResponse struct {
-	Result     []CreateDepositResponse
-	Annotation APIAnnotation
+	Result      []CreateDepositResponse
+	Items       []BulkDepositItem
+	Annotation  APIAnnotation
+	Annotations []APIAnnotation
+}
+
+// BulkRefundItem is the outcome of a single row of a bulk refund
+type BulkRefundItem struct {
+	Index    int
+	Request  RefundRequest
+	Outcome  BulkItemOutcome
+	Response InitiateRefundResponse
+	Err      error
+}
+
+// CreateBulkRefundResponse holds one item per row sent, each refund carries its own annotation
+type CreateBulkRefundResponse struct {
+	Result []InitiateRefundResponse
+	Items  []BulkRefundItem
 }
 
 type Refund struct {
@@ -232,9 +313,24 @@ type Refund struct {
 	ReceivedByRecipient  string                 `json:"receivedByRecipient"`
 	CorrespondentIds     map[string]interface{} `json:"correspondentIds"`
 	FailureReason        FailureReason          `json:"failureReason"`
+	Metadata             map[string]string      `json:"metadata"`
 	Annotation           APIAnnotation
 }
 
+// IsSuccessful reports if a refund is successful
+func (t Refund) IsSuccessful() bool { return strings.EqualFold(t.Status, "completed") }
+
+// IsFailed reports if a refund failed
+func (t Refund) IsFailed() bool { return strings.EqualFold(t.Status, "failed") }
+
+// IsPending reports if a refund is still pending
+func (t Refund) IsPending() bool { return !t.IsSuccessful() && !t.IsFailed() && t.Status != "" }
+
+// IsNotFound checks a refund response to see if the transaction is not found
+func (t Refund) IsNotFound() bool {
+	return t.Annotation.ResponseCode == 200 && t.RefundId == ""
+}
+
 type RefundStatusResponse struct {
 	RefundId   string `json:"refundId"`
 	Status     string `json:"status"`
@@ -245,6 +341,87 @@ type RefundStatusResponse struct {
 type TimeProviderFunc func() time.Time
 
 func (s *Service) makeRequest(method, resource string, reqBody interface{}, resp interface{}) (APIAnnotation, error) {
+	ctx := s.context()
+	family := endpointFamily(method, resource)
+	start := time.Now()
+
+	var (
+		annotation    APIAnnotation
+		err           error
+		key, rejected string
+		attempts      int
+		firstSentAt   time.Time
+		intended      bool
+	)
+	for attempt := 0; ; attempt++ {
+		if attempt == 0 {
+			if err = s.auditIntent(ctx, method, resource, reqBody); err != nil {
+				err = &NotSentError{Err: err}
+				break
+			}
+			intended = method != http.MethodGet
+			if key, err = s.credentials.key(ctx, ""); err != nil {
+				err = &NotSentError{Err: err}
+				break
+			}
+		}
+		release, waitErr := s.limiter.acquire(ctx, family)
+		if waitErr != nil {
+			err = errors.Wrap(waitErr, "client - gave up waiting for rate limiter")
+			if attempts == 0 {
+				err = &NotSentError{Err: err}
+			}
+			break
+		}
+		annotation, err = s.doRequest(ctx, key, method, resource, reqBody, resp)
+		release()
+		if IsNotSent(err) {
+			break
+		}
+		if attempts++; attempts == 1 {
+			firstSentAt = annotation.StartedAt
+		}
+
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized {
+			// retried once with a freshly fetched key, or the other key of a rotation in progress
+			next, ok := s.credentials.retryKey(ctx, key, rejected)
+			if !ok {
+				break
+			}
+			rejected, key, err = key, next, nil
+			continue
+		}
+		if annotation.ResponseCode != 0 {
+			s.credentials.accept(key)
+		}
+		if statusErr == nil || statusErr.StatusCode != http.StatusTooManyRequests || s.limiter == nil {
+			break
+		}
+		wait := retryAfter(statusErr.Header)
+		s.limiter.backoff(wait)
+		if attempt >= s.limiter.maxRetries {
+			break
+		}
+	}
+
+	annotation.Operation, annotation.Attempts = operationName(method, resource), attempts
+	if attempts > 1 && !firstSentAt.IsZero() {
+		annotation.StartedAt, annotation.Duration = firstSentAt, annotation.EndedAt.Sub(firstSentAt)
+	}
+	// an audited intent always gets an outcome, even when the request ended up not being sent
+	if attempts > 0 || intended {
+		s.audit(ctx, resource, reqBody, annotation, err)
+	}
+
+	s.observeRequest(method, resource, reqBody, resp, annotation, time.Since(start), err)
+	if err == nil {
+		s.recordEvents(transactionEvents(reqBody, resp, annotation, time.Now()))
+	}
+	return annotation, err
+}
+
+func (s *Service) doRequest(ctx context.Context, apiKey, method, resource string, reqBody interface{}, resp interface{}) (APIAnnotation, error) {
 
 	URL := fmt.Sprintf("%s/%s", s.config.BaseURL, resource)
 	var (
@@ -255,12 +432,14 @@ func (s *Service) makeRequest(method, resource string, reqBody interface{}, resp
 
 		requestBody, err := json.Marshal(reqBody)
 		if err != nil {
-			return APIAnnotation{}, errors.Wrap(err, "client - unable to marshal request struct")
+			return APIAnnotation{}, &NotSentError{Err: errors.Wrap(err, "client - unable to marshal request struct")}
 		}
 
-		// only log request when explicitly asked to do so
+		// only log or annotate the request payload when explicitly asked to do so
+		if s.config.LogRequest || s.config.Annotations.RequestPayload {
+			rb = requestBody
+		}
 		if s.config.LogRequest {
-			rb, _ = json.Marshal(reqBody)
 			log.Printf("pawapay: making request to route %s with payload %s", URL, rb)
 		}
 
@@ -271,37 +450,34 @@ func (s *Service) makeRequest(method, resource string, reqBody interface{}, resp
 		log.Printf("pawapay: making request to route %s", URL)
 	}
 
-	req, err := http.NewRequest(method, URL, body)
+	req, err := http.NewRequestWithContext(ctx, method, URL, body)
 	if err != nil {
-		return APIAnnotation{}, errors.Wrap(err, "client - unable to create request body")
+		return APIAnnotation{}, &NotSentError{Err: errors.Wrap(err, "client - unable to create request body")}
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", s.config.APIKey))
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
 
+	started := time.Now()
 	res, err := s.client.Do(req)
 	if err != nil {
-		return APIAnnotation{}, errors.Wrap(err, "client - failed to execute request")
+		return s.config.Annotations.annotate(req, rb, nil, nil, started, time.Now()),
+			errors.Wrap(err, "client - failed to execute request")
 	}
 
 	b, _ := io.ReadAll(res.Body)
+	ended := time.Now()
 	if s.config.LogResponse {
 		log.Printf("pawapay: got response %s code %d", string(b), res.StatusCode)
 	}
 
-	var apiAnnotation APIAnnotation
-	apiAnnotation.RequestPayload = string(rb)
-	apiAnnotation.ResponseCode = res.StatusCode
-	apiAnnotation.ResponsePayload = string(b)
-	if !strings.EqualFold(os.Getenv("env"), "testing") {
-		apiAnnotation.URL = URL
-	}
+	apiAnnotation := s.config.Annotations.annotate(req, rb, res, b, started, ended)
 
 	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusCreated {
 		if s.config.LogResponse {
 			log.Printf("pawapay: error response body: %s for request payload %s", b, requestBody)
 		}
-		return apiAnnotation, fmt.Errorf("invalid status code received, expected 200/204/201, got %v with body %s", res.StatusCode, b)
+		return apiAnnotation, &StatusError{StatusCode: res.StatusCode, Body: string(b), Header: res.Header}
 	}
 
 	if resp != nil || res.StatusCode != http.StatusNoContent {
@@ -313,7 +489,7 @@ func (s *Service) makeRequest(method, resource string, reqBody interface{}, resp
 }
 
 func (s *Service) newCreatePayoutRequest(timeProvider TimeProviderFunc, payoutId string, amt Amount, countryCode, code, description string,
-	pn PhoneNumber) CreatePayoutRequest {
+	pn PhoneNumber, metadata []MetadataField) CreatePayoutRequest {
 	layout := "2006-01-02T15:04:05Z"
 	if len(description) > 22 {
 		description = description[:22]
@@ -328,30 +504,31 @@ func (s *Service) newCreatePayoutRequest(timeProvider TimeProviderFunc, payoutId
 		CustomerTimestamp:    timeProvider().Format(layout),
 		StatementDescription: description,
 		Recipient:            Recipient{Type: recipientType, Address: Address{Value: fmt.Sprintf("%s%s", pn.CountryCode, pn.Number)}},
+		Metadata:             metadata,
 	}
 }
 
-func (s *Service) newCreateBulkPayoutRequest(timeProvider TimeProviderFunc, req []PayoutRequest) ([]CreatePayoutRequest, error) {
-	requests := []CreatePayoutRequest{}
-	for _, payload := range req {
-
-		query := gountries.New()
-		se, err := query.FindCountryByCallingCode(payload.PhoneNumber.CountryCode)
-		if err != nil {
-			return []CreatePayoutRequest{}, err
-		}
-
-		countryCode := se.Alpha3
+func (s *Service) newBulkPayoutRequest(timeProvider TimeProviderFunc, payload PayoutRequest) (CreatePayoutRequest, error) {
+	if err := ValidateID("payoutId", payload.PayoutId); err != nil {
+		return CreatePayoutRequest{}, err
+	}
+	if err := ValidateMetadata(payload.Metadata); err != nil {
+		return CreatePayoutRequest{}, err
+	}
 
-		requests = append(requests, s.newCreatePayoutRequest(timeProvider, payload.PayoutId, payload.Amount,
-			countryCode, payload.Correspondent, payload.Description, payload.PhoneNumber))
+	se, err := countryByCallingCode(payload.PhoneNumber.CountryCode)
+	if err != nil {
+		return CreatePayoutRequest{}, err
 	}
 
-	return requests, nil
+	countryCode := se.Alpha3
+
+	return s.newCreatePayoutRequest(timeProvider, payload.PayoutId, payload.Amount,
+		countryCode, payload.Correspondent, payload.Description, payload.PhoneNumber, payload.Metadata), nil
 }
 
 func (s *Service) newDepositRequest(timeProvider TimeProviderFunc, depositId string, amt Amount, countryCode, code, description string,
-	pn PhoneNumber, authCode string) CreateDepositRequest {
+	pn PhoneNumber, authCode string, metadata []MetadataField) CreateDepositRequest {
 	layout := "2006-01-02T15:04:05Z"
 	if len(description) > 22 {
 		description = description[:22]
@@ -367,34 +544,45 @@ func (s *Service) newDepositRequest(timeProvider TimeProviderFunc, depositId str
 		StatementDescription: description,
 		PreAuthorizationCode: authCode,
 		Payer:                Payer{Type: recipientType, Address: Address{Value: fmt.Sprintf("%s%s", pn.CountryCode, pn.Number)}},
+		Metadata:             metadata,
 	}
 }
 
-func (s *Service) newCreateBulkDepositRequest(timeProvider TimeProviderFunc, req []DepositRequest) ([]CreateDepositRequest, error) {
-	requests := []CreateDepositRequest{}
-	for _, payload := range req {
-
-		query := gountries.New()
-		se, err := query.FindCountryByCallingCode(payload.PhoneNumber.CountryCode)
-		if err != nil {
-			return []CreateDepositRequest{}, err
-		}
-
-		countryCode := se.Alpha3
+func (s *Service) newBulkDepositRequest(timeProvider TimeProviderFunc, payload DepositRequest) (CreateDepositRequest, error) {
+	if err := ValidateID("depositId", payload.DepositId); err != nil {
+		return CreateDepositRequest{}, err
+	}
+	if err := ValidateMetadata(payload.Metadata); err != nil {
+		return CreateDepositRequest{}, err
+	}
 
-		requests = append(requests, s.newDepositRequest(timeProvider, payload.DepositId, payload.Amount,
-			countryCode, payload.Correspondent, payload.Description, payload.PhoneNumber, payload.PreAuthCode))
+	se, err := countryByCallingCode(payload.PhoneNumber.CountryCode)
+	if err != nil {
+		return CreateDepositRequest{}, err
 	}
 
-	return requests, nil
+	countryCode := se.Alpha3
+
+	return s.newDepositRequest(timeProvider, payload.DepositId, payload.Amount,
+		countryCode, payload.Correspondent, payload.Description, payload.PhoneNumber, payload.PreAuthCode, payload.Metadata), nil
 }
 
-func (s Service) newRefundRequest(refundId, depositId string, amount Amount) RefundRequest {
+func (s Service) newRefundRequest(refundId, depositId string, amount Amount, metadata []MetadataField) RefundRequest {
 	return RefundRequest{
 		RefundId:  refundId,
 		DepositId: depositId,
 		Amount:    amount.Value,
+		Metadata:  metadata,
+	}
+}
+
+// countryByCallingCode returns the country of a calling code, a *CallingCodeError is returned when there is none
+func countryByCallingCode(callingCode string) (gountries.Country, error) {
+	country, err := gountries.New().FindCountryByCallingCode(callingCode)
+	if err != nil {
+		return gountries.Country{}, &CallingCodeError{CallingCode: callingCode}
 	}
+	return country, nil
 }
 
 func GetAllCorrespondents() ([]MomoMapping, error) {
@@ -3,52 +3,127 @@ package pawapay
 import (
 	"fmt"
 	"net/http"
-
-	"github.com/pariz/gountries"
+	"strings"
 )
 
 // InitiateDeposit provides the functionality of initiating a deposit for the sender to confirm
 // See docs https://docs.pawapay.co.uk/#operation/createDesposit for more details
 func (s *Service) InitiateDeposit(timeProvider TimeProviderFunc, depositReq DepositRequest) (CreateDepositResponse, error) {
 
-	query := gountries.New()
-	se, err := query.FindCountryByCallingCode(depositReq.PhoneNumber.CountryCode)
+	countryCode, err := depositCountry(depositReq)
 	if err != nil {
 		return CreateDepositResponse{}, err
 	}
-	countryCode := se.Alpha3
 
 	resource := "deposits"
 	payload := s.newDepositRequest(timeProvider, depositReq.DepositId, depositReq.Amount, countryCode,
-		depositReq.Correspondent, depositReq.Description, depositReq.PhoneNumber, depositReq.PreAuthCode)
+		depositReq.Correspondent, depositReq.Description, depositReq.PhoneNumber, depositReq.PreAuthCode, depositReq.Metadata)
+
+	done, err := s.breaker.allow(depositReq.Correspondent, DepositOperation)
+	if err != nil {
+		return CreateDepositResponse{}, err
+	}
 
 	var response CreateDepositResponse
 	annotation, err := s.makeRequest(http.MethodPost, resource, payload, &response)
+	done(s.breaker.outcome(err, response.Status, response.RejectionReason))
 	if err != nil {
 		return CreateDepositResponse{}, err
 	}
 	response.Annotation = annotation
 
+	if err := checkEchoedID("InitiateDeposit", depositReq.DepositId, response.DepositId); err != nil {
+		return response, err
+	}
+
 	return response, nil
 }
 
-// CreateBulkDeposit provides the functionality of creating a bulk deposit
+// depositCountry validates a deposit and returns the alpha3 code of the country of its phone number
+func depositCountry(depositReq DepositRequest) (string, error) {
+	if err := ValidateID("depositId", depositReq.DepositId); err != nil {
+		return "", err
+	}
+	if err := ValidateMetadata(depositReq.Metadata); err != nil {
+		return "", err
+	}
+
+	se, err := countryByCallingCode(depositReq.PhoneNumber.CountryCode)
+	if err != nil {
+		return "", err
+	}
+	return se.Alpha3, nil
+}
+
+// InitiateBulkDeposit provides the functionality of creating a bulk deposit. The deposits are sent in chunks the
+// size pawapay accepts and the outcome of every row is returned, a *BulkError is returned with it when a row was not
+// sent or has an unknown outcome, even though the other rows were sent
 // See docs https://docs.pawapay.co.uk/#operation/createDeposits for more details
 func (s *Service) InitiateBulkDeposit(timeProvider TimeProviderFunc, data []DepositRequest) (CreateBulkDepositResponse, error) {
 
-	resource := "deposits/bulk"
-	payload, err := s.newCreateBulkDepositRequest(timeProvider, data)
-	if err != nil {
+	ids := make([]string, 0, len(data))
+	for _, deposit := range data {
+		ids = append(ids, deposit.DepositId)
+	}
+	if err := checkDuplicateIDs("depositId", ids); err != nil {
 		return CreateBulkDepositResponse{}, err
 	}
 
-	var response []CreateDepositResponse
-	annotation, err := s.makeRequest(http.MethodPost, resource, payload, &response)
-	if err != nil {
-		return CreateBulkDepositResponse{}, err
+	items := make([]BulkDepositItem, len(data))
+	var (
+		payloads  []CreateDepositRequest
+		positions []int
+	)
+	for i, deposit := range data {
+		items[i] = BulkDepositItem{Index: i, Request: deposit}
+		payload, err := s.newBulkDepositRequest(timeProvider, deposit)
+		if err != nil {
+			items[i].Outcome, items[i].Err = BulkItemInvalid, err
+			continue
+		}
+		payloads = append(payloads, payload)
+		positions = append(positions, i)
+	}
+
+	resource := "deposits/bulk"
+	annotations := make([]APIAnnotation, chunkCount(len(payloads), s.config.Bulk.ChunkSize))
+	s.forEachChunk(len(payloads), func(chunk, start, end int) {
+		var response []CreateDepositResponse
+		annotation, err := s.makeRequest(http.MethodPost, resource, payloads[start:end], &response)
+		annotations[chunk] = annotation
+
+		results := map[string]CreateDepositResponse{}
+		for _, r := range response {
+			r.Annotation = annotation
+			results[strings.ToLower(r.DepositId)] = r
+		}
+		for j := start; j < end; j++ {
+			item := &items[positions[j]]
+			result, ok := results[strings.ToLower(payloads[j].DepositId)]
+			switch {
+			case err != nil:
+				item.Outcome, item.Err = BulkItemFailed, err
+			case !ok:
+				item.Outcome, item.Err = BulkItemFailed, fmt.Errorf("no result returned for depositId %s", payloads[j].DepositId)
+			default:
+				item.Outcome, item.Response = bulkOutcome(result.Status), result
+			}
+		}
+	})
+
+	response := CreateBulkDepositResponse{Items: items, Annotations: annotations}
+	if len(annotations) > 0 {
+		response.Annotation = annotations[0]
+	}
+	outcomes := make([]BulkItemOutcome, 0, len(items))
+	for _, item := range items {
+		if item.Response.DepositId != "" {
+			response.Result = append(response.Result, item.Response)
+		}
+		outcomes = append(outcomes, item.Outcome)
 	}
 
-	return CreateBulkDepositResponse{Result: response, Annotation: annotation}, nil
+	return response, bulkError(outcomes)
 }
 
 // GetDeposit provides the functionality of retrieving a deposit
@@ -0,0 +1,67 @@
+package pawapay
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// StatusError is returned when pawapay responds with a status code other than 200/204/201
+type StatusError struct {
+	StatusCode int
+	Body       string
+	Header     http.Header
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("invalid status code received, expected 200/204/201, got %v with body %s", e.StatusCode, e.Body)
+}
+
+// IDMismatchError is returned when the id pawapay echoes back for a transaction is not the one that was sent.
+// The response is returned alongside it so that the incident can be investigated
+type IDMismatchError struct {
+	Operation string
+	Sent      string
+	Received  string
+}
+
+func (e *IDMismatchError) Error() string {
+	return fmt.Sprintf("pawapay: %s sent id %s but got back %q", e.Operation, e.Sent, e.Received)
+}
+
+// checkEchoedID compares ids case insensitively, pawapay may echo a uuid back in another case
+func checkEchoedID(operation, sent, received string) error {
+	if !strings.EqualFold(sent, received) {
+		return &IDMismatchError{Operation: operation, Sent: sent, Received: received}
+	}
+	return nil
+}
+
+// CallingCodeError is returned when a phone number's calling code is not that of any country
+type CallingCodeError struct {
+	CallingCode string
+}
+
+func (e *CallingCodeError) Error() string {
+	return fmt.Sprintf("pawapay: no country has the calling code %q", e.CallingCode)
+}
+
+// NotSentError is returned when a request failed before it was sent to pawapay, eg no api key was available or the
+// context was cancelled while waiting for the rate limiter. pawapay never saw the transaction, so it is safe to
+// consider it not made
+type NotSentError struct {
+	Err error
+}
+
+func (e *NotSentError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the error the request failed with
+func (e *NotSentError) Unwrap() error { return e.Err }
+
+// IsNotSent reports whether err means the request never reached pawapay
+func IsNotSent(err error) bool {
+	var notSent *NotSentError
+	return errors.As(err, &notSent)
+}
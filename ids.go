@@ -0,0 +1,91 @@
+package pawapay
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// IDGenerator produces the payoutId, depositId and refundId of new transactions. The reference is whatever
+// identifies the transaction on the caller's side, eg an order id, and may be ignored by the generator
+type IDGenerator interface {
+	GenerateID(reference string) string
+}
+
+// RandomIDGenerator generates random UUIDv4s, it is the default generator
+type RandomIDGenerator struct{}
+
+// GenerateID implements IDGenerator
+func (RandomIDGenerator) GenerateID(string) string { return uuid.NewString() }
+
+// NameBasedIDGenerator derives UUIDv5s from references within a namespace, so the same order always maps to the
+// same transaction id and retrying it can never pay twice
+type NameBasedIDGenerator struct {
+	Namespace uuid.UUID
+}
+
+// GenerateID implements IDGenerator
+func (g NameBasedIDGenerator) GenerateID(reference string) string {
+	return uuid.NewSHA1(g.Namespace, []byte(reference)).String()
+}
+
+// InvalidIDError is returned when a transaction id is not a UUID pawapay accepts
+type InvalidIDError struct {
+	Field string
+	ID    string
+}
+
+func (e *InvalidIDError) Error() string {
+	return fmt.Sprintf("pawapay: %s %q is not a valid UUID", e.Field, e.ID)
+}
+
+// DuplicateIDError is returned when the same transaction id appears more than once in a bulk request
+type DuplicateIDError struct {
+	Field   string
+	ID      string
+	Indexes []int
+}
+
+func (e *DuplicateIDError) Error() string {
+	return fmt.Sprintf("pawapay: %s %s is repeated at indexes %v", e.Field, e.ID, e.Indexes)
+}
+
+// NewID returns a transaction id from the configured IDGenerator
+func (s *Service) NewID(reference string) string {
+	if s.config.IDGenerator == nil {
+		return RandomIDGenerator{}.GenerateID(reference)
+	}
+	return s.config.IDGenerator.GenerateID(reference)
+}
+
+// ValidateID checks that id is a lower or upper case UUID in its canonical 36 character form. Version 4 is what
+// pawapay expects, name based version 5 ids are accepted as well
+func ValidateID(field, id string) error {
+	if len(id) != 36 {
+		return &InvalidIDError{Field: field, ID: id}
+	}
+	parsed, err := uuid.Parse(id)
+	if err != nil || parsed.Variant() != uuid.RFC4122 || (parsed.Version() != 4 && parsed.Version() != 5) {
+		return &InvalidIDError{Field: field, ID: id}
+	}
+	return nil
+}
+
+// checkDuplicateIDs rejects ids that are repeated within a bulk request
+func checkDuplicateIDs(field string, ids []string) error {
+	seen := map[string][]int{}
+	for i, id := range ids {
+		if id == "" {
+			continue
+		}
+		key := strings.ToLower(id)
+		seen[key] = append(seen[key], i)
+	}
+	for i, id := range ids {
+		if indexes := seen[strings.ToLower(id)]; len(indexes) > 1 && indexes[0] == i {
+			return &DuplicateIDError{Field: field, ID: id, Indexes: indexes}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package pawapay
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits pawapay enforces on the metadata of a single transaction, lengths are counted in characters
+const (
+	// MaxMetadataFields is the maximum number of metadata fields
+	MaxMetadataFields = 10
+	// MaxMetadataFieldNameLength is the longest field name
+	MaxMetadataFieldNameLength = 50
+	// MaxMetadataFieldValueLength is the longest field value
+	MaxMetadataFieldValueLength = 256
+	// MaxMetadataSize is the longest the names and values of every field may be together
+	MaxMetadataSize = 2000
+)
+
+// MetadataField is a single entry of the metadata attached to a transaction. Fields marked as PII are
+// stored encrypted by pawapay and masked in their dashboard
+type MetadataField struct {
+	FieldName  string `json:"fieldName"`
+	FieldValue string `json:"fieldValue"`
+	IsPII      bool   `json:"isPII,omitempty"`
+}
+
+// MetadataError is returned when metadata breaks a limit enforced by pawapay
+type MetadataError struct {
+	Reason string
+}
+
+func (e *MetadataError) Error() string { return "pawapay: " + e.Reason }
+
+func metadataErrorf(format string, args ...interface{}) error {
+	return &MetadataError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// ValidateMetadata checks metadata against the limits enforced by pawapay so that the request is not rejected, a
+// *MetadataError is returned for the first limit broken
+func ValidateMetadata(metadata []MetadataField) error {
+	if len(metadata) > MaxMetadataFields {
+		return metadataErrorf("metadata has %d fields, at most %d are allowed", len(metadata), MaxMetadataFields)
+	}
+
+	var size int
+	seen := map[string]bool{}
+	for _, field := range metadata {
+		name := strings.TrimSpace(field.FieldName)
+		if name == "" {
+			return metadataErrorf("metadata field name cannot be empty")
+		}
+		if seen[name] {
+			return metadataErrorf("metadata field %q is repeated", name)
+		}
+		seen[name] = true
+
+		nameLength, valueLength := utf8.RuneCountInString(field.FieldName), utf8.RuneCountInString(field.FieldValue)
+		if nameLength > MaxMetadataFieldNameLength {
+			return metadataErrorf("metadata field name %q has %d characters, at most %d are allowed", name, nameLength,
+				MaxMetadataFieldNameLength)
+		}
+		if valueLength > MaxMetadataFieldValueLength {
+			return metadataErrorf("metadata field %q has a value of %d characters, at most %d are allowed", name,
+				valueLength, MaxMetadataFieldValueLength)
+		}
+		size += nameLength + valueLength
+	}
+	if size > MaxMetadataSize {
+		return metadataErrorf("metadata has %d characters, at most %d are allowed", size, MaxMetadataSize)
+	}
+	return nil
+}
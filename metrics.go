@@ -0,0 +1,181 @@
+package pawapay
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metrics receives a measurement for every request made by the service and every callback it handles.
+// Implementations must be safe for concurrent use
+type Metrics interface {
+	ObserveRequest(RequestObservation)
+	ObserveCallback(CallbackObservation)
+}
+
+// RequestObservation describes a single request made to pawapay, it is observed once however many rows a bulk call
+// carries. Correspondent is that of every item, empty when a bulk call mixes correspondents
+type RequestObservation struct {
+	Tenant        string
+	Operation     string
+	Correspondent string
+	ResponseCode  int
+	Duration      time.Duration
+	Err           error
+	// Items holds a transaction per row sent, a single one for calls that are not bulk
+	Items []TransactionObservation
+}
+
+// TransactionObservation describes a single transaction sent or read by a request
+type TransactionObservation struct {
+	Correspondent string
+	Currency      string
+	Country       string
+	Status        string
+	FailureCode   string
+	Amount        float64
+}
+
+// CallbackObservation describes a single callback received from pawapay
+type CallbackObservation struct {
+	Tenant        string
+	Type          CallbackType
+	Correspondent string
+	Currency      string
+	Country       string
+	Status        string
+	FailureCode   string
+	Amount        float64
+}
+
+// operationName derives a stable operation name from a request, eg POST payouts/bulk becomes payouts.bulk
+func operationName(method, resource string) string {
+	parts := strings.SplitN(strings.TrimPrefix(resource, "v1/"), "/", 3)
+	family := parts[0]
+	if method == http.MethodGet {
+		return family + ".get"
+	}
+	if len(parts) == 1 {
+		return family + ".create"
+	}
+	return family + "." + parts[1]
+}
+
+func parseAmount(value string) float64 {
+	f, _ := strconv.ParseFloat(value, 64)
+	return f
+}
+
+// transactionObservations extracts the labels of the transactions of a completed request from its payload and
+// decoded response. Bulk results are matched to the rows sent by id
+func transactionObservations(reqBody, resp interface{}) []TransactionObservation {
+	switch body := reqBody.(type) {
+	case CreatePayoutRequest:
+		o := TransactionObservation{Correspondent: body.Correspondent, Currency: body.Currency, Country: body.Country,
+			Amount: parseAmount(body.Amount)}
+		if r, ok := resp.(*CreatePayoutResponse); ok {
+			o.Status = r.Status
+		}
+		return []TransactionObservation{o}
+	case []CreatePayoutRequest:
+		statuses := map[string]string{}
+		if r, ok := resp.(*[]CreatePayoutResponse); ok {
+			for _, result := range *r {
+				statuses[strings.ToLower(result.PayoutID)] = result.Status
+			}
+		}
+		obs := make([]TransactionObservation, 0, len(body))
+		for _, item := range body {
+			obs = append(obs, TransactionObservation{Correspondent: item.Correspondent, Currency: item.Currency,
+				Country: item.Country, Amount: parseAmount(item.Amount), Status: statuses[strings.ToLower(item.PayoutId)]})
+		}
+		return obs
+	case CreateDepositRequest:
+		o := TransactionObservation{Correspondent: body.Correspondent, Currency: body.Currency, Country: body.Country,
+			Amount: parseAmount(body.Amount)}
+		if r, ok := resp.(*CreateDepositResponse); ok {
+			o.Status = r.Status
+		}
+		return []TransactionObservation{o}
+	case []CreateDepositRequest:
+		statuses := map[string]string{}
+		if r, ok := resp.(*[]CreateDepositResponse); ok {
+			for _, result := range *r {
+				statuses[strings.ToLower(result.DepositId)] = result.Status
+			}
+		}
+		obs := make([]TransactionObservation, 0, len(body))
+		for _, item := range body {
+			obs = append(obs, TransactionObservation{Correspondent: item.Correspondent, Currency: item.Currency,
+				Country: item.Country, Amount: parseAmount(item.Amount), Status: statuses[strings.ToLower(item.DepositId)]})
+		}
+		return obs
+	case RefundRequest:
+		o := TransactionObservation{Amount: parseAmount(body.Amount)}
+		if r, ok := resp.(*InitiateRefundResponse); ok {
+			o.Status = r.Status
+		}
+		return []TransactionObservation{o}
+	}
+
+	var o TransactionObservation
+	switch r := resp.(type) {
+	case *[]Payout:
+		if len(*r) > 0 {
+			p := (*r)[0]
+			o.Correspondent, o.Currency, o.Country, o.Status = p.Correspondent, p.Currency, p.Country, p.Status
+			o.FailureCode, o.Amount = p.FailureReason.FailureCode, parseAmount(p.Amount)
+		}
+	case *[]Deposit:
+		if len(*r) > 0 {
+			d := (*r)[0]
+			o.Correspondent, o.Currency, o.Country, o.Status = d.Correspondent, d.Currency, d.Country, d.Status
+			o.FailureCode, o.Amount = d.FailureReason.FailureCode, parseAmount(d.DepositedAmount)
+		}
+	case *[]Refund:
+		if len(*r) > 0 {
+			f := (*r)[0]
+			o.Correspondent, o.Currency, o.Country, o.Status = f.Correspondent, f.Currency, f.Country, f.Status
+			o.FailureCode, o.Amount = f.FailureReason.FailureCode, parseAmount(f.Amount)
+		}
+	case *PayoutStatusResponse:
+		o.Status = r.Status
+	case *DepositStatusResponse:
+		o.Status = r.Status
+	case *RefundStatusResponse:
+		o.Status = r.Status
+	}
+	return []TransactionObservation{o}
+}
+
+// sharedCorrespondent returns the correspondent of every item, empty when they differ
+func sharedCorrespondent(items []TransactionObservation) string {
+	if len(items) == 0 {
+		return ""
+	}
+	for _, item := range items[1:] {
+		if item.Correspondent != items[0].Correspondent {
+			return ""
+		}
+	}
+	return items[0].Correspondent
+}
+
+// observeRequest reports a completed request to the configured metrics
+func (s *Service) observeRequest(method, resource string, reqBody, resp interface{}, annotation APIAnnotation,
+	duration time.Duration, err error) {
+	if s.metrics == nil {
+		return
+	}
+	items := transactionObservations(reqBody, resp)
+	s.metrics.ObserveRequest(RequestObservation{
+		Tenant:        s.config.Tenant,
+		Operation:     operationName(method, resource),
+		Correspondent: sharedCorrespondent(items),
+		ResponseCode:  annotation.ResponseCode,
+		Duration:      duration,
+		Err:           err,
+		Items:         items,
+	})
+}
@@ -0,0 +1,364 @@
+package pawapay
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// IntentState is how far an outbox intent has got
+type IntentState string
+
+const (
+	// IntentPending means the intent was persisted but pawapay's answer to it is not known
+	IntentPending IntentState = "PENDING"
+	// IntentResolved means pawapay answered the intent, its Status holds the answer
+	IntentResolved IntentState = "RESOLVED"
+	// IntentNotSent means the call failed before it was sent, pawapay never saw it and it is not recovered
+	IntentNotSent IntentState = "NOT_SENT"
+)
+
+// Intent is a money moving call persisted before it is sent. Only the request matching Type is set
+type Intent struct {
+	ID        string          `json:"id"`
+	Type      TransactionType `json:"type"`
+	Payout    *PayoutRequest  `json:"payout,omitempty"`
+	Deposit   *DepositRequest `json:"deposit,omitempty"`
+	Refund    *RefundRequest  `json:"refund,omitempty"`
+	State     IntentState     `json:"state"`
+	Status    string          `json:"status,omitempty"`
+	Attempts  int             `json:"attempts"`
+	LastError string          `json:"lastError,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// OutboxStore persists outbox intents. Implementations must be safe for concurrent use
+type OutboxStore interface {
+	// SaveIntent inserts an intent or replaces the one with the same ID
+	SaveIntent(Intent) error
+	// PendingIntents returns every intent still in IntentPending, oldest first
+	PendingIntents() ([]Intent, error)
+}
+
+// MemoryOutboxStore is an OutboxStore that lives for as long as the process does, it is meant for tests
+type MemoryOutboxStore struct {
+	mu      sync.Mutex
+	intents map[string]Intent
+}
+
+// NewMemoryOutboxStore returns an empty in memory outbox store
+func NewMemoryOutboxStore() *MemoryOutboxStore {
+	return &MemoryOutboxStore{intents: map[string]Intent{}}
+}
+
+// SaveIntent implements OutboxStore
+func (m *MemoryOutboxStore) SaveIntent(i Intent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.intents[i.ID] = i
+	return nil
+}
+
+// PendingIntents implements OutboxStore
+func (m *MemoryOutboxStore) PendingIntents() ([]Intent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return pendingIntents(m.intents), nil
+}
+
+// FileOutboxStore is an OutboxStore backed by a single json file. Every save rewrites the file and syncs it to
+// disk before returning. Only pending intents are kept, an intent is dropped from the file once it is resolved, so
+// the file stays as small as the number of calls in flight
+type FileOutboxStore struct {
+	path string
+
+	mu      sync.Mutex
+	intents map[string]Intent
+}
+
+// NewFileOutboxStore opens the outbox stored at path, the file is created on the first save
+func NewFileOutboxStore(path string) (*FileOutboxStore, error) {
+	store := &FileOutboxStore{path: path, intents: map[string]Intent{}}
+
+	bb, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read outbox file")
+	}
+	if err := json.Unmarshal(bb, &store.intents); err != nil {
+		return nil, errors.Wrap(err, "unable to unmarshal outbox file")
+	}
+	for id, i := range store.intents {
+		if i.State != IntentPending {
+			delete(store.intents, id)
+		}
+	}
+	return store, nil
+}
+
+// SaveIntent implements OutboxStore
+func (f *FileOutboxStore) SaveIntent(i Intent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	previous, existed := f.intents[i.ID]
+	if i.State == IntentPending {
+		f.intents[i.ID] = i
+	} else {
+		delete(f.intents, i.ID)
+	}
+	if err := writeFileSynced(f.path, f.intents); err != nil {
+		delete(f.intents, i.ID)
+		if existed {
+			f.intents[i.ID] = previous
+		}
+		return err
+	}
+	return nil
+}
+
+// PendingIntents implements OutboxStore
+func (f *FileOutboxStore) PendingIntents() ([]Intent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return pendingIntents(f.intents), nil
+}
+
+func pendingIntents(intents map[string]Intent) []Intent {
+	var pending []Intent
+	for _, i := range intents {
+		if i.State == IntentPending {
+			pending = append(pending, i)
+		}
+	}
+	sort.Slice(pending, func(a, b int) bool { return pending[a].CreatedAt.Before(pending[b].CreatedAt) })
+	return pending
+}
+
+// writeFileSynced replaces the file at path with v encoded as json, going through a synced temporary file so a
+// crash never leaves a half written file behind
+func writeFileSynced(path string, v interface{}) error {
+	bb, err := json.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal file content")
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "unable to create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(bb); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "unable to write temporary file")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "unable to sync temporary file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "unable to close temporary file")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), path), "unable to replace file")
+}
+
+// Outbox persists payouts, deposits and refunds before they are sent so that the outcome of a call interrupted by a
+// crash can be recovered. Resending is safe because pawapay ignores transaction ids it already knows
+type Outbox struct {
+	service *Service
+	store   OutboxStore
+	now     TimeProviderFunc
+}
+
+// NewOutbox returns an outbox that sends through s and persists intents in store
+func NewOutbox(s *Service, store OutboxStore) *Outbox {
+	return &Outbox{service: s, store: store, now: time.Now}
+}
+
+// RecoveryResult is what Recover did with a single pending intent
+type RecoveryResult struct {
+	Intent   Intent
+	Resent   bool
+	Resolved bool
+	Err      error
+}
+
+func (o *Outbox) begin(intent Intent) (Intent, error) {
+	now := o.now()
+	if intent.CreatedAt.IsZero() {
+		intent.CreatedAt = now
+	}
+	intent.State = IntentPending
+	intent.Attempts++
+	intent.UpdatedAt = now
+	if err := o.store.SaveIntent(intent); err != nil {
+		return intent, errors.Wrap(err, "unable to persist outbox intent")
+	}
+	return intent, nil
+}
+
+// finish records pawapay's answer to an intent. Intents whose request did not get a definite answer stay pending,
+// unless the request is known to have never been sent
+func (o *Outbox) finish(intent Intent, status string, err error) Intent {
+	intent.UpdatedAt = o.now()
+	intent.LastError = ""
+	if err != nil {
+		intent.LastError = err.Error()
+	}
+
+	var statusErr *StatusError
+	switch {
+	case err == nil, errors.As(err, new(*IDMismatchError)):
+		intent.State, intent.Status = IntentResolved, status
+	case errors.As(err, &statusErr) && statusErr.StatusCode >= 400 && statusErr.StatusCode < 500 &&
+		statusErr.StatusCode != http.StatusTooManyRequests:
+		intent.State, intent.Status = IntentResolved, "REJECTED"
+	case intent.Attempts == 1 && (IsNotSent(err) || errors.As(err, new(*CircuitOpenError))):
+		// a resent intent stays pending, it is still not known whether an earlier attempt reached pawapay
+		intent.State = IntentNotSent
+	}
+
+	// the call has already happened, failing to record it only means Recover will look it up again
+	o.store.SaveIntent(intent)
+	return intent
+}
+
+// sendable returns the error a call validated by the caller would fail on before being sent, so that calls that
+// cannot be sent are never persisted. Payouts and deposits are checked against their correspondent's circuit
+func (o *Outbox) sendable(correspondent, operationType string) error {
+	if operationType != "" {
+		if err := o.service.breaker.check(correspondent, operationType); err != nil {
+			return err
+		}
+	}
+	return o.service.context().Err()
+}
+
+// CreatePayout persists the payout and sends it through CreatePayout
+func (o *Outbox) CreatePayout(timeProvider TimeProviderFunc, req PayoutRequest) (CreatePayoutResponse, error) {
+	if _, err := payoutCountry(req); err != nil {
+		return CreatePayoutResponse{}, err
+	}
+	if err := o.sendable(req.Correspondent, PayoutOperation); err != nil {
+		return CreatePayoutResponse{}, err
+	}
+
+	intent, err := o.begin(Intent{ID: req.PayoutId, Type: PayoutTransaction, Payout: &req})
+	if err != nil {
+		return CreatePayoutResponse{}, err
+	}
+
+	response, err := o.service.CreatePayout(timeProvider, req)
+	o.finish(intent, response.Status, err)
+	return response, err
+}
+
+// InitiateDeposit persists the deposit and sends it through InitiateDeposit
+func (o *Outbox) InitiateDeposit(timeProvider TimeProviderFunc, req DepositRequest) (CreateDepositResponse, error) {
+	if _, err := depositCountry(req); err != nil {
+		return CreateDepositResponse{}, err
+	}
+	if err := o.sendable(req.Correspondent, DepositOperation); err != nil {
+		return CreateDepositResponse{}, err
+	}
+
+	intent, err := o.begin(Intent{ID: req.DepositId, Type: DepositTransaction, Deposit: &req})
+	if err != nil {
+		return CreateDepositResponse{}, err
+	}
+
+	response, err := o.service.InitiateDeposit(timeProvider, req)
+	o.finish(intent, response.Status, err)
+	return response, err
+}
+
+// RequestRefund persists the refund and sends it through RequestRefund
+func (o *Outbox) RequestRefund(refundId, depositId string, amount Amount, metadata ...MetadataField) (InitiateRefundResponse, error) {
+	req := RefundRequest{RefundId: refundId, DepositId: depositId, Amount: amount.Value, Currency: amount.Currency,
+		Metadata: metadata}
+	if err := checkRefund(refundId, depositId, metadata); err != nil {
+		return InitiateRefundResponse{}, err
+	}
+	if err := o.sendable("", ""); err != nil {
+		return InitiateRefundResponse{}, err
+	}
+
+	intent, err := o.begin(Intent{ID: refundId, Type: RefundTransaction, Refund: &req})
+	if err != nil {
+		return InitiateRefundResponse{}, err
+	}
+
+	response, err := o.service.RequestRefund(refundId, depositId, amount, metadata...)
+	o.finish(intent, response.Status, err)
+	return response, err
+}
+
+// Recover goes through every pending intent. Intents pawapay knows are resolved with their current status, the
+// others are sent again
+func (o *Outbox) Recover(timeProvider TimeProviderFunc) ([]RecoveryResult, error) {
+	pending, err := o.store.PendingIntents()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list pending outbox intents")
+	}
+
+	results := make([]RecoveryResult, 0, len(pending))
+	for _, intent := range pending {
+		result := RecoveryResult{Intent: intent}
+
+		remote, err := o.service.lookupTransaction(TransactionRef{ID: intent.ID, Type: intent.Type})
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+		if remote.found {
+			result.Intent = o.finish(intent, remote.status, nil)
+			result.Resolved = true
+			results = append(results, result)
+			continue
+		}
+
+		intent, err = o.begin(intent)
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+
+		var status string
+		switch intent.Type {
+		case PayoutTransaction:
+			var response CreatePayoutResponse
+			response, err = o.service.CreatePayout(timeProvider, *intent.Payout)
+			status = response.Status
+		case DepositTransaction:
+			var response CreateDepositResponse
+			response, err = o.service.InitiateDeposit(timeProvider, *intent.Deposit)
+			status = response.Status
+		case RefundTransaction:
+			var response InitiateRefundResponse
+			refund := intent.Refund
+			response, err = o.service.RequestRefund(refund.RefundId, refund.DepositId,
+				Amount{Value: refund.Amount, Currency: refund.Currency}, refund.Metadata...)
+			status = response.Status
+		}
+
+		result.Intent = o.finish(intent, status, err)
+		result.Resent = true
+		result.Resolved = result.Intent.State == IntentResolved
+		result.Err = err
+		results = append(results, result)
+	}
+
+	return results, nil
+}
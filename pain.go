@@ -0,0 +1,398 @@
+package pawapay
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pariz/gountries"
+	"github.com/pkg/errors"
+)
+
+const (
+	pain001Namespace = "urn:iso:std:iso:20022:tech:xsd:pain.001"
+	pain002Namespace = "urn:iso:std:iso:20022:tech:xsd:pain.002.001.10"
+)
+
+// pain001Document holds the parts of a pain.001 CustomerCreditTransferInitiation that map to payouts. It is
+// decoded without a namespace so that every version of the message is accepted
+type pain001Document struct {
+	XMLName    xml.Name `xml:"Document"`
+	Initiation *struct {
+		GroupHeader struct {
+			MessageID string `xml:"MsgId"`
+		} `xml:"GrpHdr"`
+		PaymentInfos []pain001PaymentInfo `xml:"PmtInf"`
+	} `xml:"CstmrCdtTrfInitn"`
+}
+
+type pain001PaymentInfo struct {
+	PaymentInfoID string `xml:"PmtInfId"`
+	PaymentMethod string `xml:"PmtMtd"`
+	Transactions  []struct {
+		PaymentID struct {
+			InstructionID string `xml:"InstrId"`
+			EndToEndID    string `xml:"EndToEndId"`
+			UETR          string `xml:"UETR"`
+		} `xml:"PmtId"`
+		Amount struct {
+			Instructed *struct {
+				Currency string `xml:"Ccy,attr"`
+				Value    string `xml:",chardata"`
+			} `xml:"InstdAmt"`
+			Equivalent *struct{} `xml:"EqvtAmt"`
+		} `xml:"Amt"`
+		CreditorAgent struct {
+			Other struct {
+				ID string `xml:"Id"`
+			} `xml:"FinInstnId>Othr"`
+		} `xml:"CdtrAgt"`
+		CreditorAccount struct {
+			IBAN  string `xml:"Id>IBAN"`
+			Other string `xml:"Id>Othr>Id"`
+			Proxy string `xml:"Prxy>Id"`
+		} `xml:"CdtrAcct"`
+		ChequeInstruction *struct{} `xml:"ChqInstr"`
+		Remittance        struct {
+			Unstructured []string   `xml:"Ustrd"`
+			Structured   []struct{} `xml:"Strd"`
+		} `xml:"RmtInf"`
+	} `xml:"CdtTrfTxInf"`
+}
+
+// Pain001Options configures how pain.001 credit transfers are mapped to payouts
+type Pain001Options struct {
+	// IDGenerator derives payout ids from the MsgId, PmtInfId, InstrId and EndToEndId of transactions that carry no
+	// UETR. It should be a NameBasedIDGenerator so that ingesting the same file twice can never pay twice
+	IDGenerator IDGenerator
+	// Correspondent picks the correspondent of a creditor when its agent carries no other identification, which is
+	// otherwise used as the correspondent
+	Correspondent func(PhoneNumber) string
+}
+
+// Pain001Transaction is a credit transfer of a pain.001 message and the payout it maps to
+type Pain001Transaction struct {
+	PaymentInfoID string
+	InstructionID string
+	EndToEndID    string
+	UETR          string
+	Payout        PayoutRequest
+}
+
+// Pain001Issue is a credit transfer that could not be mapped to a payout
+type Pain001Issue struct {
+	PaymentInfoID string
+	InstructionID string
+	EndToEndID    string
+	UETR          string
+	Reason        string
+}
+
+// Pain001Error is returned alongside a batch when some of its credit transfers use features payouts do not support
+type Pain001Error struct {
+	Issues []Pain001Issue
+}
+
+func (e *Pain001Error) Error() string {
+	first := e.Issues[0]
+	return fmt.Sprintf("pawapay: %d pain.001 transactions are not supported, first is %s/%s: %s", len(e.Issues),
+		first.PaymentInfoID, first.EndToEndID, first.Reason)
+}
+
+// Pain001Batch is a pain.001 message mapped to payouts. Issues holds the transactions that were left out
+type Pain001Batch struct {
+	MessageID string
+	// MessageName is the name and version of the message taken from its namespace, eg pain.001.001.09
+	MessageName  string
+	Transactions []Pain001Transaction
+	Issues       []Pain001Issue
+}
+
+// Payouts returns the payouts of the batch, ready for CreateBulkPayout
+func (b Pain001Batch) Payouts() []PayoutRequest {
+	payouts := make([]PayoutRequest, 0, len(b.Transactions))
+	for _, t := range b.Transactions {
+		payouts = append(payouts, t.Payout)
+	}
+	return payouts
+}
+
+// ParsePain001 maps the credit transfers of an ISO 20022 pain.001 message to payouts. The EndToEndId becomes the
+// description and the creditor's msisdn is read from its account proxy or other account id. A *Pain001Error
+// listing the transactions that were left out is returned with the batch
+func ParsePain001(r io.Reader, opts Pain001Options) (Pain001Batch, error) {
+	var doc pain001Document
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return Pain001Batch{}, errors.Wrap(err, "unable to decode pain.001 message")
+	}
+	if !strings.HasPrefix(doc.XMLName.Space, pain001Namespace) || doc.Initiation == nil {
+		return Pain001Batch{}, fmt.Errorf("%q is not a pain.001 message", doc.XMLName.Space)
+	}
+
+	space := doc.XMLName.Space
+	batch := Pain001Batch{MessageID: doc.Initiation.GroupHeader.MessageID, MessageName: space[strings.LastIndex(space, ":")+1:]}
+	query := gountries.New()
+	seen := map[string]bool{}
+	for _, info := range doc.Initiation.PaymentInfos {
+		for _, tx := range info.Transactions {
+			id := tx.PaymentID
+			issue := func(reason string) {
+				batch.Issues = append(batch.Issues, Pain001Issue{PaymentInfoID: info.PaymentInfoID,
+					InstructionID: id.InstructionID, EndToEndID: id.EndToEndID, UETR: id.UETR, Reason: reason})
+			}
+
+			account := tx.CreditorAccount
+			msisdn := account.Proxy
+			if msisdn == "" {
+				msisdn = account.Other
+			}
+			switch {
+			case info.PaymentMethod != "TRF":
+				issue(fmt.Sprintf("payment method %s is not supported, only TRF is", info.PaymentMethod))
+				continue
+			case tx.ChequeInstruction != nil:
+				issue("cheque instructions are not supported")
+				continue
+			case tx.Amount.Equivalent != nil || tx.Amount.Instructed == nil:
+				issue("only instructed amounts are supported")
+				continue
+			case !isPositiveAmount(strings.TrimSpace(tx.Amount.Instructed.Value)):
+				issue(fmt.Sprintf("%q is not a positive amount", tx.Amount.Instructed.Value))
+				continue
+			case len(tx.Remittance.Structured) > 0:
+				issue("structured remittance information is not supported")
+				continue
+			case msisdn == "" && account.IBAN != "":
+				issue("IBAN creditor accounts are not supported, the msisdn must be a proxy or other account id")
+				continue
+			case msisdn == "":
+				issue("creditor account has no msisdn")
+				continue
+			}
+
+			// a UETR is a UUIDv4, which is what pawapay expects as payout id. Otherwise the id is derived from every
+			// id of the transaction, an EndToEndId alone is often NOTPROVIDED and repeats across files
+			payoutID := strings.ToLower(id.UETR)
+			if ValidateID("payoutId", payoutID) != nil && opts.IDGenerator != nil {
+				payoutID = opts.IDGenerator.GenerateID(strings.Join([]string{batch.MessageID, info.PaymentInfoID,
+					id.InstructionID, id.EndToEndID}, "/"))
+			}
+			if err := ValidateID("payoutId", payoutID); err != nil {
+				issue("transaction has no UETR usable as payout id and no IDGenerator is configured")
+				continue
+			}
+			if seen[payoutID] {
+				issue("transaction has the same ids as an earlier one of the message, it needs an InstrId, " +
+					"EndToEndId or UETR of its own")
+				continue
+			}
+			seen[payoutID] = true
+
+			phone, err := parseMSISDN(query, msisdn)
+			if err != nil {
+				issue(err.Error())
+				continue
+			}
+
+			description := id.EndToEndID
+			if description == "NOTPROVIDED" || description == "" {
+				description = strings.Join(tx.Remittance.Unstructured, " ")
+			}
+
+			correspondent := tx.CreditorAgent.Other.ID
+			if correspondent == "" && opts.Correspondent != nil {
+				correspondent = opts.Correspondent(phone)
+			}
+			if correspondent == "" {
+				issue("no correspondent for the creditor")
+				continue
+			}
+
+			batch.Transactions = append(batch.Transactions, Pain001Transaction{
+				PaymentInfoID: info.PaymentInfoID,
+				InstructionID: id.InstructionID,
+				EndToEndID:    id.EndToEndID,
+				UETR:          id.UETR,
+				Payout: PayoutRequest{
+					PayoutId:      payoutID,
+					Amount:        Amount{Value: strings.TrimSpace(tx.Amount.Instructed.Value), Currency: tx.Amount.Instructed.Currency},
+					Description:   description,
+					PhoneNumber:   phone,
+					Correspondent: correspondent,
+				},
+			})
+		}
+	}
+
+	if len(batch.Issues) > 0 {
+		return batch, &Pain001Error{Issues: batch.Issues}
+	}
+	return batch, nil
+}
+
+// ISO 20022 transaction statuses used in pain.002 reports
+const (
+	Pain002AcceptedInProcess = "ACSP"
+	Pain002Settled           = "ACSC"
+	Pain002Pending           = "PDNG"
+	Pain002Rejected          = "RJCT"
+	Pain002PartiallyAccepted = "PART"
+)
+
+type pain002Document struct {
+	XMLName xml.Name `xml:"Document"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Report  struct {
+		GroupHeader struct {
+			MessageID string `xml:"MsgId"`
+			Created   string `xml:"CreDtTm"`
+		} `xml:"GrpHdr"`
+		Group struct {
+			MessageID   string `xml:"OrgnlMsgId"`
+			MessageName string `xml:"OrgnlMsgNmId"`
+			Status      string `xml:"GrpSts"`
+		} `xml:"OrgnlGrpInfAndSts"`
+		PaymentInfos []pain002PaymentInfo `xml:"OrgnlPmtInfAndSts"`
+	} `xml:"CstmrPmtStsRpt"`
+}
+
+type pain002PaymentInfo struct {
+	PaymentInfoID string               `xml:"OrgnlPmtInfId"`
+	Status        string               `xml:"PmtInfSts"`
+	Transactions  []pain002Transaction `xml:"TxInfAndSts"`
+}
+
+type pain002Transaction struct {
+	InstructionID string         `xml:"OrgnlInstrId,omitempty"`
+	EndToEndID    string         `xml:"OrgnlEndToEndId,omitempty"`
+	UETR          string         `xml:"OrgnlUETR,omitempty"`
+	Status        string         `xml:"TxSts"`
+	Reason        *pain002Reason `xml:"StsRsnInf,omitempty"`
+}
+
+type pain002Reason struct {
+	Code       string `xml:"Rsn>Prtry,omitempty"`
+	Additional string `xml:"AddtlInf,omitempty"`
+}
+
+// WriteStatusReport writes a pain.002 status report of the batch. The status of a transaction is taken from
+// payouts, eg as returned by GetPayout, and otherwise from the bulk call that sent it. Transactions that were left
+// out of the batch are reported as rejected
+func (b Pain001Batch) WriteStatusReport(w io.Writer, messageID string, createdAt time.Time,
+	response CreateBulkPayoutResponse, payouts ...Payout) error {
+	items := map[string]BulkPayoutItem{}
+	for _, item := range response.Items {
+		items[item.Request.PayoutId] = item
+	}
+	latest := map[string]Payout{}
+	for _, p := range payouts {
+		latest[p.PayoutID] = p
+	}
+
+	var doc pain002Document
+	doc.Xmlns = pain002Namespace
+	doc.Report.GroupHeader.MessageID = messageID
+	doc.Report.GroupHeader.Created = createdAt.UTC().Format(time.RFC3339)
+	doc.Report.Group.MessageID = b.MessageID
+	doc.Report.Group.MessageName = b.MessageName
+	if doc.Report.Group.MessageName == "" {
+		doc.Report.Group.MessageName = "pain.001"
+	}
+
+	infos := map[string]int{}
+	add := func(paymentInfoID string, tx pain002Transaction) {
+		i, ok := infos[paymentInfoID]
+		if !ok {
+			i = len(doc.Report.PaymentInfos)
+			infos[paymentInfoID] = i
+			doc.Report.PaymentInfos = append(doc.Report.PaymentInfos, pain002PaymentInfo{PaymentInfoID: paymentInfoID})
+		}
+		doc.Report.PaymentInfos[i].Transactions = append(doc.Report.PaymentInfos[i].Transactions, tx)
+	}
+
+	for _, t := range b.Transactions {
+		tx := pain002Transaction{InstructionID: t.InstructionID, EndToEndID: t.EndToEndID, UETR: t.UETR}
+		tx.Status, tx.Reason = pain002Status(t.Payout.PayoutId, items, latest)
+		add(t.PaymentInfoID, tx)
+	}
+	for _, issue := range b.Issues {
+		add(issue.PaymentInfoID, pain002Transaction{InstructionID: issue.InstructionID, EndToEndID: issue.EndToEndID,
+			UETR: issue.UETR, Status: Pain002Rejected, Reason: &pain002Reason{Code: "UNSUPPORTED", Additional: issue.Reason}})
+	}
+
+	var all []string
+	for i, info := range doc.Report.PaymentInfos {
+		var statuses []string
+		for _, tx := range info.Transactions {
+			statuses = append(statuses, tx.Status)
+		}
+		doc.Report.PaymentInfos[i].Status = pain002GroupStatus(statuses)
+		all = append(all, statuses...)
+	}
+	doc.Report.Group.Status = pain002GroupStatus(all)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return errors.Wrap(err, "unable to write pain.002 report")
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return errors.Wrap(encoder.Encode(doc), "unable to encode pain.002 report")
+}
+
+func pain002Status(payoutID string, items map[string]BulkPayoutItem, latest map[string]Payout) (string, *pain002Reason) {
+	if p, ok := latest[payoutID]; ok && !p.IsNotFound() && p.Status != "" {
+		switch {
+		case p.IsSuccessful():
+			return Pain002Settled, nil
+		case p.IsFailed():
+			return Pain002Rejected, &pain002Reason{Code: p.FailureReason.FailureCode, Additional: p.FailureReason.FailureMessage}
+		}
+		return Pain002AcceptedInProcess, nil
+	}
+
+	item, ok := items[payoutID]
+	if !ok {
+		return Pain002Pending, nil
+	}
+	switch item.Outcome {
+	case BulkItemAccepted, BulkItemDuplicate:
+		return Pain002AcceptedInProcess, nil
+	case BulkItemRejected:
+		reason := item.Response.RejectionReason
+		return Pain002Rejected, &pain002Reason{Code: reason.RejectionCode, Additional: reason.RejectionMessage}
+	case BulkItemInvalid:
+		return Pain002Rejected, &pain002Reason{Code: "INVALID", Additional: errString(item.Err)}
+	}
+	// the request carrying the payout failed or its answer is not known, it may still have reached pawapay
+	return Pain002Pending, nil
+}
+
+// pain002GroupStatus summarises the statuses of the transactions of a group
+func pain002GroupStatus(statuses []string) string {
+	counts := map[string]int{}
+	for _, s := range statuses {
+		counts[s]++
+	}
+	switch {
+	case len(statuses) == 0:
+		return Pain002Rejected
+	case counts[Pain002Settled] == len(statuses):
+		return Pain002Settled
+	case counts[Pain002Rejected] == len(statuses):
+		return Pain002Rejected
+	case counts[Pain002Rejected] > 0:
+		return Pain002PartiallyAccepted
+	case counts[Pain002Pending] > 0:
+		return Pain002Pending
+	}
+	return Pain002AcceptedInProcess
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -2,6 +2,8 @@ package pawapay_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,10 +12,16 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/Uchencho/pawapay"
+	"github.com/Uchencho/pawapay/boltstore"
+	pawapayprometheus "github.com/Uchencho/pawapay/prometheus"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -726,3 +734,2292 @@ func TestResendRefundCallBack(t *testing.T) {
 		})
 	}
 }
+
+type recordingMetrics struct {
+	requests  []pawapay.RequestObservation
+	callbacks []pawapay.CallbackObservation
+}
+
+func (m *recordingMetrics) ObserveRequest(o pawapay.RequestObservation) {
+	m.requests = append(m.requests, o)
+}
+func (m *recordingMetrics) ObserveCallback(o pawapay.CallbackObservation) {
+	m.callbacks = append(m.callbacks, o)
+}
+
+func TestMetricsAreRecorded(t *testing.T) {
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var resp pawapay.CreatePayoutResponse
+		fileToStruct(filepath.Join("testdata", "create-payout-response.json"), &resp)
+
+		w.WriteHeader(http.StatusOK)
+		bb, _ := json.Marshal(resp)
+		w.Write(bb)
+	}))
+	defer pawapayService.Close()
+
+	metrics := &recordingMetrics{}
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, Metrics: metrics})
+
+	_, err := c.CreatePayout(timeProvider(), pawapay.PayoutRequest{
+		PayoutId:      testPayoutId,
+		Amount:        pawapay.Amount{Currency: "GHS", Value: "1000"},
+		Description:   "test",
+		PhoneNumber:   pawapay.PhoneNumber{CountryCode: "233", Number: "247492147"},
+		Correspondent: "MTN_MOMO_GHA",
+	})
+	t.Run("No error is returned", func(t *testing.T) {
+		assert.NoError(t, err)
+	})
+
+	t.Run("Request observation is as expected", func(t *testing.T) {
+		if assert.Len(t, metrics.requests, 1) {
+			o := metrics.requests[0]
+			assert.Equal(t, "payouts.create", o.Operation)
+			assert.Equal(t, "MTN_MOMO_GHA", o.Correspondent)
+			assert.Equal(t, http.StatusOK, o.ResponseCode)
+			if assert.Len(t, o.Items, 1) {
+				assert.Equal(t, "GHS", o.Items[0].Currency)
+				assert.Equal(t, "GHA", o.Items[0].Country)
+				assert.Equal(t, "ACCEPTED", o.Items[0].Status)
+				assert.Equal(t, float64(1000), o.Items[0].Amount)
+			}
+		}
+	})
+
+	t.Run("Prometheus collector accepts the observation", func(t *testing.T) {
+		collector := pawapayprometheus.NewCollector("test")
+		registry := prometheus.NewRegistry()
+		assert.NoError(t, registry.Register(collector))
+		collector.ObserveRequest(metrics.requests[0])
+
+		families, err := registry.Gather()
+		assert.NoError(t, err)
+		assert.NotEmpty(t, families)
+	})
+}
+
+func TestBulkMetrics(t *testing.T) {
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body []pawapay.CreatePayoutRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		// answered in reverse order, the first row is rejected
+		var results []pawapay.CreatePayoutResponse
+		for i := len(body) - 1; i >= 0; i-- {
+			status := "ACCEPTED"
+			if i == 0 {
+				status = "REJECTED"
+			}
+			results = append(results, pawapay.CreatePayoutResponse{PayoutID: body[i].PayoutId, Status: status})
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(results)
+	}))
+	defer pawapayService.Close()
+
+	metrics := &recordingMetrics{}
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, Metrics: metrics})
+	payout := func(id, correspondent string) pawapay.PayoutRequest {
+		return pawapay.PayoutRequest{PayoutId: id, Amount: pawapay.Amount{Currency: "GHS", Value: "10"},
+			PhoneNumber: pawapay.PhoneNumber{CountryCode: "233", Number: "247492147"}, Correspondent: correspondent}
+	}
+	c.CreateBulkPayout(timeProvider(), []pawapay.PayoutRequest{
+		payout("7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01", "MTN_MOMO_GHA"),
+		payout("7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a02", "AIRTELTIGO_GHA"),
+	})
+
+	if assert.Len(t, metrics.requests, 1, "a bulk call is observed once") {
+		o := metrics.requests[0]
+		assert.Empty(t, o.Correspondent)
+		if assert.Len(t, o.Items, 2) {
+			assert.Equal(t, "REJECTED", o.Items[0].Status)
+			assert.Equal(t, "ACCEPTED", o.Items[1].Status)
+		}
+	}
+}
+
+func TestCallbackHandler(t *testing.T) {
+	metrics := &recordingMetrics{}
+	c := pawapay.NewService(pawapay.Config{Metrics: metrics})
+
+	var received pawapay.Callback
+	handler := c.CallbackHandler(pawapay.PayoutCallback, func(cb pawapay.Callback) error {
+		received = cb
+		return nil
+	})
+
+	bb, _ := os.ReadFile(filepath.Join("testdata", "get-payout-response.json"))
+	var payouts []json.RawMessage
+	json.Unmarshal(bb, &payouts)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/callback", bytes.NewReader(payouts[0])))
+
+	t.Run("Callback is acknowledged", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Callback is decoded", func(t *testing.T) {
+		assert.Equal(t, testPayoutId, received.Payout.PayoutID)
+		assert.Equal(t, "COMPLETED", received.Status())
+	})
+
+	t.Run("Callback is observed", func(t *testing.T) {
+		if assert.Len(t, metrics.callbacks, 1) {
+			assert.Equal(t, "MTN_MOMO_ZMB", metrics.callbacks[0].Correspondent)
+			assert.Equal(t, "COMPLETED", metrics.callbacks[0].Status)
+		}
+	})
+}
+
+func TestRateLimitRetriesAfterTooManyRequests(t *testing.T) {
+	var calls int
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		var resp []pawapay.Payout
+		fileToStruct(filepath.Join("testdata", "get-payout-response.json"), &resp)
+
+		w.WriteHeader(http.StatusOK)
+		bb, _ := json.Marshal(resp)
+		w.Write(bb)
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{
+		BaseURL: pawapayService.URL,
+		RateLimit: &pawapay.RateLimit{
+			Limit:       pawapay.Limit{RequestsPerSecond: 100, Burst: 1},
+			MaxInFlight: 1,
+			MaxRetries:  1,
+		},
+	})
+
+	result, err := c.GetPayout(testPayoutId)
+	t.Run("No error is returned", func(t *testing.T) {
+		assert.NoError(t, err)
+	})
+
+	t.Run("Request is retried once", func(t *testing.T) {
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, testPayoutId, result.PayoutID)
+	})
+}
+
+func TestRateLimitHonorsContextCancellation(t *testing.T) {
+	c := pawapay.NewService(pawapay.Config{
+		BaseURL: "http://127.0.0.1:0",
+		RateLimit: &pawapay.RateLimit{
+			Families: map[pawapay.EndpointFamily]pawapay.Limit{
+				pawapay.ReadEndpoints: {RequestsPerSecond: 0.001, Burst: 1},
+			},
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := c.WithContext(ctx).GetPayout(testPayoutId)
+	t.Run("Cancellation error is returned", func(t *testing.T) {
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var calls int
+	healthy := false
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var resp pawapay.CreatePayoutResponse
+		fileToStruct(filepath.Join("testdata", "create-payout-response.json"), &resp)
+
+		w.WriteHeader(http.StatusOK)
+		bb, _ := json.Marshal(resp)
+		w.Write(bb)
+	}))
+	defer pawapayService.Close()
+
+	breaker := pawapay.NewCircuitBreaker(pawapay.CircuitBreakerConfig{FailureThreshold: 2, CoolDown: 50 * time.Millisecond})
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, CircuitBreaker: breaker})
+
+	req := pawapay.PayoutRequest{
+		PayoutId:      testPayoutId,
+		Amount:        pawapay.Amount{Currency: "GHS", Value: "1000"},
+		Description:   "test",
+		PhoneNumber:   pawapay.PhoneNumber{CountryCode: "233", Number: "247492147"},
+		Correspondent: "MTN_MOMO_GHA",
+	}
+
+	for i := 0; i < 2; i++ {
+		c.CreatePayout(timeProvider(), req)
+	}
+
+	t.Run("Circuit opens after threshold", func(t *testing.T) {
+		assert.Equal(t, pawapay.BreakerOpen, breaker.State("MTN_MOMO_GHA", pawapay.PayoutOperation))
+		assert.Equal(t, pawapay.BreakerClosed, breaker.State("MTN_MOMO_GHA", pawapay.DepositOperation))
+	})
+
+	t.Run("Open circuit fails fast", func(t *testing.T) {
+		_, err := c.CreatePayout(timeProvider(), req)
+		var openErr *pawapay.CircuitOpenError
+		assert.ErrorAs(t, err, &openErr)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("A cancelled trial request leaves the circuit half-open", func(t *testing.T) {
+		time.Sleep(60 * time.Millisecond)
+		assert.Equal(t, pawapay.BreakerHalfOpen, breaker.State("MTN_MOMO_GHA", pawapay.PayoutOperation))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := c.WithContext(ctx).CreatePayout(timeProvider(), req)
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, pawapay.BreakerHalfOpen, breaker.State("MTN_MOMO_GHA", pawapay.PayoutOperation))
+	})
+
+	t.Run("Circuit closes after a successful trial request", func(t *testing.T) {
+		assert.Equal(t, pawapay.BreakerHalfOpen, breaker.State("MTN_MOMO_GHA", pawapay.PayoutOperation))
+
+		healthy = true
+		_, err := c.CreatePayout(timeProvider(), req)
+		assert.NoError(t, err)
+		assert.Equal(t, pawapay.BreakerClosed, breaker.State("MTN_MOMO_GHA", pawapay.PayoutOperation))
+	})
+}
+
+func TestGetWalletBalances(t *testing.T) {
+	table := []row{
+		{
+			Name: "Retrieving wallet balances succeeds",
+			CustomServerURL: func(t *testing.T) string {
+				pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+					t.Run("URL and request method is as expected", func(t *testing.T) {
+						expectedURL := "/wallet-balances"
+						assert.Equal(t, http.MethodGet, req.Method)
+						assert.Equal(t, expectedURL, req.RequestURI)
+					})
+
+					var resp pawapay.WalletBalancesResponse
+					fileToStruct(filepath.Join("testdata", "wallet-balances-response.json"), &resp)
+
+					w.WriteHeader(http.StatusOK)
+					bb, _ := json.Marshal(resp)
+					w.Write(bb)
+
+				}))
+				return pawapayService.URL
+			},
+		},
+	}
+
+	for _, row := range table {
+
+		c := pawapay.NewService(pawapay.Config{
+			BaseURL: row.CustomServerURL(t),
+		})
+
+		log.Printf("======== Running row: %s ==========", row.Name)
+
+		result, err := c.GetWalletBalances()
+		t.Run("No error is returned", func(t *testing.T) {
+			assert.NoError(t, err)
+		})
+
+		t.Run("Balances are as expected", func(t *testing.T) {
+			assert.Len(t, result.Balances, 2)
+		})
+
+		affordability, err := c.CanAfford([]pawapay.PayoutRequest{
+			{PayoutId: testPayoutId, Amount: pawapay.Amount{Currency: "GHS", Value: "1000"},
+				PhoneNumber: pawapay.PhoneNumber{CountryCode: "233", Number: "247492147"}},
+			{PayoutId: testPayoutId, Amount: pawapay.Amount{Currency: "GHS", Value: "499.99"},
+				PhoneNumber: pawapay.PhoneNumber{CountryCode: "233", Number: "247492148"}},
+		})
+		t.Run("Batch within the wallet balance is affordable", func(t *testing.T) {
+			assert.NoError(t, err)
+			assert.True(t, affordability.CanAfford)
+			assert.Equal(t, "1499.99", affordability.Wallets[0].Required)
+		})
+
+		affordability, err = c.CanAfford([]pawapay.PayoutRequest{
+			{PayoutId: testPayoutId, Amount: pawapay.Amount{Currency: "GHS", Value: "1500.01"},
+				PhoneNumber: pawapay.PhoneNumber{CountryCode: "233", Number: "247492147"}},
+		})
+		t.Run("Batch above the wallet balance is not affordable", func(t *testing.T) {
+			assert.NoError(t, err)
+			assert.False(t, affordability.CanAfford)
+		})
+
+		_, err = c.CanAfford([]pawapay.PayoutRequest{
+			{PayoutId: testPayoutId, Amount: pawapay.Amount{Currency: "GHS", Value: "1"},
+				PhoneNumber: pawapay.PhoneNumber{CountryCode: "0", Number: "247492147"}},
+		})
+		t.Run("Unknown calling codes are typed", func(t *testing.T) {
+			var callingCodeErr *pawapay.CallingCodeError
+			if assert.ErrorAs(t, err, &callingCodeErr) {
+				assert.Equal(t, "0", callingCodeErr.CallingCode)
+			}
+		})
+	}
+}
+
+func TestCreatePaymentPageSession(t *testing.T) {
+	table := []row{
+		{
+			Name: "payment page session is created successfully",
+			Input: pawapay.PaymentPageRequest{
+				DepositId:   testDepositId,
+				ReturnURL:   "https://merchant.com/paymentProcessed",
+				Amount:      pawapay.Amount{Currency: "ZMW", Value: "15"},
+				Description: "Note of 4 to 22 chars",
+				Country:     "ZMB",
+				PhoneNumber: pawapay.PhoneNumber{CountryCode: "260", Number: "763456789"},
+				Language:    "en",
+				Reason:      "Ticket to festival",
+				Metadata: []pawapay.MetadataField{
+					{FieldName: "orderId", FieldValue: "ORD-123456789"},
+					{FieldName: "customerId", FieldValue: "customer@email.com", IsPII: true},
+				},
+			},
+			CustomServerURL: func(t *testing.T) string {
+				pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+					var actualBody, expectedBody pawapay.CreatePaymentPageSessionRequest
+
+					if err := json.NewDecoder(req.Body).Decode(&actualBody); err != nil {
+						log.Printf("error in unmarshalling %+v", err)
+						w.WriteHeader(http.StatusBadRequest)
+						return
+					}
+
+					t.Run("URL and request method is as expected", func(t *testing.T) {
+						expectedURL := "/v1/widget/sessions"
+						assert.Equal(t, http.MethodPost, req.Method)
+						assert.Equal(t, expectedURL, req.RequestURI)
+					})
+
+					t.Run("Request is as expected", func(t *testing.T) {
+						fileToStruct(filepath.Join("testdata", "create-payment-page-session-request.json"), &expectedBody)
+						assert.Equal(t, expectedBody, actualBody)
+					})
+
+					var resp pawapay.CreatePaymentPageSessionResponse
+					fileToStruct(filepath.Join("testdata", "create-payment-page-session-response.json"), &resp)
+
+					w.WriteHeader(http.StatusOK)
+					bb, _ := json.Marshal(resp)
+					w.Write(bb)
+
+				}))
+				return pawapayService.URL
+			},
+		},
+	}
+
+	for _, row := range table {
+
+		c := pawapay.NewService(pawapay.Config{
+			BaseURL: row.CustomServerURL(t),
+		})
+
+		req := row.Input.(pawapay.PaymentPageRequest)
+
+		log.Printf("======== Running row: %s ==========", row.Name)
+
+		result, err := c.CreatePaymentPageSession(req)
+		t.Run("No error is returned", func(t *testing.T) {
+			assert.NoError(t, err)
+		})
+
+		t.Run("Redirect url is returned", func(t *testing.T) {
+			assert.NotEmpty(t, result.RedirectURL)
+		})
+	}
+}
+
+func TestPaymentPageCurrency(t *testing.T) {
+	c := pawapay.NewService(pawapay.Config{BaseURL: "http://127.0.0.1:1"})
+	req := pawapay.PaymentPageRequest{DepositId: testDepositId, ReturnURL: "https://merchant.com/paymentProcessed",
+		Amount: pawapay.Amount{Currency: "GHS", Value: "15"}, Country: "ZMB"}
+
+	t.Run("A currency that is not the country's is rejected", func(t *testing.T) {
+		_, err := c.CreatePaymentPageSession(req)
+		assert.ErrorContains(t, err, "not that of ZMB")
+	})
+
+	t.Run("A currency without a country is rejected", func(t *testing.T) {
+		req.Country = ""
+		_, err := c.CreatePaymentPageSession(req)
+		assert.ErrorContains(t, err, "without a country")
+	})
+}
+
+func TestResolvePaymentPageSession(t *testing.T) {
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("[]"))
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+
+	result, err := c.ResolvePaymentPageSession(testDepositId)
+	t.Run("No error is returned", func(t *testing.T) {
+		assert.NoError(t, err)
+	})
+
+	t.Run("Session without a deposit is abandoned", func(t *testing.T) {
+		assert.Equal(t, pawapay.PaymentPageAbandoned, result.Outcome)
+	})
+}
+
+func TestTransactionMetadata(t *testing.T) {
+	var calls int
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+
+		var resp []pawapay.Payout
+		fileToStruct(filepath.Join("testdata", "get-payout-response.json"), &resp)
+
+		w.WriteHeader(http.StatusOK)
+		bb, _ := json.Marshal(resp)
+		w.Write(bb)
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+
+	t.Run("Metadata is returned with the payout", func(t *testing.T) {
+		result, err := c.GetPayout(testPayoutId)
+		assert.NoError(t, err)
+		assert.Equal(t, "ORD-123456789", result.Metadata["orderId"])
+	})
+
+	t.Run("Too many metadata fields are rejected before sending", func(t *testing.T) {
+		var metadata []pawapay.MetadataField
+		for i := 0; i <= pawapay.MaxMetadataFields; i++ {
+			metadata = append(metadata, pawapay.MetadataField{FieldName: fmt.Sprintf("field%d", i), FieldValue: "value"})
+		}
+
+		_, err := c.RequestRefund(testDepositId, testDepositId, pawapay.Amount{Currency: "GHS", Value: "10"}, metadata...)
+		assert.Error(t, err)
+		assert.Equal(t, 1, calls)
+	})
+}
+
+func TestValidateMetadata(t *testing.T) {
+	field := func(name string, valueLength int) pawapay.MetadataField {
+		return pawapay.MetadataField{FieldName: name, FieldValue: strings.Repeat("é", valueLength)}
+	}
+	// every field is 6 + 194 = 200 characters, ten of them reach MaxMetadataSize
+	fields := func(n, lastValueLength int) []pawapay.MetadataField {
+		var metadata []pawapay.MetadataField
+		for i := 0; i < n; i++ {
+			metadata = append(metadata, field(fmt.Sprintf("field%d", i), 194))
+		}
+		metadata[n-1].FieldValue = strings.Repeat("é", lastValueLength)
+		return metadata
+	}
+
+	table := []struct {
+		name     string
+		metadata []pawapay.MetadataField
+		valid    bool
+	}{
+		{"Longest name", []pawapay.MetadataField{field(strings.Repeat("n", pawapay.MaxMetadataFieldNameLength), 1)}, true},
+		{"Name too long", []pawapay.MetadataField{field(strings.Repeat("n", pawapay.MaxMetadataFieldNameLength+1), 1)}, false},
+		{"Longest value", []pawapay.MetadataField{field("orderId", pawapay.MaxMetadataFieldValueLength)}, true},
+		{"Value too long", []pawapay.MetadataField{field("orderId", pawapay.MaxMetadataFieldValueLength+1)}, false},
+		{"Largest metadata", fields(10, 194), true},
+		{"Metadata too large", fields(10, 195), false},
+	}
+	for _, row := range table {
+		t.Run(row.name, func(t *testing.T) {
+			err := pawapay.ValidateMetadata(row.metadata)
+			if row.valid {
+				assert.NoError(t, err)
+			} else {
+				var metadataErr *pawapay.MetadataError
+				assert.ErrorAs(t, err, &metadataErr)
+			}
+		})
+	}
+}
+
+func TestRefundTracker(t *testing.T) {
+	deposit := `[{"depositId":"` + testDepositId + `","status":"COMPLETED","requestedAmount":"200.00",` +
+		`"depositedAmount":"150.00","currency":"ZMW","country":"ZMB","correspondent":"MTN_MOMO_ZMB"}]`
+
+	var refunds []pawapay.RefundRequest
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == http.MethodGet && req.RequestURI == "/deposits/"+testDepositId:
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(deposit))
+		case req.Method == http.MethodGet && strings.HasPrefix(req.RequestURI, "/refunds/"):
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"refundId":"` + strings.TrimPrefix(req.RequestURI, "/refunds/") + `","status":"COMPLETED"}]`))
+		case req.Method == http.MethodPost && req.RequestURI == "/refunds":
+			var body pawapay.RefundRequest
+			json.NewDecoder(req.Body).Decode(&body)
+			refunds = append(refunds, body)
+
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"refundId":"` + body.RefundId + `","status":"ACCEPTED","created":"2020-10-19T11:17:01Z"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+	tracker := pawapay.NewRefundTracker(&c, pawapay.NewMemoryRefundStore())
+
+	t.Run("Partial refund succeeds", func(t *testing.T) {
+		_, err := tracker.Refund("3f2a0f4e-7c1d-4b61-9f0e-0d8a8f1c2b01", testDepositId, pawapay.Amount{Value: "100"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Over refund is rejected before sending", func(t *testing.T) {
+		_, err := tracker.Refund("3f2a0f4e-7c1d-4b61-9f0e-0d8a8f1c2b02", testDepositId, pawapay.Amount{Value: "60"})
+		var overRefund *pawapay.OverRefundError
+		assert.ErrorAs(t, err, &overRefund)
+		assert.Equal(t, "50.00", overRefund.Refundable)
+		assert.Len(t, refunds, 1)
+	})
+
+	t.Run("Refund without an amount refunds what is left of the deposited amount", func(t *testing.T) {
+		_, err := tracker.Refund("3f2a0f4e-7c1d-4b61-9f0e-0d8a8f1c2b03", testDepositId, pawapay.Amount{})
+		assert.NoError(t, err)
+		if assert.Len(t, refunds, 2) {
+			assert.Equal(t, "50.00", refunds[1].Amount)
+		}
+	})
+}
+
+func TestRefundTrackerDepositNotRefundable(t *testing.T) {
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`[{"depositId":"` + testDepositId + `","status":"FAILED","requestedAmount":"200.00",` +
+			`"currency":"ZMW","country":"ZMB","correspondent":"MTN_MOMO_ZMB"}]`))
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+	_, err := pawapay.NewRefundTracker(&c, pawapay.NewMemoryRefundStore()).RefundableBalance(testDepositId)
+
+	assert.ErrorIs(t, err, pawapay.ErrDepositNotRefundable)
+	var notRefundable *pawapay.DepositNotRefundableError
+	if assert.ErrorAs(t, err, &notRefundable) {
+		assert.Equal(t, "FAILED", notRefundable.Status)
+	}
+}
+
+func TestRefundTrackerFailedRequests(t *testing.T) {
+	deposit := `[{"depositId":"` + testDepositId + `","status":"COMPLETED","requestedAmount":"200.00",` +
+		`"depositedAmount":"150.00","currency":"ZMW","country":"ZMB","correspondent":"MTN_MOMO_ZMB"}]`
+
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == http.MethodGet && req.RequestURI == "/deposits/"+testDepositId:
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(deposit))
+		case req.Method == http.MethodGet && strings.HasPrefix(req.RequestURI, "/refunds/"):
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[]`))
+		default:
+			// the connection is dropped without an answer, pawapay may or may not have received the refund
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		}
+	}))
+	defer pawapayService.Close()
+
+	var keyRequests int
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL,
+		Credentials: pawapay.CredentialProviderFunc(func(context.Context) ([]string, error) {
+			if keyRequests++; keyRequests == 2 {
+				return nil, fmt.Errorf("secret store unavailable")
+			}
+			return []string{"key"}, nil
+		})})
+	store := pawapay.NewMemoryRefundStore()
+	tracker := pawapay.NewRefundTracker(&c, store)
+
+	t.Run("Invalid refunds are not recorded", func(t *testing.T) {
+		_, err := tracker.Refund("not-a-uuid", testDepositId, pawapay.Amount{Value: "10"})
+		assert.Error(t, err)
+		_, err = tracker.Refund("3f2a0f4e-7c1d-4b61-9f0e-0d8a8f1c2b04", testDepositId, pawapay.Amount{Value: "10"},
+			pawapay.MetadataField{FieldName: strings.Repeat("n", pawapay.MaxMetadataFieldNameLength+1), FieldValue: "1"})
+		assert.Error(t, err)
+
+		records, _ := store.ListRefunds(testDepositId)
+		assert.Empty(t, records)
+	})
+
+	t.Run("A refund that was never sent does not count", func(t *testing.T) {
+		keyRequests = 0
+		_, err := tracker.Refund("3f2a0f4e-7c1d-4b61-9f0e-0d8a8f1c2b05", testDepositId, pawapay.Amount{Value: "10"})
+		assert.True(t, pawapay.IsNotSent(err))
+
+		records, _ := store.ListRefunds(testDepositId)
+		if assert.Len(t, records, 1) {
+			assert.Equal(t, pawapay.RefundNotSent, records[0].Status)
+		}
+	})
+
+	t.Run("A refund pawapay does not know stops counting", func(t *testing.T) {
+		_, err := tracker.Refund("3f2a0f4e-7c1d-4b61-9f0e-0d8a8f1c2b06", testDepositId, pawapay.Amount{Value: "10"})
+		assert.Error(t, err)
+		assert.False(t, pawapay.IsNotSent(err))
+
+		balance, err := tracker.RefundableBalance(testDepositId)
+		assert.NoError(t, err)
+		assert.Equal(t, "150.00", balance.Refundable)
+		if assert.Len(t, balance.Refunds, 2) {
+			assert.Equal(t, pawapay.RefundNotFound, balance.Refunds[1].Status)
+		}
+	})
+}
+
+func TestRefundTrackerAmounts(t *testing.T) {
+	deposit := `[{"depositId":"` + testDepositId + `","status":"COMPLETED","requestedAmount":"1000",` +
+		`"depositedAmount":"1000","currency":"UGX","country":"UGA","correspondent":"MTN_MOMO_UGA"}]`
+
+	var refunds []pawapay.RefundRequest
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		switch {
+		case req.Method == http.MethodGet && req.RequestURI == "/deposits/"+testDepositId:
+			w.Write([]byte(deposit))
+		case req.Method == http.MethodGet:
+			w.Write([]byte(`[{"refundId":"` + strings.TrimPrefix(req.RequestURI, "/refunds/") + `","status":"COMPLETED"}]`))
+		default:
+			var body pawapay.RefundRequest
+			json.NewDecoder(req.Body).Decode(&body)
+			refunds = append(refunds, body)
+			w.Write([]byte(`{"refundId":"` + body.RefundId + `","status":"ACCEPTED"}`))
+		}
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+
+	t.Run("A full refund sends the deposited amount as pawapay reported it", func(t *testing.T) {
+		tracker := pawapay.NewRefundTracker(&c, pawapay.NewMemoryRefundStore())
+		_, err := tracker.Refund("3f2a0f4e-7c1d-4b61-9f0e-0d8a8f1c2b01", testDepositId, pawapay.Amount{})
+		assert.NoError(t, err)
+		if assert.Len(t, refunds, 1) {
+			assert.Equal(t, "1000", refunds[0].Amount)
+		}
+	})
+
+	t.Run("What is left keeps the scale of the deposit", func(t *testing.T) {
+		tracker := pawapay.NewRefundTracker(&c, pawapay.NewMemoryRefundStore())
+		_, err := tracker.Refund("3f2a0f4e-7c1d-4b61-9f0e-0d8a8f1c2b02", testDepositId, pawapay.Amount{Value: "400"})
+		assert.NoError(t, err)
+
+		balance, err := tracker.RefundableBalance(testDepositId)
+		assert.NoError(t, err)
+		assert.Equal(t, "400", balance.Refunded)
+		assert.Equal(t, "600", balance.Refundable)
+	})
+}
+
+type failingRefundStore struct {
+	*pawapay.MemoryRefundStore
+	saves int
+}
+
+// SaveRefund fails every save after the first
+func (f *failingRefundStore) SaveRefund(r pawapay.RefundRecord) error {
+	if f.saves++; f.saves > 1 {
+		return fmt.Errorf("store unavailable")
+	}
+	return f.MemoryRefundStore.SaveRefund(r)
+}
+
+func TestRefundTrackerSaveErrors(t *testing.T) {
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"depositId":"` + testDepositId + `","status":"COMPLETED","depositedAmount":"150",` +
+				`"currency":"ZMW"}]`))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+	store := &failingRefundStore{MemoryRefundStore: pawapay.NewMemoryRefundStore()}
+	_, err := pawapay.NewRefundTracker(&c, store).Refund("3f2a0f4e-7c1d-4b61-9f0e-0d8a8f1c2b01", testDepositId,
+		pawapay.Amount{Value: "10"})
+
+	t.Run("A rejected refund that cannot be saved is an error that keeps its cause", func(t *testing.T) {
+		assert.ErrorContains(t, err, "store unavailable")
+		var statusErr *pawapay.StatusError
+		assert.ErrorAs(t, err, &statusErr)
+	})
+}
+
+func TestEchoedIDMismatch(t *testing.T) {
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"refundId":"5a3c5b3e-4f1b-4a51-b7a2-6d1f1c0e9e11","status":"ACCEPTED","created":"2020-10-19T11:17:01Z"}`))
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+
+	result, err := c.RequestRefund(testDepositId, testDepositId, pawapay.Amount{Currency: "GHS", Value: "10"})
+	t.Run("Mismatch error is returned", func(t *testing.T) {
+		var mismatch *pawapay.IDMismatchError
+		if assert.ErrorAs(t, err, &mismatch) {
+			assert.Equal(t, testDepositId, mismatch.Sent)
+			assert.Equal(t, "5a3c5b3e-4f1b-4a51-b7a2-6d1f1c0e9e11", mismatch.Received)
+		}
+	})
+
+	t.Run("Response is still returned", func(t *testing.T) {
+		assert.Equal(t, "5a3c5b3e-4f1b-4a51-b7a2-6d1f1c0e9e11", result.RefundId)
+		assert.Equal(t, http.StatusOK, result.Annotation.ResponseCode)
+	})
+
+	t.Run("An id echoed in another case matches", func(t *testing.T) {
+		_, err := c.RequestRefund("5A3C5B3E-4F1B-4A51-B7A2-6D1F1C0E9E11", testDepositId,
+			pawapay.Amount{Currency: "GHS", Value: "10"})
+		assert.NoError(t, err)
+	})
+}
+
+func TestTransactionIDs(t *testing.T) {
+	var calls int
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("[]"))
+	}))
+	defer pawapayService.Close()
+
+	namespace := uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	c := pawapay.NewService(pawapay.Config{
+		BaseURL:     pawapayService.URL,
+		IDGenerator: pawapay.NameBasedIDGenerator{Namespace: namespace},
+	})
+
+	t.Run("Name based ids are deterministic and valid", func(t *testing.T) {
+		id := c.NewID("order-1")
+		assert.Equal(t, id, c.NewID("order-1"))
+		assert.NotEqual(t, id, c.NewID("order-2"))
+		assert.NoError(t, pawapay.ValidateID("payoutId", id))
+	})
+
+	t.Run("Random ids are valid", func(t *testing.T) {
+		assert.NoError(t, pawapay.ValidateID("payoutId", pawapay.RandomIDGenerator{}.GenerateID("")))
+	})
+
+	t.Run("Invalid id is rejected before sending", func(t *testing.T) {
+		_, err := c.CreatePayout(timeProvider(), pawapay.PayoutRequest{
+			PayoutId:      "uniqueId",
+			Amount:        pawapay.Amount{Currency: "GHS", Value: "1000"},
+			PhoneNumber:   pawapay.PhoneNumber{CountryCode: "233", Number: "247492147"},
+			Correspondent: "MTN_MOMO_GHA",
+		})
+		var invalid *pawapay.InvalidIDError
+		assert.ErrorAs(t, err, &invalid)
+		assert.Equal(t, 0, calls)
+	})
+
+	t.Run("Repeated id in a batch is rejected before sending", func(t *testing.T) {
+		deposit := pawapay.DepositRequest{
+			DepositId:     testDepositId,
+			Amount:        pawapay.Amount{Currency: "GHS", Value: "1000"},
+			PhoneNumber:   pawapay.PhoneNumber{CountryCode: "233", Number: "247492147"},
+			Correspondent: "MTN_MOMO_GHA",
+		}
+		_, err := c.InitiateBulkDeposit(timeProvider(), []pawapay.DepositRequest{deposit, deposit})
+		var duplicate *pawapay.DuplicateIDError
+		if assert.ErrorAs(t, err, &duplicate) {
+			assert.Equal(t, []int{0, 1}, duplicate.Indexes)
+		}
+		assert.Equal(t, 0, calls)
+	})
+}
+
+func TestCreateBulkPayoutInChunks(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		chunks [][]pawapay.CreatePayoutRequest
+	)
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body []pawapay.CreatePayoutRequest
+		json.NewDecoder(req.Body).Decode(&body)
+
+		mu.Lock()
+		chunks = append(chunks, body)
+		mu.Unlock()
+
+		// the chunk holding the payout to 0000000003 is failed by the server
+		for _, payout := range body {
+			if payout.Recipient.Address.Value == "2330000000003" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		var resp []pawapay.CreatePayoutResponse
+		for _, payout := range body {
+			resp = append(resp, pawapay.CreatePayoutResponse{PayoutID: payout.PayoutId, Status: "ACCEPTED"})
+		}
+		w.WriteHeader(http.StatusOK)
+		bb, _ := json.Marshal(resp)
+		w.Write(bb)
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{
+		BaseURL: pawapayService.URL,
+		Bulk:    pawapay.BulkOptions{ChunkSize: 2, Concurrency: 2},
+	})
+
+	var req []pawapay.PayoutRequest
+	for i := 0; i < 5; i++ {
+		req = append(req, pawapay.PayoutRequest{
+			PayoutId:      c.NewID(""),
+			Amount:        pawapay.Amount{Currency: "GHS", Value: "1000"},
+			PhoneNumber:   pawapay.PhoneNumber{CountryCode: "233", Number: fmt.Sprintf("000000000%d", i)},
+			Correspondent: "MTN_MOMO_GHA",
+		})
+	}
+	req[1].PhoneNumber.CountryCode = "0"
+
+	result, err := c.CreateBulkPayout(timeProvider(), req)
+
+	t.Run("Bulk error reports the rows that were not accepted", func(t *testing.T) {
+		var bulkErr *pawapay.BulkError
+		if assert.ErrorAs(t, err, &bulkErr) {
+			assert.Equal(t, 1, bulkErr.Invalid)
+			assert.Equal(t, 2, bulkErr.Failed)
+		}
+	})
+
+	t.Run("Valid rows are sent in chunks", func(t *testing.T) {
+		assert.Len(t, chunks, 2)
+		assert.Len(t, result.Annotations, 2)
+	})
+
+	t.Run("Every row has an outcome", func(t *testing.T) {
+		outcomes := []pawapay.BulkItemOutcome{}
+		for _, item := range result.Items {
+			outcomes = append(outcomes, item.Outcome)
+		}
+		assert.Equal(t, []pawapay.BulkItemOutcome{pawapay.BulkItemAccepted, pawapay.BulkItemInvalid,
+			pawapay.BulkItemAccepted, pawapay.BulkItemFailed, pawapay.BulkItemFailed}, outcomes)
+		assert.Len(t, result.Result, 2)
+	})
+}
+
+func TestRequestBulkRefund(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		refunds []pawapay.RefundRequest
+	)
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body pawapay.RefundRequest
+		json.NewDecoder(req.Body).Decode(&body)
+
+		mu.Lock()
+		refunds = append(refunds, body)
+		mu.Unlock()
+
+		if body.Amount == "500" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"refundId":"` + body.RefundId + `","status":"ACCEPTED","created":"2020-10-19T11:17:01Z"}`))
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, Bulk: pawapay.BulkOptions{Concurrency: 2}})
+
+	req := []pawapay.RefundRequest{
+		{RefundId: c.NewID(""), DepositId: c.NewID(""), Amount: "100", Currency: "ZMW"},
+		{RefundId: "not-a-uuid", DepositId: c.NewID(""), Amount: "100"},
+		{RefundId: c.NewID(""), DepositId: c.NewID(""), Amount: "500"},
+		{RefundId: c.NewID(""), DepositId: c.NewID(""), Amount: "100"},
+	}
+
+	result, err := c.RequestBulkRefund(req)
+
+	t.Run("Bulk error reports the rows that were not accepted", func(t *testing.T) {
+		var bulkErr *pawapay.BulkError
+		if assert.ErrorAs(t, err, &bulkErr) {
+			assert.Equal(t, 1, bulkErr.Invalid)
+			assert.Equal(t, 1, bulkErr.Failed)
+		}
+	})
+
+	t.Run("Only valid rows are sent", func(t *testing.T) {
+		assert.Len(t, refunds, 3)
+		assert.Len(t, result.Result, 2)
+	})
+
+	t.Run("The currency of a row is sent", func(t *testing.T) {
+		for _, refund := range refunds {
+			if refund.RefundId == req[0].RefundId {
+				assert.Equal(t, "ZMW", refund.Currency)
+			}
+		}
+	})
+
+	t.Run("Every row has an outcome", func(t *testing.T) {
+		outcomes := []pawapay.BulkItemOutcome{}
+		for _, item := range result.Items {
+			outcomes = append(outcomes, item.Outcome)
+		}
+		assert.Equal(t, []pawapay.BulkItemOutcome{pawapay.BulkItemAccepted, pawapay.BulkItemInvalid,
+			pawapay.BulkItemFailed, pawapay.BulkItemAccepted}, outcomes)
+	})
+}
+
+func TestBulkOutcomes(t *testing.T) {
+	statuses := map[string]string{"100": "accepted", "200": "Duplicate_Ignored", "300": "", "400": "SOMETHING_NEW"}
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body pawapay.RefundRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"refundId":"` + body.RefundId + `","status":"` + statuses[body.Amount] + `"}`))
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, Bulk: pawapay.BulkOptions{Concurrency: 1}})
+
+	var req []pawapay.RefundRequest
+	for _, amount := range []string{"100", "200", "300", "400"} {
+		req = append(req, pawapay.RefundRequest{RefundId: c.NewID(""), DepositId: c.NewID(""), Amount: amount})
+	}
+	result, err := c.RequestBulkRefund(req)
+
+	t.Run("Statuses are matched case insensitively and unknown ones are reported", func(t *testing.T) {
+		outcomes := []pawapay.BulkItemOutcome{}
+		for _, item := range result.Items {
+			outcomes = append(outcomes, item.Outcome)
+		}
+		assert.Equal(t, []pawapay.BulkItemOutcome{pawapay.BulkItemAccepted, pawapay.BulkItemDuplicate,
+			pawapay.BulkItemUnknown, pawapay.BulkItemUnknown}, outcomes)
+	})
+
+	t.Run("Unknown outcomes are a bulk error", func(t *testing.T) {
+		var bulkErr *pawapay.BulkError
+		if assert.ErrorAs(t, err, &bulkErr) {
+			assert.Equal(t, 2, bulkErr.Unknown)
+		}
+	})
+}
+
+func TestBulkUpperCasedIDs(t *testing.T) {
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body []map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		var response []map[string]string
+		for _, row := range body {
+			echoed := map[string]string{"status": "ACCEPTED"}
+			for _, field := range []string{"payoutId", "depositId"} {
+				if id, ok := row[field].(string); ok {
+					echoed[field] = strings.ToUpper(id)
+				}
+			}
+			response = append(response, echoed)
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+	phone := pawapay.PhoneNumber{CountryCode: "233", Number: "247492147"}
+	amount := pawapay.Amount{Currency: "GHS", Value: "10"}
+
+	t.Run("Payouts echoed in another case are accepted", func(t *testing.T) {
+		response, err := c.CreateBulkPayout(timeProvider(), []pawapay.PayoutRequest{
+			{PayoutId: c.NewID(""), Amount: amount, PhoneNumber: phone, Correspondent: "MTN_MOMO_GHA"},
+			{PayoutId: c.NewID(""), Amount: amount, PhoneNumber: phone, Correspondent: "MTN_MOMO_GHA"},
+		})
+		assert.NoError(t, err)
+		for _, item := range response.Items {
+			assert.Equal(t, pawapay.BulkItemAccepted, item.Outcome)
+		}
+	})
+
+	t.Run("Deposits echoed in another case are accepted", func(t *testing.T) {
+		response, err := c.InitiateBulkDeposit(timeProvider(), []pawapay.DepositRequest{
+			{DepositId: c.NewID(""), Amount: amount, PhoneNumber: phone, Correspondent: "MTN_MOMO_GHA"},
+			{DepositId: c.NewID(""), Amount: amount, PhoneNumber: phone, Correspondent: "MTN_MOMO_GHA"},
+		})
+		assert.NoError(t, err)
+		for _, item := range response.Items {
+			assert.Equal(t, pawapay.BulkItemAccepted, item.Outcome)
+		}
+	})
+}
+
+func TestOutboxRecovery(t *testing.T) {
+	var (
+		up      bool
+		created int
+	)
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case !up:
+			w.WriteHeader(http.StatusBadGateway)
+		case req.Method == http.MethodGet:
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("[]"))
+		default:
+			created++
+			var resp pawapay.CreatePayoutResponse
+			fileToStruct(filepath.Join("testdata", "create-payout-response.json"), &resp)
+
+			w.WriteHeader(http.StatusOK)
+			bb, _ := json.Marshal(resp)
+			w.Write(bb)
+		}
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+	path := filepath.Join(t.TempDir(), "outbox.json")
+
+	store, err := pawapay.NewFileOutboxStore(path)
+	assert.NoError(t, err)
+
+	_, err = pawapay.NewOutbox(&c, store).CreatePayout(timeProvider(), pawapay.PayoutRequest{
+		PayoutId:      testPayoutId,
+		Amount:        pawapay.Amount{Currency: "GHS", Value: "1000"},
+		Description:   "test",
+		PhoneNumber:   pawapay.PhoneNumber{CountryCode: "233", Number: "247492147"},
+		Correspondent: "MTN_MOMO_GHA",
+	})
+	t.Run("Payout without a definite answer stays pending", func(t *testing.T) {
+		assert.Error(t, err)
+		pending, _ := store.PendingIntents()
+		assert.Len(t, pending, 1)
+	})
+
+	up = true
+	reopened, err := pawapay.NewFileOutboxStore(path)
+	assert.NoError(t, err)
+
+	results, err := pawapay.NewOutbox(&c, reopened).Recover(timeProvider())
+	t.Run("Recovery resends the payout unknown to pawapay", func(t *testing.T) {
+		assert.NoError(t, err)
+		if assert.Len(t, results, 1) {
+			assert.True(t, results[0].Resent)
+			assert.True(t, results[0].Resolved)
+			assert.Equal(t, "ACCEPTED", results[0].Intent.Status)
+			assert.Equal(t, 2, results[0].Intent.Attempts)
+		}
+		assert.Equal(t, 1, created)
+	})
+
+	t.Run("Nothing is left pending", func(t *testing.T) {
+		pending, _ := reopened.PendingIntents()
+		assert.Empty(t, pending)
+	})
+
+	t.Run("Resolved intents are dropped from the file", func(t *testing.T) {
+		bb, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{}`, string(bb))
+	})
+}
+
+func TestOutboxCallsThatAreNotSent(t *testing.T) {
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected request to %s", req.RequestURI)
+	}))
+	defer pawapayService.Close()
+
+	payout := pawapay.PayoutRequest{
+		PayoutId:      testPayoutId,
+		Amount:        pawapay.Amount{Currency: "GHS", Value: "1000"},
+		Description:   "test",
+		PhoneNumber:   pawapay.PhoneNumber{CountryCode: "233", Number: "247492147"},
+		Correspondent: "MTN_MOMO_GHA",
+	}
+
+	t.Run("Calls failing local checks are not persisted", func(t *testing.T) {
+		c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+		store := pawapay.NewMemoryOutboxStore()
+		outbox := pawapay.NewOutbox(&c, store)
+
+		invalid := payout
+		invalid.PhoneNumber.CountryCode = "0"
+		_, err := outbox.CreatePayout(timeProvider(), invalid)
+		assert.Error(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = pawapay.NewOutbox(c.WithContext(ctx), store).CreatePayout(timeProvider(), payout)
+		assert.ErrorIs(t, err, context.Canceled)
+
+		pending, _ := store.PendingIntents()
+		assert.Empty(t, pending)
+	})
+
+	t.Run("A call that failed before being sent is not recovered", func(t *testing.T) {
+		c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL,
+			Credentials: pawapay.CredentialProviderFunc(func(context.Context) ([]string, error) {
+				return nil, fmt.Errorf("secret store unavailable")
+			})})
+		store := pawapay.NewMemoryOutboxStore()
+
+		_, err := pawapay.NewOutbox(&c, store).CreatePayout(timeProvider(), payout)
+		assert.True(t, pawapay.IsNotSent(err))
+
+		pending, _ := store.PendingIntents()
+		assert.Empty(t, pending)
+	})
+}
+
+func TestTransactionStore(t *testing.T) {
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var resp pawapay.CreatePayoutResponse
+		fileToStruct(filepath.Join("testdata", "create-payout-response.json"), &resp)
+
+		w.WriteHeader(http.StatusOK)
+		bb, _ := json.Marshal(resp)
+		w.Write(bb)
+	}))
+	defer pawapayService.Close()
+
+	boltStore, err := boltstore.NewTransactionStore(filepath.Join(t.TempDir(), "transactions.db"))
+	assert.NoError(t, err)
+	defer boltStore.Close()
+
+	stores := map[string]pawapay.TransactionStore{
+		"memory": pawapay.NewMemoryTransactionStore(),
+		"bolt":   boltStore,
+	}
+
+	for name, store := range stores {
+		c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, TransactionStore: store})
+
+		_, err := c.CreatePayout(timeProvider(), pawapay.PayoutRequest{
+			PayoutId:      testPayoutId,
+			Amount:        pawapay.Amount{Currency: "GHS", Value: "1000"},
+			Description:   "test",
+			PhoneNumber:   pawapay.PhoneNumber{CountryCode: "233", Number: "247492147"},
+			Correspondent: "MTN_MOMO_GHA",
+		})
+		assert.NoError(t, err)
+
+		t.Run(name+": payouts stuck in accepted are found", func(t *testing.T) {
+			found, err := store.FindTransactions(pawapay.TransactionQuery{
+				Type:         pawapay.PayoutTransaction,
+				Statuses:     []string{"ACCEPTED"},
+				StatusBefore: time.Now().Add(time.Second),
+			})
+			assert.NoError(t, err)
+			assert.Len(t, found, 1)
+
+			found, err = store.FindTransactions(pawapay.TransactionQuery{StatusBefore: time.Now().Add(-time.Hour)})
+			assert.NoError(t, err)
+			assert.Empty(t, found)
+		})
+
+		bb, _ := os.ReadFile(filepath.Join("testdata", "get-payout-response.json"))
+		var payouts []json.RawMessage
+		json.Unmarshal(bb, &payouts)
+		_, err = c.ParseCallback(pawapay.PayoutCallback, bytes.NewReader(payouts[0]))
+		assert.NoError(t, err)
+
+		t.Run(name+": history holds every status", func(t *testing.T) {
+			record, err := store.GetTransaction(testPayoutId)
+			assert.NoError(t, err)
+			assert.Equal(t, "COMPLETED", record.Status)
+			if assert.Len(t, record.History, 2) {
+				assert.Equal(t, pawapay.SourceCreate, record.History[0].Source)
+				assert.Equal(t, http.StatusOK, record.History[0].Annotation.ResponseCode)
+				assert.Equal(t, pawapay.SourceCallback, record.History[1].Source)
+			}
+		})
+
+		t.Run(name+": a final status is never left", func(t *testing.T) {
+			for _, status := range []string{"DUPLICATE_IGNORED", "SUBMITTED"} {
+				assert.NoError(t, store.RecordEvent(pawapay.TransactionEvent{ID: testPayoutId,
+					Type: pawapay.PayoutTransaction, Status: status, Source: pawapay.SourceGet, At: time.Now()}))
+			}
+			record, err := store.GetTransaction(testPayoutId)
+			assert.NoError(t, err)
+			assert.Equal(t, "COMPLETED", record.Status)
+			assert.Len(t, record.History, 2)
+		})
+
+		t.Run(name+": unknown transaction is not found", func(t *testing.T) {
+			_, err := store.GetTransaction("unknown")
+			assert.ErrorIs(t, err, pawapay.ErrTransactionNotFound)
+		})
+	}
+}
+
+func TestBulkTransactionEvents(t *testing.T) {
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body []pawapay.CreatePayoutRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		var response []string
+		for _, row := range body {
+			response = append(response, `{"payoutId":"`+strings.ToUpper(row.PayoutId)+`","status":"ACCEPTED"}`)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("[" + strings.Join(response, ",") + "]"))
+	}))
+	defer pawapayService.Close()
+
+	store := pawapay.NewMemoryTransactionStore()
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, TransactionStore: store})
+	_, err := c.CreateBulkPayout(timeProvider(), []pawapay.PayoutRequest{{PayoutId: testPayoutId,
+		Amount:      pawapay.Amount{Currency: "GHS", Value: "10"},
+		PhoneNumber: pawapay.PhoneNumber{CountryCode: "233", Number: "247492147"}, Correspondent: "MTN_MOMO_GHA"}})
+	assert.NoError(t, err)
+
+	t.Run("Statuses echoed with ids in another case are recorded", func(t *testing.T) {
+		record, err := store.GetTransaction(testPayoutId)
+		assert.NoError(t, err)
+		assert.Equal(t, "ACCEPTED", record.Status)
+	})
+}
+
+func TestReconciler(t *testing.T) {
+	const (
+		matchedId   = "8c1a7a52-2a4f-4f0c-9d8b-1e0f5d6a7b01"
+		statusId    = "8c1a7a52-2a4f-4f0c-9d8b-1e0f5d6a7b02"
+		amountId    = "8c1a7a52-2a4f-4f0c-9d8b-1e0f5d6a7b03"
+		missingId   = "8c1a7a52-2a4f-4f0c-9d8b-1e0f5d6a7b04"
+		unknownId   = "8c1a7a52-2a4f-4f0c-9d8b-1e0f5d6a7b05"
+		shortfallId = "8c1a7a52-2a4f-4f0c-9d8b-1e0f5d6a7b06"
+	)
+
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.RequestURI[strings.LastIndex(req.RequestURI, "/")+1:]
+		w.WriteHeader(http.StatusOK)
+		switch id {
+		case missingId:
+			w.Write([]byte("[]"))
+		case shortfallId:
+			w.Write([]byte(`[{"depositId":"` + id + `","status":"COMPLETED","requestedAmount":"200.00","depositedAmount":"150.00","currency":"ZMW"}]`))
+		default:
+			w.Write([]byte(`[{"payoutId":"` + id + `","status":"COMPLETED","amount":"100.00","currency":"GHS"}]`))
+		}
+	}))
+	defer pawapayService.Close()
+
+	local := "type,id,amount,currency,status\n" +
+		"payout," + matchedId + ",100,GHS,COMPLETED\n" +
+		"payout," + statusId + ",100,GHS,FAILED\n" +
+		"payout," + amountId + ",120,GHS,COMPLETED\n" +
+		"payout," + missingId + ",100,GHS,ACCEPTED\n" +
+		"deposit," + shortfallId + ",200,ZMW,COMPLETED\n"
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+	report, err := pawapay.NewReconciler(&c).Reconcile(pawapay.CSVSource{Reader: strings.NewReader(local)},
+		pawapay.TransactionRef{ID: matchedId, Type: pawapay.PayoutTransaction},
+		pawapay.TransactionRef{ID: unknownId, Type: pawapay.PayoutTransaction})
+
+	t.Run("No error is returned", func(t *testing.T) {
+		assert.NoError(t, err)
+	})
+
+	t.Run("Every transaction is classified", func(t *testing.T) {
+		classes := []pawapay.ReconciliationClass{}
+		for _, entry := range report.Entries {
+			classes = append(classes, entry.Class)
+		}
+		assert.Equal(t, []pawapay.ReconciliationClass{
+			pawapay.ReconciliationMatched,
+			pawapay.ReconciliationStatusMismatch,
+			pawapay.ReconciliationAmountMismatch,
+			pawapay.ReconciliationMissingAtPawapay,
+			pawapay.ReconciliationAmountMismatch,
+			pawapay.ReconciliationUnknownLocally,
+		}, classes)
+		assert.Equal(t, 2, report.Summary[pawapay.ReconciliationAmountMismatch])
+	})
+
+	t.Run("Report is machine readable", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NoError(t, report.WriteJSON(&buf))
+
+		var decoded pawapay.ReconciliationReport
+		assert.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+		assert.Len(t, decoded.Entries, 6)
+	})
+}
+
+func TestSweeper(t *testing.T) {
+	const (
+		stuckId    = "3b2c6f0e-1f4a-4d7e-9a3c-5e8d7f6a1b01"
+		recentId   = "3b2c6f0e-1f4a-4d7e-9a3c-5e8d7f6a1b02"
+		depositId  = "3b2c6f0e-1f4a-4d7e-9a3c-5e8d7f6a1b03"
+		notifiedId = "3b2c6f0e-1f4a-4d7e-9a3c-5e8d7f6a1b04"
+		refundId   = "3b2c6f0e-1f4a-4d7e-9a3c-5e8d7f6a1b05"
+		oldId      = "3b2c6f0e-1f4a-4d7e-9a3c-5e8d7f6a1b06"
+	)
+
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests = append(requests, req.Method+" "+req.RequestURI)
+		mu.Unlock()
+
+		id := req.RequestURI[strings.LastIndex(req.RequestURI, "/")+1:]
+		w.WriteHeader(http.StatusOK)
+		switch {
+		case req.Method == http.MethodGet:
+			w.Write([]byte(`[{"payoutId":"` + id + `","status":"ENQUEUED","correspondent":"MTN_MOMO_GHA"}]`))
+		case strings.Contains(req.RequestURI, "fail-enqueued"):
+			w.Write([]byte(`{"payoutId":"` + id + `","status":"ACCEPTED"}`))
+		default:
+			w.Write([]byte(`{"status":"ACCEPTED"}`))
+		}
+	}))
+	defer pawapayService.Close()
+
+	store := pawapay.NewMemoryTransactionStore()
+	now := time.Now()
+	for _, e := range []pawapay.TransactionEvent{
+		{ID: stuckId, Type: pawapay.PayoutTransaction, Correspondent: "MTN_MOMO_GHA", Status: "ENQUEUED", At: now.Add(-2 * time.Hour)},
+		{ID: recentId, Type: pawapay.PayoutTransaction, Correspondent: "MTN_MOMO_GHA", Status: "ENQUEUED", At: now.Add(-10 * time.Minute)},
+		{ID: depositId, Type: pawapay.DepositTransaction, Status: "COMPLETED", Source: pawapay.SourceGet, At: now.Add(-time.Hour)},
+		{ID: notifiedId, Type: pawapay.PayoutTransaction, Status: "COMPLETED", Source: pawapay.SourceCallback, At: now.Add(-time.Hour)},
+		{ID: refundId, Type: pawapay.RefundTransaction, Status: "COMPLETED", Source: pawapay.SourceGet, At: now.Add(-50 * time.Minute)},
+		{ID: oldId, Type: pawapay.DepositTransaction, Status: "COMPLETED", Source: pawapay.SourceGet, At: now.Add(-72 * time.Hour)},
+	} {
+		assert.NoError(t, store.RecordEvent(e))
+	}
+
+	var stuck []pawapay.StuckPayout
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, TransactionStore: store})
+	sweeper := pawapay.NewSweeper(&c, pawapay.SweeperConfig{
+		EnqueuedAge:              3 * time.Hour,
+		CorrespondentEnqueuedAge: map[string]time.Duration{"MTN_MOMO_GHA": time.Hour},
+		OnStuckPayout:            func(p pawapay.StuckPayout) { stuck = append(stuck, p) },
+	})
+
+	report, err := sweeper.Sweep(context.Background())
+
+	t.Run("No error is returned", func(t *testing.T) {
+		assert.NoError(t, err)
+		assert.Empty(t, report.Errors)
+		assert.Equal(t, 2, report.Checked)
+	})
+
+	t.Run("Payouts enqueued past the correspondent threshold are failed", func(t *testing.T) {
+		assert.Len(t, report.FailedEnqueued, 1)
+		assert.Len(t, stuck, 1)
+		assert.Equal(t, stuckId, stuck[0].Payout.PayoutID)
+		assert.Contains(t, requests, "POST /payouts/fail-enqueued/"+stuckId)
+		assert.NotContains(t, requests, "POST /payouts/fail-enqueued/"+recentId)
+	})
+
+	t.Run("Missing callbacks are resent once", func(t *testing.T) {
+		assert.Equal(t, []pawapay.TransactionRef{{ID: depositId, Type: pawapay.DepositTransaction},
+			{ID: refundId, Type: pawapay.RefundTransaction}}, report.ResentCallbacks)
+		assert.Contains(t, requests, "POST /refunds/resend-callback")
+
+		report, err := sweeper.Sweep(context.Background())
+		assert.NoError(t, err)
+		assert.Empty(t, report.ResentCallbacks)
+	})
+
+	t.Run("Callbacks missing for longer than the window are left alone", func(t *testing.T) {
+		assert.NotContains(t, report.ResentCallbacks, pawapay.TransactionRef{ID: oldId, Type: pawapay.DepositTransaction})
+	})
+
+	t.Run("A sweep stops when its context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := sweeper.Sweep(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("Run keeps sweeping after a sweep fails", func(t *testing.T) {
+		var sweeps int
+		failing := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL,
+			TransactionStore: failingTransactionStore{find: func() { sweeps++ }}})
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err := pawapay.NewSweeper(&failing, pawapay.SweeperConfig{Interval: 10 * time.Millisecond}).Run(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Greater(t, sweeps, 1)
+	})
+}
+
+func TestPayoutResultsOfFailedRows(t *testing.T) {
+	const (
+		sentId    = "5d8e2a10-7c3b-4b6e-8f1a-2c9d0e3f4a01"
+		notSentId = "5d8e2a10-7c3b-4b6e-8f1a-2c9d0e3f4a02"
+	)
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if strings.HasSuffix(req.RequestURI, sentId) {
+			w.Write([]byte(`[{"payoutId":"` + sentId + `","status":"COMPLETED","created":"2023-02-24T10:00:00Z"}]`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+	chunkErr := fmt.Errorf("connection reset")
+	results := c.PayoutResults(pawapay.CreateBulkPayoutResponse{Items: []pawapay.BulkPayoutItem{
+		{Index: 0, Request: pawapay.PayoutRequest{PayoutId: sentId}, Outcome: pawapay.BulkItemFailed, Err: chunkErr},
+		{Index: 1, Request: pawapay.PayoutRequest{PayoutId: notSentId}, Outcome: pawapay.BulkItemFailed, Err: chunkErr},
+	}}, pawapay.PollOptions{})
+
+	t.Run("Failed rows pawapay knows get their status", func(t *testing.T) {
+		assert.Equal(t, "COMPLETED", results[0].Status)
+		assert.NoError(t, results[0].Err)
+	})
+
+	t.Run("Failed rows pawapay does not know keep the error of the bulk call", func(t *testing.T) {
+		assert.Empty(t, results[1].Status)
+		assert.Equal(t, chunkErr, results[1].Err)
+	})
+}
+
+type failingTransactionStore struct {
+	pawapay.TransactionStore
+	find func()
+}
+
+func (f failingTransactionStore) FindTransactions(pawapay.TransactionQuery) ([]pawapay.TransactionRecord, error) {
+	f.find()
+	return nil, fmt.Errorf("store unavailable")
+}
+
+func TestPayoutCSVReferencesAndMetadata(t *testing.T) {
+	namespace := uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	c := pawapay.NewService(pawapay.Config{IDGenerator: pawapay.NameBasedIDGenerator{Namespace: namespace}})
+
+	input := "reference,msisdn,amount,currency,correspondent,Metadata.orderId\n" +
+		"order-1,233704584739,100,GHS,MTN_MOMO_GHA,o-1\n" +
+		"order-2,233704584740,50,GHS,MTN_MOMO_GHA,\n"
+	payouts, err := pawapay.PayoutCSVReader{NewID: c.NewID}.Read(strings.NewReader(input))
+
+	t.Run("Ids are generated from the reference column", func(t *testing.T) {
+		assert.NoError(t, err)
+		if assert.Len(t, payouts, 2) {
+			assert.Equal(t, c.NewID("order-1"), payouts[0].PayoutId)
+			assert.Equal(t, c.NewID("order-2"), payouts[1].PayoutId)
+		}
+	})
+
+	t.Run("Metadata columns are read, empty values are left out", func(t *testing.T) {
+		if assert.Len(t, payouts, 2) {
+			assert.Equal(t, []pawapay.MetadataField{{FieldName: "orderId", FieldValue: "o-1"}}, payouts[0].Metadata)
+			assert.Empty(t, payouts[1].Metadata)
+		}
+	})
+}
+
+func TestPayoutCSV(t *testing.T) {
+	const (
+		completedId = "5d8e2a10-7c3b-4b6e-8f1a-2c9d0e3f4a01"
+		failedId    = "5d8e2a10-7c3b-4b6e-8f1a-2c9d0e3f4a02"
+	)
+	input := "\xef\xbb\xbfReference;Phone;Value;Ccy;Network;Note\r\n" +
+		completedId + ";+233 704 584 739;100;ghs;MTN_MOMO_GHA;salary\r\n" +
+		failedId + ";233704584740;50.5;GHS;MTN_MOMO_GHA;salary\r\n" +
+		"not-a-uuid;233704584741;10;GHS;MTN_MOMO_GHA;salary\r\n" +
+		strings.ToUpper(completedId) + ";233704584742;10;GHS;MTN_MOMO_GHA;salary\r\n" +
+		"5d8e2a10-7c3b-4b6e-8f1a-2c9d0e3f4a05;0000;10;GHS;MTN_MOMO_GHA;salary\r\n"
+
+	columns := pawapay.PayoutCSVColumns{ID: "reference", MSISDN: "phone", Amount: "value", Currency: "ccy",
+		Correspondent: "network", Description: "note"}
+	payouts, err := pawapay.PayoutCSVReader{Columns: columns}.Read(strings.NewReader(input))
+
+	t.Run("Invalid rows are reported with their line numbers", func(t *testing.T) {
+		var csvErr *pawapay.CSVError
+		if assert.ErrorAs(t, err, &csvErr) {
+			lines := []int{}
+			for _, row := range csvErr.Rows {
+				lines = append(lines, row.Line)
+			}
+			assert.Equal(t, []int{4, 5, 6}, lines)
+			assert.Contains(t, csvErr.Rows[1].Err.Error(), "repeated")
+			assert.Equal(t, "phone", csvErr.Rows[2].Column)
+		}
+	})
+
+	t.Run("Valid rows are mapped to payouts", func(t *testing.T) {
+		assert.Len(t, payouts, 2)
+		assert.Equal(t, pawapay.PhoneNumber{CountryCode: "233", Number: "704584739"}, payouts[0].PhoneNumber)
+		assert.Equal(t, pawapay.Amount{Value: "100", Currency: "GHS"}, payouts[0].Amount)
+	})
+
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodPost {
+			var body []pawapay.CreatePayoutRequest
+			json.NewDecoder(req.Body).Decode(&body)
+			var resp []pawapay.CreatePayoutResponse
+			for _, payout := range body {
+				resp = append(resp, pawapay.CreatePayoutResponse{PayoutID: payout.PayoutId, Status: "ACCEPTED"})
+			}
+			bb, _ := json.Marshal(resp)
+			w.Write(bb)
+			return
+		}
+		if strings.HasSuffix(req.RequestURI, failedId) {
+			w.Write([]byte(`[{"payoutId":"` + failedId + `","status":"FAILED","created":"2023-02-24T10:00:00Z",` +
+				`"failureReason":{"failureCode":"RECIPIENT_NOT_FOUND"}}]`))
+			return
+		}
+		w.Write([]byte(`[{"payoutId":"` + completedId + `","status":"COMPLETED","created":"2023-02-24T10:00:00Z"}]`))
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+	response, err := c.CreateBulkPayout(timeProvider(), payouts)
+	assert.NoError(t, err)
+
+	results := c.PayoutResults(response, pawapay.PollOptions{})
+	var buf bytes.Buffer
+	assert.NoError(t, pawapay.PayoutCSVWriter{Columns: columns}.Write(&buf, results))
+
+	t.Run("Results are written with the final status of every row", func(t *testing.T) {
+		assert.Equal(t, "reference,phone,value,ccy,network,note,outcome,status,failure_code,failure_message,created,error\n"+
+			completedId+",233704584739,100,GHS,MTN_MOMO_GHA,salary,ACCEPTED,COMPLETED,,,2023-02-24T10:00:00Z,\n"+
+			failedId+",233704584740,50.5,GHS,MTN_MOMO_GHA,salary,ACCEPTED,FAILED,RECIPIENT_NOT_FOUND,,2023-02-24T10:00:00Z,\n",
+			buf.String())
+	})
+}
+
+func TestPain001(t *testing.T) {
+	f, err := os.Open(filepath.Join("testdata", "pain001.xml"))
+	assert.NoError(t, err)
+	defer f.Close()
+
+	namespace := uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	batch, err := pawapay.ParsePain001(f, pawapay.Pain001Options{
+		IDGenerator:   pawapay.NameBasedIDGenerator{Namespace: namespace},
+		Correspondent: func(pawapay.PhoneNumber) string { return "MTN_MOMO_ZMB" },
+	})
+
+	t.Run("Unsupported transactions are reported", func(t *testing.T) {
+		var painErr *pawapay.Pain001Error
+		if assert.ErrorAs(t, err, &painErr) {
+			assert.Len(t, painErr.Issues, 2)
+			assert.Equal(t, "SALARY-FEB-003", painErr.Issues[0].EndToEndID)
+			assert.Contains(t, painErr.Issues[0].Reason, "IBAN")
+			assert.Equal(t, "CHEQUES", painErr.Issues[1].PaymentInfoID)
+		}
+	})
+
+	t.Run("Credit transfers are mapped to payouts", func(t *testing.T) {
+		assert.Equal(t, "PAYROLL-2023-02", batch.MessageID)
+		assert.Equal(t, []pawapay.PayoutRequest{
+			{
+				PayoutId:      "0b9e5d2c-6f3a-4c1d-8e7b-2a4f6c8d0e01",
+				Amount:        pawapay.Amount{Value: "1500.00", Currency: "GHS"},
+				Description:   "SALARY-FEB-001",
+				PhoneNumber:   pawapay.PhoneNumber{CountryCode: "233", Number: "704584739"},
+				Correspondent: "MTN_MOMO_GHA",
+			},
+			{
+				PayoutId:      pawapay.NameBasedIDGenerator{Namespace: namespace}.GenerateID("PAYROLL-2023-02/SALARIES/INSTR-2/NOTPROVIDED"),
+				Amount:        pawapay.Amount{Value: "250", Currency: "ZMW"},
+				Description:   "Bonus",
+				PhoneNumber:   pawapay.PhoneNumber{CountryCode: "260", Number: "763456789"},
+				Correspondent: "MTN_MOMO_ZMB",
+			},
+		}, batch.Payouts())
+	})
+
+	t.Run("Status report covers every transaction", func(t *testing.T) {
+		payouts := batch.Payouts()
+		response := pawapay.CreateBulkPayoutResponse{Items: []pawapay.BulkPayoutItem{
+			{Index: 0, Request: payouts[0], Outcome: pawapay.BulkItemAccepted},
+			{Index: 1, Request: payouts[1], Outcome: pawapay.BulkItemRejected, Response: pawapay.CreatePayoutResponse{
+				RejectionReason: pawapay.RejectionReason{RejectionCode: "INVALID_AMOUNT"}}},
+		}}
+		completed := pawapay.Payout{PayoutID: payouts[0].PayoutId, Status: "COMPLETED"}
+
+		var buf bytes.Buffer
+		assert.NoError(t, batch.WriteStatusReport(&buf, "REPORT-1", time.Date(2023, 2, 24, 12, 0, 0, 0, time.UTC),
+			response, completed))
+
+		report := buf.String()
+		assert.Contains(t, report, `<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pain.002.001.10">`)
+		assert.Contains(t, report, "<OrgnlMsgId>PAYROLL-2023-02</OrgnlMsgId>")
+		assert.Contains(t, report, "<OrgnlMsgNmId>pain.001.001.09</OrgnlMsgNmId>")
+		assert.Contains(t, report, "<GrpSts>PART</GrpSts>")
+		assert.Contains(t, report, "<OrgnlEndToEndId>SALARY-FEB-001</OrgnlEndToEndId>\n        <OrgnlUETR>0B9E5D2C-6F3A-4C1D-8E7B-2A4F6C8D0E01</OrgnlUETR>\n        <TxSts>ACSC</TxSts>")
+		assert.Contains(t, report, "<Prtry>INVALID_AMOUNT</Prtry>")
+		assert.Equal(t, 3, strings.Count(report, "<TxSts>RJCT</TxSts>"))
+	})
+}
+
+func TestPain001IDs(t *testing.T) {
+	document := func(msgID string, transactions ...string) string {
+		return `<Document xmlns="urn:iso:std:iso:20022:tech:xsd:pain.001.001.09"><CstmrCdtTrfInitn>` +
+			`<GrpHdr><MsgId>` + msgID + `</MsgId></GrpHdr><PmtInf><PmtInfId>BONUS</PmtInfId><PmtMtd>TRF</PmtMtd>` +
+			strings.Join(transactions, "") + `</PmtInf></CstmrCdtTrfInitn></Document>`
+	}
+	transaction := func(pmtID, amount string) string {
+		return `<CdtTrfTxInf><PmtId>` + pmtID + `</PmtId><Amt><InstdAmt Ccy="GHS">` + amount + `</InstdAmt></Amt>` +
+			`<CdtrAcct><Id><Othr><Id>233704584739</Id></Othr></Id></CdtrAcct></CdtTrfTxInf>`
+	}
+	opts := pawapay.Pain001Options{
+		IDGenerator:   pawapay.NameBasedIDGenerator{Namespace: uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")},
+		Correspondent: func(pawapay.PhoneNumber) string { return "MTN_MOMO_GHA" },
+	}
+
+	t.Run("Transactions without an EndToEndId get ids of their own", func(t *testing.T) {
+		batch, err := pawapay.ParsePain001(strings.NewReader(document("MSG-1",
+			transaction("<InstrId>1</InstrId><EndToEndId>NOTPROVIDED</EndToEndId>", "10"),
+			transaction("<InstrId>2</InstrId><EndToEndId>NOTPROVIDED</EndToEndId>", "10"))), opts)
+		assert.NoError(t, err)
+		payouts := batch.Payouts()
+		if assert.Len(t, payouts, 2) {
+			assert.NotEqual(t, payouts[0].PayoutId, payouts[1].PayoutId)
+		}
+	})
+
+	t.Run("The same EndToEndId in another message gets another id", func(t *testing.T) {
+		first, err := pawapay.ParsePain001(strings.NewReader(document("MSG-1",
+			transaction("<EndToEndId>SALARY-1</EndToEndId>", "10"))), opts)
+		assert.NoError(t, err)
+		second, err := pawapay.ParsePain001(strings.NewReader(document("MSG-2",
+			transaction("<EndToEndId>SALARY-1</EndToEndId>", "10"))), opts)
+		assert.NoError(t, err)
+		assert.NotEqual(t, first.Payouts()[0].PayoutId, second.Payouts()[0].PayoutId)
+	})
+
+	t.Run("Transactions that cannot be told apart are reported", func(t *testing.T) {
+		_, err := pawapay.ParsePain001(strings.NewReader(document("MSG-1",
+			transaction("<EndToEndId>NOTPROVIDED</EndToEndId>", "10"),
+			transaction("<EndToEndId>NOTPROVIDED</EndToEndId>", "10"))), opts)
+		var painErr *pawapay.Pain001Error
+		if assert.ErrorAs(t, err, &painErr) && assert.Len(t, painErr.Issues, 1) {
+			assert.Contains(t, painErr.Issues[0].Reason, "same ids")
+		}
+	})
+
+	t.Run("Amounts that are not positive are reported", func(t *testing.T) {
+		_, err := pawapay.ParsePain001(strings.NewReader(document("MSG-1",
+			transaction("<EndToEndId>A</EndToEndId>", "0"),
+			transaction("<EndToEndId>B</EndToEndId>", "-5"))), opts)
+		var painErr *pawapay.Pain001Error
+		if assert.ErrorAs(t, err, &painErr) && assert.Len(t, painErr.Issues, 2) {
+			assert.Contains(t, painErr.Issues[0].Reason, "not a positive amount")
+			assert.Contains(t, painErr.Issues[1].Reason, "not a positive amount")
+		}
+	})
+}
+
+func TestStatement(t *testing.T) {
+	entries := []pawapay.StatementEntry{
+		pawapay.DepositEntry(pawapay.Deposit{DepositId: "d1", Status: "COMPLETED", RequestedAmount: "100",
+			DepositedAmount: "100", Currency: "GHS", Country: "GHA", Correspondent: "MTN_MOMO_GHA",
+			CorrespondentIds: map[string]interface{}{"MTN_INIT": "ABC123", "MTN_FINAL": "DEF456"},
+			Created:          "2023-02-10T10:00:00Z"}),
+		pawapay.PayoutEntry(pawapay.Payout{PayoutID: "p1", Status: "COMPLETED", Amount: "30.5", Currency: "GHS",
+			Country: "GHA", Correspondent: "MTN_MOMO_GHA", Created: "2023-02-11T10:00:00Z"}),
+		pawapay.PayoutEntry(pawapay.Payout{PayoutID: "p2", Status: "FAILED", Amount: "10", Currency: "GHS",
+			Country: "GHA", Created: "2023-02-11T11:00:00Z"}),
+		pawapay.RefundEntry(pawapay.Refund{RefundId: "r1", Status: "COMPLETED", Amount: "5", Currency: "ZMW",
+			Country: "ZMB", Created: "2023-02-12T10:00:00Z"}),
+		pawapay.PayoutEntry(pawapay.Payout{PayoutID: "p3", Status: "COMPLETED", Amount: "10", Currency: "GHS",
+			Country: "GHA", Created: "2023-03-01T00:00:00Z"}),
+	}
+	from := time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	statement, err := pawapay.NewStatement(from, to, map[pawapay.Wallet]string{{Country: "GHA", Currency: "GHS"}: "1000"}, entries)
+	assert.NoError(t, err)
+
+	t.Run("Amounts that are not decimal numbers are an error", func(t *testing.T) {
+		invalid := append([]pawapay.StatementEntry{}, entries...)
+		invalid[1].Amount = "30,5"
+		_, err := pawapay.NewStatement(from, to, nil, invalid)
+		assert.ErrorContains(t, err, "p1")
+
+		_, err = pawapay.NewStatement(from, to, map[pawapay.Wallet]string{{Country: "GHA", Currency: "GHS"}: "n/a"}, entries)
+		assert.ErrorContains(t, err, "opening balance")
+	})
+
+	t.Run("Completed entries of the period are grouped by wallet", func(t *testing.T) {
+		if assert.Len(t, statement.Accounts, 2) {
+			ghs := statement.Accounts[0]
+			assert.Equal(t, pawapay.Wallet{Country: "GHA", Currency: "GHS"}, ghs.Wallet)
+			assert.Len(t, ghs.Entries, 2)
+			assert.Equal(t, "1000.00", ghs.OpeningBalance)
+			assert.Equal(t, "1069.50", ghs.ClosingBalance)
+			assert.Equal(t, "-5.00", statement.Accounts[1].ClosingBalance)
+		}
+	})
+
+	t.Run("Statement is written as csv", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NoError(t, statement.WriteCSV(&buf))
+		assert.Contains(t, buf.String(), "entry,GHA,GHS,deposit,d1,CRDT,100,2023-02-10T10:00:00Z,MTN_MOMO_GHA,MTN_FINAL=DEF456;MTN_INIT=ABC123\n")
+		assert.Contains(t, buf.String(), "closing,GHA,GHS,,,,1069.50,2023-03-01T00:00:00Z,,\n")
+	})
+
+	t.Run("Statement is written as camt.053", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NoError(t, statement.WriteCamt053(&buf, "STMT-2023-02", to))
+		report := buf.String()
+		assert.Contains(t, report, `<Document xmlns="urn:iso:std:iso:20022:tech:xsd:camt.053.001.08">`)
+		assert.Contains(t, report, "<Id>GHA-GHS</Id>")
+		assert.Contains(t, report, "<Tp>MTN_INIT</Tp>\n                <Ref>ABC123</Ref>")
+		assert.Contains(t, report, "<Cd>CLBD</Cd>")
+		assert.Contains(t, report, `<Amt Ccy="ZMW">5.00</Amt>`+"\n        <CdtDbtInd>DBIT</CdtDbtInd>")
+	})
+}
+
+func TestStatementEntries(t *testing.T) {
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		if strings.HasSuffix(req.URL.Path, "/missing") {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`[{"payoutId":"found","status":"COMPLETED","amount":"10","currency":"GHS","country":"GHA"}]`))
+	}))
+	defer pawapayService.Close()
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+	entries, err := c.StatementEntries([]pawapay.TransactionRef{
+		{ID: "missing", Type: pawapay.PayoutTransaction},
+		{ID: "found", Type: pawapay.PayoutTransaction},
+	})
+
+	t.Run("Transactions pawapay does not know are reported and skipped", func(t *testing.T) {
+		assert.ErrorIs(t, err, pawapay.ErrTransactionNotFound)
+		var missingErr *pawapay.MissingTransactionsError
+		if assert.ErrorAs(t, err, &missingErr) {
+			assert.Equal(t, []pawapay.TransactionRef{{ID: "missing", Type: pawapay.PayoutTransaction}}, missingErr.Refs)
+		}
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, "found", entries[0].ID)
+		}
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		keys []string
+	)
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		keys = append(keys, req.Header.Get("Authorization"))
+		mu.Unlock()
+
+		var body pawapay.CreatePayoutRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"payoutId":"` + body.PayoutId + `","status":"ACCEPTED"}`))
+	}))
+	defer pawapayService.Close()
+
+	metrics := &recordingMetrics{}
+	zambiaStore := pawapay.NewMemoryTransactionStore()
+	registry, err := pawapay.NewRegistry(pawapay.RegistryConfig{Metrics: metrics},
+		pawapay.Tenant{Key: "ghana", Config: pawapay.Config{BaseURL: pawapayService.URL, APIKey: "ghana-key"},
+			Currencies: []string{"GHS"}},
+		pawapay.Tenant{Key: "zambia", Config: pawapay.Config{BaseURL: pawapayService.URL, APIKey: "zambia-key",
+			TransactionStore: zambiaStore}, Countries: []string{"ZMB"}},
+	)
+	assert.NoError(t, err)
+
+	t.Run("Tenant keys must be unique", func(t *testing.T) {
+		_, err := pawapay.NewRegistry(pawapay.RegistryConfig{}, pawapay.Tenant{Key: "a"}, pawapay.Tenant{Key: "a"})
+		assert.Error(t, err)
+	})
+
+	zambianPayout := pawapay.PayoutRequest{
+		PayoutId:      "7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01",
+		Amount:        pawapay.Amount{Currency: "ZMW", Value: "100"},
+		PhoneNumber:   pawapay.PhoneNumber{CountryCode: "260", Number: "763456789"},
+		Correspondent: "MTN_MOMO_ZMB",
+	}
+
+	t.Run("Calls are routed by country and currency", func(t *testing.T) {
+		service, err := registry.ForPayout(zambianPayout)
+		assert.NoError(t, err)
+		_, err = service.CreatePayout(timeProvider(), zambianPayout)
+		assert.NoError(t, err)
+
+		assert.Equal(t, []string{"Bearer zambia-key"}, keys)
+		if assert.Len(t, metrics.requests, 1) {
+			assert.Equal(t, "zambia", metrics.requests[0].Tenant)
+		}
+
+		_, err = registry.Resolve(pawapay.TenantHint{Country: "CMR", Currency: "XAF"})
+		assert.ErrorIs(t, err, pawapay.ErrUnknownTenant)
+	})
+
+	t.Run("Callbacks are attributed to their tenant", func(t *testing.T) {
+		var tenants []string
+		handler := registry.CallbackHandler(pawapay.PayoutCallback, func(tenant string, cb pawapay.Callback) error {
+			tenants = append(tenants, tenant)
+			return nil
+		})
+
+		for _, target := range []string{"/callbacks/payouts", "/callbacks/payouts?tenant=ghana"} {
+			rec := httptest.NewRecorder()
+			body := `{"payoutId":"` + zambianPayout.PayoutId + `","status":"COMPLETED"}`
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+			assert.Equal(t, http.StatusOK, rec.Code)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/callbacks/payouts",
+			strings.NewReader(`{"payoutId":"7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a02","status":"COMPLETED"}`)))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/callbacks/payouts?tenant=ghana",
+			strings.NewReader(`{"payoutId":"7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a02","status":"COMPLETED"}`)))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		assert.Equal(t, []string{"zambia", "zambia"}, tenants)
+		record, err := zambiaStore.GetTransaction(zambianPayout.PayoutId)
+		assert.NoError(t, err)
+		assert.Equal(t, "COMPLETED", record.Status)
+	})
+
+	t.Run("Callback hints are only used when trusted", func(t *testing.T) {
+		trusting, err := pawapay.NewRegistry(pawapay.RegistryConfig{TrustCallbackHints: true},
+			pawapay.Tenant{Key: "ghana", Config: pawapay.Config{BaseURL: pawapayService.URL}},
+			pawapay.Tenant{Key: "zambia", Config: pawapay.Config{BaseURL: pawapayService.URL, TransactionStore: zambiaStore}},
+		)
+		assert.NoError(t, err)
+
+		var tenants []string
+		handler := trusting.CallbackHandler(pawapay.PayoutCallback, func(tenant string, cb pawapay.Callback) error {
+			tenants = append(tenants, tenant)
+			return nil
+		})
+		for _, body := range []string{
+			`{"payoutId":"` + zambianPayout.PayoutId + `","status":"COMPLETED"}`,
+			`{"payoutId":"7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a02","status":"COMPLETED"}`,
+		} {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/callbacks/payouts?tenant=ghana",
+				strings.NewReader(body)))
+			assert.Equal(t, http.StatusOK, rec.Code)
+		}
+		assert.Equal(t, []string{"zambia", "ghana"}, tenants)
+	})
+}
+
+func TestCredentials(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		valid    = map[string]bool{}
+		received []string
+	)
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		received = append(received, key)
+		if !valid[key] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`[]`))
+	}))
+	defer pawapayService.Close()
+
+	accept := func(keys ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		valid, received = map[string]bool{}, nil
+		for _, key := range keys {
+			valid[key] = true
+		}
+	}
+	sent := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}
+
+	t.Run("Overlapping keys stick to the one accepted", func(t *testing.T) {
+		accept("old")
+		service := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL,
+			Credentials: pawapay.StaticCredentials{"new", "old"}})
+
+		_, err := service.GetPayout("7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01")
+		assert.NoError(t, err)
+		_, err = service.GetPayout("7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"new", "old", "old"}, sent())
+	})
+
+	t.Run("A rejected key is retried once with a freshly read file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "pawapay.key")
+		assert.NoError(t, os.WriteFile(path, []byte("k1\n"), 0o600))
+		credentials, err := pawapay.NewFileCredentials(path)
+		assert.NoError(t, err)
+		service := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, Credentials: credentials})
+
+		accept("k1")
+		_, err = service.GetPayout("7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01")
+		assert.NoError(t, err)
+
+		// same size and possibly the same modification time, only the refresh after the 401 picks the new key up
+		assert.NoError(t, os.WriteFile(path, []byte("k2\n"), 0o600))
+		accept("k2")
+		_, err = service.GetPayout("7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01")
+		assert.NoError(t, err)
+		assert.Equal(t, "k2", sent()[len(sent())-1])
+	})
+
+	t.Run("A key with no alternative fails after a single request", func(t *testing.T) {
+		accept("other")
+		t.Setenv("PAWAPAY_TEST_KEY", "revoked")
+		service := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL,
+			Credentials: pawapay.EnvCredentials{"PAWAPAY_TEST_KEY"}})
+
+		_, err := service.GetPayout("7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01")
+		var statusErr *pawapay.StatusError
+		assert.ErrorAs(t, err, &statusErr)
+		assert.Equal(t, http.StatusUnauthorized, statusErr.StatusCode)
+		assert.Equal(t, []string{"revoked"}, sent())
+	})
+}
+
+func TestConfig(t *testing.T) {
+	token := func(claims string) string {
+		return "eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJl"
+	}
+
+	t.Run("Environments have their base url", func(t *testing.T) {
+		assert.Equal(t, "https://api.sandbox.pawapay.cloud", pawapay.Sandbox.BaseURL())
+		assert.Equal(t, "https://api.pawapay.cloud", pawapay.Environment("Production").BaseURL())
+	})
+
+	t.Run("A config without url or key is invalid", func(t *testing.T) {
+		_, err := pawapay.Config{}.Validate()
+		var configErr *pawapay.ConfigError
+		assert.ErrorAs(t, err, &configErr)
+		assert.Len(t, configErr.Problems, 2)
+
+		_, err = pawapay.Config{BaseURL: "api.pawapay.cloud", APIKey: token(`{}`)}.Validate()
+		assert.Error(t, err)
+	})
+
+	t.Run("A production key used against the sandbox is warned about", func(t *testing.T) {
+		warnings, err := pawapay.Config{Environment: pawapay.Sandbox, APIKey: token(`{"env":"production"}`)}.Validate()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"api key 1 was issued for production but is used against sandbox"}, warnings)
+
+		warnings, err = pawapay.Config{Environment: pawapay.Production, APIKey: token(`{"env":"production"}`)}.Validate()
+		assert.NoError(t, err)
+		assert.Empty(t, warnings)
+	})
+
+	t.Run("Config files are overridden by the environment", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "pawapay.yaml")
+		assert.NoError(t, os.WriteFile(path, []byte("environment: production\napiKey: file-key\ntimeout: 30s\n"+
+			"rateLimit:\n  requestsPerSecond: 10\nbulk:\n  chunkSize: 50\n"), 0o600))
+		t.Setenv("PAWAPAY_API_KEY", "env-key")
+		t.Setenv("PAWAPAY_BULK_CHUNK_SIZE", "25")
+
+		c, err := pawapay.LoadConfig(path)
+		assert.NoError(t, err)
+		assert.Equal(t, pawapay.Production, c.Environment)
+		assert.Equal(t, "env-key", c.APIKey)
+		assert.Equal(t, 25, c.Bulk.ChunkSize)
+		assert.Equal(t, 30*time.Second, c.HTTPClient.Timeout)
+		assert.Equal(t, 10.0, c.RateLimit.RequestsPerSecond)
+
+		jsonPath := filepath.Join(t.TempDir(), "pawapay.json")
+		assert.NoError(t, os.WriteFile(jsonPath, []byte(`{"apiToken":"key"}`), 0o600))
+		_, err = pawapay.LoadConfig(jsonPath)
+		assert.Error(t, err, "unknown fields are rejected")
+
+		t.Setenv("PAWAPAY_LOG_REQUEST", "maybe")
+		_, err = pawapay.LoadConfig(path)
+		assert.Error(t, err)
+	})
+}
+
+func TestAnnotationPolicy(t *testing.T) {
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body pawapay.CreatePayoutRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"payoutId":"` + body.PayoutId + `","status":"ACCEPTED"}`))
+	}))
+	defer pawapayService.Close()
+
+	payout := pawapay.PayoutRequest{
+		PayoutId:      "7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01",
+		Amount:        pawapay.Amount{Currency: "GHS", Value: "100"},
+		PhoneNumber:   pawapay.PhoneNumber{CountryCode: "233", Number: "704584739"},
+		Correspondent: "MTN_MOMO_GHA",
+	}
+
+	t.Run("The url and response are captured by default", func(t *testing.T) {
+		// the process env no longer changes what is captured
+		t.Setenv("env", "testing")
+		service := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL})
+		response, err := service.CreatePayout(time.Now, payout)
+		assert.NoError(t, err)
+		assert.Equal(t, pawapayService.URL+"/payouts", response.Annotation.URL)
+		assert.Empty(t, response.Annotation.RequestPayload)
+		assert.Contains(t, response.Annotation.ResponsePayload, "ACCEPTED")
+	})
+
+	t.Run("The policy picks and redacts what is captured", func(t *testing.T) {
+		service := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, Annotations: pawapay.AnnotationPolicy{
+			OmitURL: true, RequestPayload: true, OmitResponsePayload: true, Redact: pawapay.RedactPhoneNumbers}})
+		response, err := service.CreatePayout(time.Now, payout)
+		assert.NoError(t, err)
+		assert.Empty(t, response.Annotation.URL)
+		assert.Empty(t, response.Annotation.ResponsePayload)
+		assert.Contains(t, response.Annotation.RequestPayload, `"recipient":{"address":"REDACTED"`)
+		assert.NotContains(t, response.Annotation.RequestPayload, "704584739")
+	})
+}
+
+func TestAnnotationDetails(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+
+		w.Header().Set("X-Request-Id", fmt.Sprintf("req-%d", n))
+		if n == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`[]`))
+	}))
+	defer pawapayService.Close()
+
+	var audit bytes.Buffer
+	service := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, RateLimit: &pawapay.RateLimit{MaxRetries: 1},
+		AuditSink: pawapay.NewJSONAuditSink(&audit), Tenant: "ghana"})
+
+	payout, err := service.GetPayout("7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01")
+	assert.NoError(t, err)
+
+	annotation := payout.Annotation
+	assert.Equal(t, "payouts.get", annotation.Operation)
+	assert.Equal(t, http.MethodGet, annotation.Method)
+	assert.Equal(t, 2, annotation.Attempts)
+	assert.Equal(t, map[string]string{"X-Request-Id": "req-2"}, annotation.Headers)
+	assert.False(t, annotation.StartedAt.IsZero())
+	assert.Equal(t, annotation.EndedAt.Sub(annotation.StartedAt), annotation.Duration)
+
+	var record pawapay.AuditRecord
+	assert.NoError(t, json.Unmarshal(audit.Bytes(), &record))
+	assert.Equal(t, "ghana", record.Tenant)
+	assert.Equal(t, "req-2", record.Annotation.Headers["X-Request-Id"])
+	assert.Empty(t, record.Err)
+}
+
+func TestAuditLog(t *testing.T) {
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body pawapay.CreatePayoutRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`{"payoutId":"` + body.PayoutId + `","status":"ACCEPTED"}`))
+	}))
+	defer pawapayService.Close()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := pawapay.OpenAuditLog(path)
+	assert.NoError(t, err)
+
+	service := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, AuditSink: auditLog})
+	ops := service.WithContext(pawapay.WithCaller(context.Background(), "ops@example.com"))
+	for _, id := range []string{"7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01", "7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a02"} {
+		_, err := ops.CreatePayout(time.Now, pawapay.PayoutRequest{
+			PayoutId:      id,
+			Amount:        pawapay.Amount{Currency: "GHS", Value: "100"},
+			PhoneNumber:   pawapay.PhoneNumber{CountryCode: "233", Number: "704584739"},
+			Correspondent: "MTN_MOMO_GHA",
+		})
+		assert.NoError(t, err)
+	}
+	_, err = ops.GetPayout("7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01")
+	assert.NoError(t, err)
+	assert.NoError(t, auditLog.Close())
+
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+
+	t.Run("Only money moving calls are chained with their caller", func(t *testing.T) {
+		last, err := pawapay.VerifyAuditLog(bytes.NewReader(b))
+		assert.NoError(t, err)
+		assert.Len(t, lines, 4)
+		assert.Equal(t, uint64(4), last.Sequence)
+		assert.Equal(t, pawapay.AuditOutcome, last.Record.Phase)
+		assert.Equal(t, "ops@example.com", last.Record.Caller)
+		assert.Equal(t, "payouts.create", last.Record.Annotation.Operation)
+		assert.Contains(t, last.Record.Request, "7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a02")
+	})
+
+	t.Run("Altered entries are detected", func(t *testing.T) {
+		altered := strings.Replace(string(b), `\"amount\":\"100\"`, `\"amount\":\"900\"`, 1)
+		assert.NotEqual(t, string(b), altered)
+		_, err := pawapay.VerifyAuditLog(strings.NewReader(altered))
+		var logErr *pawapay.AuditLogError
+		assert.ErrorAs(t, err, &logErr)
+		assert.Equal(t, 1, logErr.Line)
+	})
+
+	t.Run("Intents are written before the request is sent", func(t *testing.T) {
+		var intent pawapay.AuditEntry
+		assert.NoError(t, json.Unmarshal([]byte(lines[2]), &intent))
+		assert.Equal(t, pawapay.AuditIntent, intent.Record.Phase)
+		assert.Equal(t, "payouts.create", intent.Record.Annotation.Operation)
+		assert.Zero(t, intent.Record.Annotation.ResponseCode)
+		assert.Contains(t, intent.Record.Request, "7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a02")
+	})
+
+	t.Run("Removed entries are detected", func(t *testing.T) {
+		_, err := pawapay.VerifyAuditLog(strings.NewReader(lines[1]))
+		var logErr *pawapay.AuditLogError
+		assert.ErrorAs(t, err, &logErr)
+		assert.Contains(t, logErr.Reason, "missing")
+	})
+
+	t.Run("A reopened log continues the chain", func(t *testing.T) {
+		auditLog, err := pawapay.OpenAuditLog(path)
+		assert.NoError(t, err)
+		assert.NoError(t, auditLog.Audit(context.Background(), pawapay.AuditRecord{
+			Resource:   "payouts/fail-enqueued/7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01",
+			Annotation: pawapay.APIAnnotation{Operation: "payouts.fail-enqueued"}}))
+		assert.NoError(t, auditLog.Close())
+
+		f, err := os.Open(path)
+		assert.NoError(t, err)
+		defer f.Close()
+		last, err := pawapay.VerifyAuditLog(f)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(5), last.Sequence)
+	})
+
+	t.Run("An interrupted write is cut off when the log is reopened", func(t *testing.T) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+		assert.NoError(t, err)
+		_, err = f.WriteString(`{"sequence":6,"at":"2023-02`)
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+
+		auditLog, err := pawapay.OpenAuditLog(path)
+		assert.NoError(t, err)
+		assert.NoError(t, auditLog.Audit(context.Background(), pawapay.AuditRecord{
+			Annotation: pawapay.APIAnnotation{Operation: "refunds.create"}}))
+		assert.NoError(t, auditLog.Close())
+
+		b, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		last, err := pawapay.VerifyAuditLog(bytes.NewReader(b))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(6), last.Sequence)
+	})
+
+	t.Run("A last entry that is not an entry is reported", func(t *testing.T) {
+		corrupted := filepath.Join(t.TempDir(), "audit.log")
+		assert.NoError(t, os.WriteFile(corrupted, append(b, []byte("garbage\n")...), 0o600))
+		_, err := pawapay.OpenAuditLog(corrupted)
+		var logErr *pawapay.AuditLogError
+		if assert.ErrorAs(t, err, &logErr) {
+			assert.Equal(t, 5, logErr.Line)
+		}
+	})
+}
+
+func TestAuditSink(t *testing.T) {
+	var sent int
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sent++
+		var body pawapay.CreatePayoutRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"payoutId":"` + body.PayoutId + `","status":"ACCEPTED"}`))
+	}))
+	defer pawapayService.Close()
+
+	payout := pawapay.PayoutRequest{
+		PayoutId:      "7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01",
+		Amount:        pawapay.Amount{Currency: "GHS", Value: "100"},
+		PhoneNumber:   pawapay.PhoneNumber{CountryCode: "233", Number: "704584739"},
+		Correspondent: "MTN_MOMO_GHA",
+	}
+	failing := pawapay.AuditSinkFunc(func(context.Context, pawapay.AuditRecord) error {
+		return fmt.Errorf("disk full")
+	})
+
+	t.Run("A required audit that fails stops the request", func(t *testing.T) {
+		service := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, AuditSink: failing, AuditRequired: true})
+		_, err := service.CreatePayout(time.Now, payout)
+		assert.True(t, pawapay.IsNotSent(err))
+		assert.Zero(t, sent)
+	})
+
+	t.Run("An optional audit that fails does not", func(t *testing.T) {
+		service := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, AuditSink: failing})
+		_, err := service.CreatePayout(time.Now, payout)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, sent)
+	})
+
+	t.Run("Sinks get a context that is not cancelled with the caller's values", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(pawapay.WithCaller(context.Background(), "ops@example.com"))
+		var (
+			errs    []error
+			callers []string
+		)
+		service := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL,
+			AuditSink: pawapay.AuditSinkFunc(func(ctx context.Context, record pawapay.AuditRecord) error {
+				cancel()
+				errs, callers = append(errs, ctx.Err()), append(callers, pawapay.CallerFromContext(ctx))
+				return nil
+			})})
+		service.WithContext(ctx).CreatePayout(time.Now, payout)
+		assert.Equal(t, []error{nil, nil}, errs)
+		assert.Equal(t, []string{"ops@example.com", "ops@example.com"}, callers)
+	})
+}
@@ -0,0 +1,156 @@
+package pawapay
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pariz/gountries"
+)
+
+// PaymentPageOutcome is the final state of a payment page session, resolved after the customer is redirected back
+type PaymentPageOutcome string
+
+const (
+	PaymentPageCompleted PaymentPageOutcome = "COMPLETED"
+	PaymentPageFailed    PaymentPageOutcome = "FAILED"
+	PaymentPagePending   PaymentPageOutcome = "PENDING"
+	// PaymentPageAbandoned means the customer left the payment page without a deposit being initiated
+	PaymentPageAbandoned PaymentPageOutcome = "ABANDONED"
+)
+
+// PaymentPageRequest holds the details of a hosted payment page session. Country, PhoneNumber and Language are
+// optional, the customer picks what is missing on the payment page
+type PaymentPageRequest struct {
+	DepositId   string
+	ReturnURL   string
+	Amount      Amount
+	Description string
+	Country     string
+	PhoneNumber PhoneNumber
+	Language    string
+	Reason      string
+	Metadata    []MetadataField
+}
+
+type CreatePaymentPageSessionRequest struct {
+	DepositId            string          `json:"depositId"`
+	ReturnURL            string          `json:"returnUrl"`
+	StatementDescription string          `json:"statementDescription,omitempty"`
+	Amount               string          `json:"amount,omitempty"`
+	Msisdn               string          `json:"msisdn,omitempty"`
+	Language             string          `json:"language,omitempty"`
+	Country              string          `json:"country,omitempty"`
+	Reason               string          `json:"reason,omitempty"`
+	Metadata             []MetadataField `json:"metadata,omitempty"`
+}
+
+type CreatePaymentPageSessionResponse struct {
+	RedirectURL string `json:"redirectUrl"`
+	Annotation  APIAnnotation
+}
+
+type PaymentPageResult struct {
+	Outcome PaymentPageOutcome
+	Deposit Deposit
+}
+
+func (s *Service) newPaymentPageSessionRequest(req PaymentPageRequest) CreatePaymentPageSessionRequest {
+	description := req.Description
+	if len(description) > 22 {
+		description = description[:22]
+	}
+
+	var msisdn string
+	if req.PhoneNumber.Number != "" {
+		msisdn = req.PhoneNumber.CountryCode + req.PhoneNumber.Number
+	}
+
+	return CreatePaymentPageSessionRequest{
+		DepositId:            req.DepositId,
+		ReturnURL:            req.ReturnURL,
+		StatementDescription: description,
+		Amount:               req.Amount.Value,
+		Msisdn:               msisdn,
+		Language:             strings.ToUpper(req.Language),
+		Country:              req.Country,
+		Reason:               req.Reason,
+		Metadata:             req.Metadata,
+	}
+}
+
+// CreatePaymentPageSession provides the functionality of creating a hosted payment page session. Redirect the
+// customer to the returned RedirectURL, they are sent back to ReturnURL once done
+// See docs https://docs.pawapay.co.uk/#operation/createWidgetSession for more details
+func (s *Service) CreatePaymentPageSession(req PaymentPageRequest) (CreatePaymentPageSessionResponse, error) {
+
+	if err := ValidateID("depositId", req.DepositId); err != nil {
+		return CreatePaymentPageSessionResponse{}, err
+	}
+	if err := ValidateMetadata(req.Metadata); err != nil {
+		return CreatePaymentPageSessionResponse{}, err
+	}
+
+	if err := checkPaymentPageCurrency(req); err != nil {
+		return CreatePaymentPageSessionResponse{}, err
+	}
+
+	resource := "v1/widget/sessions"
+	payload := s.newPaymentPageSessionRequest(req)
+
+	var response CreatePaymentPageSessionResponse
+	annotation, err := s.makeRequest(http.MethodPost, resource, payload, &response)
+	if err != nil {
+		return CreatePaymentPageSessionResponse{}, err
+	}
+	response.Annotation = annotation
+
+	return response, nil
+}
+
+// checkPaymentPageCurrency rejects a currency the payment page would not charge in. The session request has no
+// currency, pawapay uses that of the country so a currency set on the amount must be the country's
+func checkPaymentPageCurrency(req PaymentPageRequest) error {
+	if req.Amount.Currency == "" {
+		return nil
+	}
+
+	query := gountries.New()
+	country, err := query.FindCountryByAlpha(req.Country)
+	if req.Country == "" && req.PhoneNumber.CountryCode != "" {
+		country, err = query.FindCountryByCallingCode(req.PhoneNumber.CountryCode)
+	}
+	if req.Country == "" && req.PhoneNumber.CountryCode == "" || err != nil {
+		return fmt.Errorf("currency %s cannot be checked without a country, the payment page charges in the "+
+			"currency of the country the customer picks", req.Amount.Currency)
+	}
+	for _, currency := range country.Currencies {
+		if strings.EqualFold(currency, req.Amount.Currency) {
+			return nil
+		}
+	}
+	return fmt.Errorf("currency %s is not that of %s, the payment page charges in the currency of the country",
+		req.Amount.Currency, country.Alpha3)
+}
+
+// ResolvePaymentPageSession looks up the deposit behind a payment page session, call it once the customer lands
+// on the return url. A session the customer abandoned has no deposit
+func (s *Service) ResolvePaymentPageSession(depositId string) (PaymentPageResult, error) {
+	deposit, err := s.GetDeposit(depositId)
+	if err != nil {
+		return PaymentPageResult{Deposit: deposit}, err
+	}
+
+	result := PaymentPageResult{Deposit: deposit}
+	switch {
+	case deposit.IsNotFound():
+		result.Outcome = PaymentPageAbandoned
+	case deposit.IsSuccessful():
+		result.Outcome = PaymentPageCompleted
+	case deposit.IsFailed():
+		result.Outcome = PaymentPageFailed
+	default:
+		result.Outcome = PaymentPagePending
+	}
+	return result, nil
+}
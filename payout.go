@@ -1,36 +1,83 @@
 package pawapay
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
-
-	"github.com/pariz/gountries"
 )
 
 // Config represents the pawapay config
 type Config struct {
+	// Environment picks the base url of a pawapay environment when BaseURL is not set
+	Environment Environment
 	BaseURL     string
 	APIKey      string
 	LogRequest  bool
 	LogResponse bool
+
+	// Metrics, when set, is notified of every request made and callback handled by the service
+	Metrics Metrics
+
+	// RateLimit, when set, throttles requests on the client before pawapay starts rejecting them
+	RateLimit *RateLimit
+
+	// CircuitBreaker, when set, fails payouts and deposits fast while their correspondent is degraded
+	CircuitBreaker *CircuitBreaker
+
+	// IDGenerator is used by NewID, random UUIDv4s are generated when it is not set
+	IDGenerator IDGenerator
+
+	// Bulk configures how bulk calls are split into chunks
+	Bulk BulkOptions
+
+	// TransactionStore, when set, records the status history of every transaction seen on a create, a get or a
+	// callback
+	TransactionStore TransactionStore
+
+	// HTTPClient, when set, is used instead of a client of the service's own so that its connections can be shared
+	HTTPClient *http.Client
+
+	// Tenant names the merchant account the config belongs to, it labels the metrics of the service
+	Tenant string
+
+	// Credentials, when set, supplies the api keys of the service on every request instead of APIKey
+	Credentials CredentialProvider
+
+	// Annotations picks what the APIAnnotation of every response captures
+	Annotations AnnotationPolicy
+
+	// AuditSink, when set, receives the annotation of every request sent to pawapay, and an intent record before
+	// every request that is not a GET is sent
+	AuditSink AuditSink
+	// AuditRequired fails a request that is not a GET with a NotSentError, without sending it, when its intent cannot
+	// be written to AuditSink. Otherwise audit failures are only logged
+	AuditRequired bool
 }
 
 // Service is a representation of a pawapay service
 type Service struct {
-	config Config
-	client *http.Client
+	config      Config
+	client      *http.Client
+	credentials *credentials
+	metrics     Metrics
+	limiter     *rateLimiter
+	breaker     *CircuitBreaker
+	ctx         context.Context
 }
 
 // ConfigProvider pawapay config provider
 type ConfigProvider func() Config
 
-// GetConfigFromEnvVars returns config configurations from environment variables
+// GetConfigFromEnvVars returns config configurations from environment variables. See LoadConfig for reading every
+// option from the environment
 func GetConfigFromEnvVars() Config {
 	return Config{
-		BaseURL: os.Getenv("PAWAPAY_API_URL"),
-		APIKey:  os.Getenv("PAWAPAY_API_KEY"),
+		Environment: Environment(os.Getenv("PAWAPAY_ENVIRONMENT")),
+		BaseURL:     os.Getenv("PAWAPAY_API_URL"),
+		APIKey:      os.Getenv("PAWAPAY_API_KEY"),
 	}
 }
 
@@ -50,54 +97,154 @@ func (c *Config) AllowLogging() {
 
 // NewService returns a new pawapay service
 func NewService(c Config) Service {
+	c.BaseURL = c.baseURL()
+	client := c.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 60 * time.Second}
+	}
 	return Service{
-		config: c,
-		client: &http.Client{Timeout: 60 * time.Second},
+		config:      c,
+		client:      client,
+		credentials: newCredentials(c),
+		metrics:     c.Metrics,
+		limiter:     newRateLimiter(c.RateLimit),
+		breaker:     c.CircuitBreaker,
+	}
+}
+
+// WithContext returns a copy of the service whose requests, including time spent waiting on the rate limiter,
+// are bound to ctx
+func (s *Service) WithContext(ctx context.Context) *Service {
+	c := *s
+	c.ctx = ctx
+	return &c
+}
+
+func (s *Service) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
 	}
+	return s.ctx
 }
 
 // CreatePayout provides the functionality of creating a payout
 // See docs https://docs.pawapay.co.uk/#operation/createPayout for more details
 func (s *Service) CreatePayout(timeProvider TimeProviderFunc, payoutReq PayoutRequest) (CreatePayoutResponse, error) {
 
-	query := gountries.New()
-	se, err := query.FindCountryByCallingCode(payoutReq.PhoneNumber.CountryCode)
+	countryCode, err := payoutCountry(payoutReq)
 	if err != nil {
 		return CreatePayoutResponse{}, err
 	}
-	countryCode := se.Alpha3
 
 	resource := "payouts"
 	payload := s.newCreatePayoutRequest(timeProvider, payoutReq.PayoutId, payoutReq.Amount, countryCode,
-		payoutReq.Correspondent, payoutReq.Description, payoutReq.PhoneNumber)
+		payoutReq.Correspondent, payoutReq.Description, payoutReq.PhoneNumber, payoutReq.Metadata)
+
+	done, err := s.breaker.allow(payoutReq.Correspondent, PayoutOperation)
+	if err != nil {
+		return CreatePayoutResponse{}, err
+	}
 
 	var response CreatePayoutResponse
 	annotation, err := s.makeRequest(http.MethodPost, resource, payload, &response)
+	done(s.breaker.outcome(err, response.Status, response.RejectionReason))
 	if err != nil {
 		return CreatePayoutResponse{}, err
 	}
 	response.Annotation = annotation
 
+	if err := checkEchoedID("CreatePayout", payoutReq.PayoutId, response.PayoutID); err != nil {
+		return response, err
+	}
+
 	return response, nil
 }
 
-// CreateBulkPayout provides the functionality of creating a bulk payout
+// payoutCountry validates a payout and returns the alpha3 code of the country of its phone number
+func payoutCountry(payoutReq PayoutRequest) (string, error) {
+	if err := ValidateID("payoutId", payoutReq.PayoutId); err != nil {
+		return "", err
+	}
+	if err := ValidateMetadata(payoutReq.Metadata); err != nil {
+		return "", err
+	}
+
+	se, err := countryByCallingCode(payoutReq.PhoneNumber.CountryCode)
+	if err != nil {
+		return "", err
+	}
+	return se.Alpha3, nil
+}
+
+// CreateBulkPayout provides the functionality of creating a bulk payout. The payouts are sent in chunks the size
+// pawapay accepts and the outcome of every row is returned, a *BulkError is returned with it when a row was not
+// sent or has an unknown outcome, even though the other rows were sent
 // See docs https://docs.pawapay.co.uk/#operation/createPayout for more details
 func (s *Service) CreateBulkPayout(timeProvider TimeProviderFunc, data []PayoutRequest) (CreateBulkPayoutResponse, error) {
 
-	resource := "payouts/bulk"
-	payload, err := s.newCreateBulkPayoutRequest(timeProvider, data)
-	if err != nil {
+	ids := make([]string, 0, len(data))
+	for _, payout := range data {
+		ids = append(ids, payout.PayoutId)
+	}
+	if err := checkDuplicateIDs("payoutId", ids); err != nil {
 		return CreateBulkPayoutResponse{}, err
 	}
 
-	var response []CreatePayoutResponse
-	annotation, err := s.makeRequest(http.MethodPost, resource, payload, &response)
-	if err != nil {
-		return CreateBulkPayoutResponse{}, err
+	items := make([]BulkPayoutItem, len(data))
+	var (
+		payloads  []CreatePayoutRequest
+		positions []int
+	)
+	for i, payout := range data {
+		items[i] = BulkPayoutItem{Index: i, Request: payout}
+		payload, err := s.newBulkPayoutRequest(timeProvider, payout)
+		if err != nil {
+			items[i].Outcome, items[i].Err = BulkItemInvalid, err
+			continue
+		}
+		payloads = append(payloads, payload)
+		positions = append(positions, i)
+	}
+
+	resource := "payouts/bulk"
+	annotations := make([]APIAnnotation, chunkCount(len(payloads), s.config.Bulk.ChunkSize))
+	s.forEachChunk(len(payloads), func(chunk, start, end int) {
+		var response []CreatePayoutResponse
+		annotation, err := s.makeRequest(http.MethodPost, resource, payloads[start:end], &response)
+		annotations[chunk] = annotation
+
+		results := map[string]CreatePayoutResponse{}
+		for _, r := range response {
+			r.Annotation = annotation
+			results[strings.ToLower(r.PayoutID)] = r
+		}
+		for j := start; j < end; j++ {
+			item := &items[positions[j]]
+			result, ok := results[strings.ToLower(payloads[j].PayoutId)]
+			switch {
+			case err != nil:
+				item.Outcome, item.Err = BulkItemFailed, err
+			case !ok:
+				item.Outcome, item.Err = BulkItemFailed, fmt.Errorf("no result returned for payoutId %s", payloads[j].PayoutId)
+			default:
+				item.Outcome, item.Response = bulkOutcome(result.Status), result
+			}
+		}
+	})
+
+	response := CreateBulkPayoutResponse{Items: items, Annotations: annotations}
+	if len(annotations) > 0 {
+		response.Annotation = annotations[0]
+	}
+	outcomes := make([]BulkItemOutcome, 0, len(items))
+	for _, item := range items {
+		if item.Response.PayoutID != "" {
+			response.Result = append(response.Result, item.Response)
+		}
+		outcomes = append(outcomes, item.Outcome)
 	}
 
-	return CreateBulkPayoutResponse{Result: response, Annotation: annotation}, nil
+	return response, bulkError(outcomes)
 }
 
 // GetPayout provides the functionality of retrieving a payout
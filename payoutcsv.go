@@ -0,0 +1,363 @@
+package pawapay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pariz/gountries"
+	"github.com/pkg/errors"
+)
+
+// PayoutCSVColumns names the csv column holding each field of a payout. Names are matched case insensitively
+type PayoutCSVColumns struct {
+	ID            string
+	MSISDN        string
+	Amount        string
+	Currency      string
+	Correspondent string
+	Description   string
+	// Reference is the column PayoutCSVReader.NewID generates the id of a row from when its id is empty
+	Reference string
+}
+
+// metadataColumnPrefix starts the name of the columns read as metadata fields, eg metadata.orderId
+const metadataColumnPrefix = "metadata."
+
+// DefaultPayoutCSVColumns are the column names used for the fields left empty in PayoutCSVColumns
+var DefaultPayoutCSVColumns = PayoutCSVColumns{
+	ID:            "id",
+	MSISDN:        "msisdn",
+	Amount:        "amount",
+	Currency:      "currency",
+	Correspondent: "correspondent",
+	Description:   "description",
+	Reference:     "reference",
+}
+
+func (c PayoutCSVColumns) withDefaults() PayoutCSVColumns {
+	d := DefaultPayoutCSVColumns
+	for _, f := range []struct{ value, fallback *string }{
+		{&c.ID, &d.ID}, {&c.MSISDN, &d.MSISDN}, {&c.Amount, &d.Amount}, {&c.Currency, &d.Currency},
+		{&c.Correspondent, &d.Correspondent}, {&c.Description, &d.Description}, {&c.Reference, &d.Reference},
+	} {
+		if *f.value == "" {
+			*f.value = *f.fallback
+		}
+	}
+	return c
+}
+
+// CSVRowError is a row of a csv file that failed validation, Line counts the header as line 1
+type CSVRowError struct {
+	Line   int
+	Column string
+	Err    error
+}
+
+func (e CSVRowError) Error() string {
+	if e.Column == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: %s: %s", e.Line, e.Column, e.Err)
+}
+
+// CSVError is returned alongside the valid rows of a csv file when some of its rows failed validation
+type CSVError struct {
+	Rows []CSVRowError
+}
+
+func (e *CSVError) Error() string {
+	return fmt.Sprintf("pawapay: %d csv rows failed validation, first is %s", len(e.Rows), e.Rows[0])
+}
+
+// PayoutCSVReader maps the rows of a csv file, as exported by spreadsheets including Excel, to payout requests.
+// Columns named metadata.<name> are read as the metadata field <name>, empty values are left out
+type PayoutCSVReader struct {
+	// Columns overrides the default column names
+	Columns PayoutCSVColumns
+	// Comma is the field delimiter, it is detected from the header row as either ',' or ';' when not set
+	Comma rune
+	// NewID, when set, generates the id of the rows without one from their reference column, eg Service.NewID.
+	// The id column is then optional
+	NewID func(reference string) string
+}
+
+// Read returns the payouts of every valid row, ready for CreateBulkPayout. A *CSVError listing the invalid rows is
+// returned with them
+func (r PayoutCSVReader) Read(in io.Reader) ([]PayoutRequest, error) {
+	columns := r.Columns.withDefaults()
+
+	buffered := bufio.NewReader(in)
+	// Excel prefixes utf-8 csv files with a byte order mark
+	if bom, _ := buffered.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		buffered.Discard(3)
+	}
+	comma := r.Comma
+	if comma == 0 {
+		comma = ','
+		if line, _ := buffered.Peek(buffered.Size()); detectSemicolon(line) {
+			comma = ';'
+		}
+	}
+
+	reader := csv.NewReader(buffered)
+	reader.Comma = comma
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read csv header")
+	}
+	index := map[string]int{}
+	var metadataColumns []int
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		index[name] = i
+		if strings.HasPrefix(name, metadataColumnPrefix) {
+			metadataColumns = append(metadataColumns, i)
+		}
+	}
+	required := []string{columns.MSISDN, columns.Amount, columns.Currency, columns.Correspondent}
+	if r.NewID == nil {
+		required = append(required, columns.ID)
+	}
+	for _, required := range required {
+		if _, ok := index[strings.ToLower(required)]; !ok {
+			return nil, fmt.Errorf("csv header has no %s column", required)
+		}
+	}
+	value := func(row []string, name string) string {
+		i, ok := index[strings.ToLower(name)]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	var (
+		payouts   []PayoutRequest
+		csvErr    CSVError
+		firstSeen = map[string]int{}
+		query     = gountries.New()
+	)
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read csv line %d", line)
+		}
+		if isBlankRow(row) {
+			continue
+		}
+
+		payout := PayoutRequest{
+			PayoutId:      value(row, columns.ID),
+			Amount:        Amount{Value: value(row, columns.Amount), Currency: strings.ToUpper(value(row, columns.Currency))},
+			Description:   value(row, columns.Description),
+			Correspondent: value(row, columns.Correspondent),
+		}
+		if payout.PayoutId == "" && r.NewID != nil {
+			payout.PayoutId = r.NewID(value(row, columns.Reference))
+		}
+		for _, i := range metadataColumns {
+			if i < len(row) && strings.TrimSpace(row[i]) != "" {
+				name := strings.TrimSpace(header[i])[len(metadataColumnPrefix):]
+				payout.Metadata = append(payout.Metadata, MetadataField{FieldName: name, FieldValue: strings.TrimSpace(row[i])})
+			}
+		}
+		phone, phoneErr := parseMSISDN(query, value(row, columns.MSISDN))
+		payout.PhoneNumber = phone
+		idErr := ValidateID("payoutId", payout.PayoutId)
+		metadataErr := ValidateMetadata(payout.Metadata)
+
+		rowErr := func(column string, err error) { csvErr.Rows = append(csvErr.Rows, CSVRowError{line, column, err}) }
+		switch {
+		case idErr != nil:
+			rowErr(columns.ID, idErr)
+		case firstSeen[strings.ToLower(payout.PayoutId)] != 0:
+			rowErr(columns.ID, fmt.Errorf("%s is repeated, first seen on line %d", payout.PayoutId,
+				firstSeen[strings.ToLower(payout.PayoutId)]))
+		case phoneErr != nil:
+			rowErr(columns.MSISDN, phoneErr)
+		case !isPositiveAmount(payout.Amount.Value):
+			rowErr(columns.Amount, fmt.Errorf("%q is not a positive amount", payout.Amount.Value))
+		case len(payout.Amount.Currency) != 3:
+			rowErr(columns.Currency, fmt.Errorf("%q is not an ISO 4217 currency code", payout.Amount.Currency))
+		case payout.Correspondent == "":
+			rowErr(columns.Correspondent, errors.New("correspondent is required"))
+		case metadataErr != nil:
+			rowErr("", metadataErr)
+		default:
+			firstSeen[strings.ToLower(payout.PayoutId)] = line
+			payouts = append(payouts, payout)
+		}
+	}
+
+	if len(csvErr.Rows) > 0 {
+		return payouts, &csvErr
+	}
+	return payouts, nil
+}
+
+// detectSemicolon reports whether the first line of a csv file is delimited by semicolons, as Excel does in
+// locales using a decimal comma
+func detectSemicolon(b []byte) bool {
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		b = b[:i]
+	}
+	return bytes.Count(b, []byte(";")) > bytes.Count(b, []byte(","))
+}
+
+func isBlankRow(row []string) bool {
+	for _, field := range row {
+		if strings.TrimSpace(field) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func isPositiveAmount(amount string) bool {
+	r, ok := new(big.Rat).SetString(amount)
+	return ok && r.Sign() > 0
+}
+
+// parseMSISDN splits a phone number in international format, eg +233 704 584 739, into its calling code and number.
+// Calling codes are prefix free so the first one that matches is the right one
+func parseMSISDN(query *gountries.Query, msisdn string) (PhoneNumber, error) {
+	digits := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '+' || r == '(' || r == ')' {
+			return -1
+		}
+		return r
+	}, msisdn)
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return PhoneNumber{}, fmt.Errorf("%q is not a phone number", msisdn)
+		}
+	}
+
+	for n := 1; n <= 3 && n < len(digits); n++ {
+		if _, err := query.FindCountryByCallingCode(digits[:n]); err == nil {
+			return PhoneNumber{CountryCode: digits[:n], Number: digits[n:]}, nil
+		}
+	}
+	return PhoneNumber{}, fmt.Errorf("%q does not start with a known calling code", msisdn)
+}
+
+// PayoutResult is the final outcome of a single row of a bulk payout
+type PayoutResult struct {
+	Request        PayoutRequest
+	Outcome        BulkItemOutcome
+	Status         string
+	FailureCode    string
+	FailureMessage string
+	Created        string
+	Err            error
+}
+
+// PollOptions configures how long payouts are polled for a final status
+type PollOptions struct {
+	// Interval is the time between two rounds of polling, defaults to 5 seconds
+	Interval time.Duration
+	// Timeout is how long to keep polling payouts that are still pending, a single round is made when it is not set
+	Timeout time.Duration
+}
+
+// PayoutResults polls GetPayout for every row of a bulk payout that may have reached pawapay, until all of them are
+// final or the timeout elapses. Failed rows are polled too, their chunk may have been sent. Invalid and rejected rows
+// keep the outcome of the bulk call, as do failed rows pawapay does not know
+func (s *Service) PayoutResults(response CreateBulkPayoutResponse, poll PollOptions) []PayoutResult {
+	interval := poll.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(poll.Timeout)
+
+	results := make([]PayoutResult, len(response.Items))
+	var pending []int
+	for i, item := range response.Items {
+		results[i] = PayoutResult{Request: item.Request, Outcome: item.Outcome, Status: item.Response.Status,
+			Created: item.Response.Created, FailureCode: item.Response.RejectionReason.RejectionCode,
+			FailureMessage: item.Response.RejectionReason.RejectionMessage, Err: item.Err}
+		if item.Outcome != BulkItemInvalid && item.Outcome != BulkItemRejected {
+			pending = append(pending, i)
+		}
+	}
+
+	for {
+		var stillPending []int
+		for _, i := range pending {
+			payout, err := s.GetPayout(results[i].Request.PayoutId)
+			if err != nil || payout.IsNotFound() {
+				// a failed row keeps the error of the bulk call until pawapay is found to know it
+				if err != nil {
+					results[i].Err = err
+				}
+				stillPending = append(stillPending, i)
+				continue
+			}
+			results[i].Err = nil
+			results[i].Status, results[i].Created = payout.Status, payout.Created
+			results[i].FailureCode, results[i].FailureMessage = payout.FailureReason.FailureCode, payout.FailureReason.FailureMessage
+			if payout.IsPending() {
+				stillPending = append(stillPending, i)
+			}
+		}
+		pending = stillPending
+
+		if len(pending) == 0 || time.Now().Add(interval).After(deadline) {
+			return results
+		}
+		if err := sleep(s.context(), interval); err != nil {
+			return results
+		}
+	}
+}
+
+// PayoutCSVWriter writes the results of a bulk payout as csv, the columns of the request are followed by outcome,
+// status, failure_code, failure_message, created and error
+type PayoutCSVWriter struct {
+	// Columns overrides the default column names of the request fields
+	Columns PayoutCSVColumns
+	// Comma is the field delimiter, defaults to ','
+	Comma rune
+}
+
+// Write writes a header row and a row per result
+func (p PayoutCSVWriter) Write(out io.Writer, results []PayoutResult) error {
+	columns := p.Columns.withDefaults()
+	writer := csv.NewWriter(out)
+	if p.Comma != 0 {
+		writer.Comma = p.Comma
+	}
+
+	header := []string{columns.ID, columns.MSISDN, columns.Amount, columns.Currency, columns.Correspondent,
+		columns.Description, "outcome", "status", "failure_code", "failure_message", "created", "error"}
+	if err := writer.Write(header); err != nil {
+		return errors.Wrap(err, "unable to write csv header")
+	}
+	for _, r := range results {
+		var errMessage string
+		if r.Err != nil {
+			errMessage = r.Err.Error()
+		}
+		req := r.Request
+		row := []string{req.PayoutId, req.PhoneNumber.CountryCode + req.PhoneNumber.Number, req.Amount.Value,
+			req.Amount.Currency, req.Correspondent, req.Description, string(r.Outcome), r.Status, r.FailureCode,
+			r.FailureMessage, r.Created, errMessage}
+		if err := writer.Write(row); err != nil {
+			return errors.Wrap(err, "unable to write csv row")
+		}
+	}
+	writer.Flush()
+	return errors.Wrap(writer.Error(), "unable to flush csv")
+}
@@ -0,0 +1,97 @@
+// Package prometheus exposes the metrics of a pawapay service as prometheus metrics, it is kept apart so that the
+// pawapay package does not depend on prometheus
+package prometheus
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Uchencho/pawapay"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector is a pawapay.Metrics implementation that exposes its measurements as prometheus metrics.
+// Register it with a prometheus registry and pass it to the service through Config.Metrics. Every metric is
+// labelled with the tenant of the service, empty for services outside of a Registry
+type Collector struct {
+	requests  *prometheus.CounterVec
+	failures  *prometheus.CounterVec
+	latency   *prometheus.HistogramVec
+	amount    *prometheus.CounterVec
+	callbacks *prometheus.CounterVec
+	settled   *prometheus.CounterVec
+}
+
+// NewCollector returns a collector whose metrics are prefixed with the given namespace
+func NewCollector(namespace string) *Collector {
+	return &Collector{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "pawapay", Name: "requests_total",
+			Help: "Transactions sent or read by requests to pawapay by operation, correspondent, http response code and status",
+		}, []string{"tenant", "operation", "correspondent", "currency", "country", "code", "status"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "pawapay", Name: "request_failures_total",
+			Help: "Transactions whose request errored or that pawapay rejected or failed, by failure code",
+		}, []string{"tenant", "operation", "correspondent", "code", "failure_code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "pawapay", Name: "request_duration_seconds",
+			Help:    "Latency of requests made to pawapay",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"tenant", "operation", "correspondent"}),
+		amount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "pawapay", Name: "accepted_amount_total",
+			Help: "Value of payouts, deposits and refunds accepted by pawapay",
+		}, []string{"tenant", "operation", "correspondent", "currency", "country"}),
+		callbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "pawapay", Name: "callbacks_total",
+			Help: "Callbacks received from pawapay by transaction type and final status",
+		}, []string{"tenant", "type", "correspondent", "currency", "country", "status", "failure_code"}),
+		settled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "pawapay", Name: "completed_amount_total",
+			Help: "Value of transactions reported as completed through callbacks",
+		}, []string{"tenant", "type", "correspondent", "currency", "country"}),
+	}
+}
+
+func (p *Collector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{p.requests, p.failures, p.latency, p.amount, p.callbacks, p.settled}
+}
+
+// Describe implements prometheus.Collector
+func (p *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range p.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (p *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range p.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// ObserveRequest implements pawapay.Metrics, latency is observed once per request and the counters once per item
+func (p *Collector) ObserveRequest(o pawapay.RequestObservation) {
+	code := strconv.Itoa(o.ResponseCode)
+	p.latency.WithLabelValues(o.Tenant, o.Operation, o.Correspondent).Observe(o.Duration.Seconds())
+
+	for _, item := range o.Items {
+		p.requests.WithLabelValues(o.Tenant, o.Operation, item.Correspondent, item.Currency, item.Country, code, item.Status).Inc()
+		if o.Err != nil || item.FailureCode != "" || strings.EqualFold(item.Status, "rejected") || strings.EqualFold(item.Status, "failed") {
+			p.failures.WithLabelValues(o.Tenant, o.Operation, item.Correspondent, code, item.FailureCode).Inc()
+		}
+		if o.Err == nil && strings.EqualFold(item.Status, "accepted") && item.Amount > 0 {
+			p.amount.WithLabelValues(o.Tenant, o.Operation, item.Correspondent, item.Currency, item.Country).Add(item.Amount)
+		}
+	}
+}
+
+// ObserveCallback implements pawapay.Metrics
+func (p *Collector) ObserveCallback(o pawapay.CallbackObservation) {
+	cbType := string(o.Type)
+	p.callbacks.WithLabelValues(o.Tenant, cbType, o.Correspondent, o.Currency, o.Country, o.Status, o.FailureCode).Inc()
+	if strings.EqualFold(o.Status, "completed") && o.Amount > 0 {
+		p.settled.WithLabelValues(o.Tenant, cbType, o.Correspondent, o.Currency, o.Country).Add(o.Amount)
+	}
+}
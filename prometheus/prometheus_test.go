@@ -0,0 +1,100 @@
+package prometheus_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Uchencho/pawapay"
+	pawapayprometheus "github.com/Uchencho/pawapay/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollector(t *testing.T) {
+	pawapayService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/payouts/bulk" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var body []pawapay.CreatePayoutRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`[{"payoutId":"` + body[0].PayoutId + `","status":"ACCEPTED"},` +
+			`{"payoutId":"` + body[1].PayoutId + `","status":"REJECTED","rejectionReason":` +
+			`{"rejectionCode":"INVALID_AMOUNT"}}]`))
+	}))
+	defer pawapayService.Close()
+
+	collector := pawapayprometheus.NewCollector("test")
+	registry := prometheus.NewRegistry()
+	assert.NoError(t, registry.Register(collector))
+
+	c := pawapay.NewService(pawapay.Config{BaseURL: pawapayService.URL, Metrics: collector, Tenant: "ghana"})
+	payout := func(id string) pawapay.PayoutRequest {
+		return pawapay.PayoutRequest{PayoutId: id, Amount: pawapay.Amount{Currency: "GHS", Value: "100"},
+			PhoneNumber: pawapay.PhoneNumber{CountryCode: "233", Number: "704584739"}, Correspondent: "MTN_MOMO_GHA"}
+	}
+	_, err := c.CreateBulkPayout(time.Now, []pawapay.PayoutRequest{payout("7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01"),
+		payout("7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a02")})
+	assert.NoError(t, err)
+	_, err = c.CreatePayout(time.Now, payout("7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a03"))
+	assert.Error(t, err)
+
+	t.Run("Requests are counted per row", func(t *testing.T) {
+		assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP test_pawapay_requests_total Transactions sent or read by requests to pawapay by operation, correspondent, http response code and status
+# TYPE test_pawapay_requests_total counter
+test_pawapay_requests_total{code="200",correspondent="MTN_MOMO_GHA",country="GHA",currency="GHS",operation="payouts.bulk",status="ACCEPTED",tenant="ghana"} 1
+test_pawapay_requests_total{code="200",correspondent="MTN_MOMO_GHA",country="GHA",currency="GHS",operation="payouts.bulk",status="REJECTED",tenant="ghana"} 1
+test_pawapay_requests_total{code="500",correspondent="MTN_MOMO_GHA",country="GHA",currency="GHS",operation="payouts.create",status="",tenant="ghana"} 1
+# HELP test_pawapay_accepted_amount_total Value of payouts, deposits and refunds accepted by pawapay
+# TYPE test_pawapay_accepted_amount_total counter
+test_pawapay_accepted_amount_total{correspondent="MTN_MOMO_GHA",country="GHA",currency="GHS",operation="payouts.bulk",tenant="ghana"} 100
+`), "test_pawapay_requests_total", "test_pawapay_accepted_amount_total"))
+	})
+
+	t.Run("Rejected rows and failed requests are counted as failures", func(t *testing.T) {
+		assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP test_pawapay_request_failures_total Transactions whose request errored or that pawapay rejected or failed, by failure code
+# TYPE test_pawapay_request_failures_total counter
+test_pawapay_request_failures_total{code="200",correspondent="MTN_MOMO_GHA",failure_code="",operation="payouts.bulk",tenant="ghana"} 1
+test_pawapay_request_failures_total{code="500",correspondent="MTN_MOMO_GHA",failure_code="",operation="payouts.create",tenant="ghana"} 1
+`), "test_pawapay_request_failures_total"))
+	})
+
+	t.Run("Latency is observed once per request", func(t *testing.T) {
+		families, err := registry.Gather()
+		assert.NoError(t, err)
+		counts := map[string]uint64{}
+		for _, family := range families {
+			if family.GetName() != "test_pawapay_request_duration_seconds" {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "operation" {
+						counts[label.GetValue()] = m.GetHistogram().GetSampleCount()
+					}
+				}
+			}
+		}
+		assert.Equal(t, map[string]uint64{"payouts.bulk": 1, "payouts.create": 1}, counts)
+	})
+
+	t.Run("Callbacks are counted with their labels", func(t *testing.T) {
+		_, err := c.ParseCallback(pawapay.PayoutCallback, strings.NewReader(`{"payoutId":"7f6e5d4c-3b2a-4190-8a7b-6c5d4e3f2a01",`+
+			`"status":"FAILED","amount":"100","currency":"GHS","country":"GHA","correspondent":"MTN_MOMO_GHA",`+
+			`"failureReason":{"failureCode":"RECIPIENT_NOT_FOUND"}}`))
+		assert.NoError(t, err)
+		assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP test_pawapay_callbacks_total Callbacks received from pawapay by transaction type and final status
+# TYPE test_pawapay_callbacks_total counter
+test_pawapay_callbacks_total{correspondent="MTN_MOMO_GHA",country="GHA",currency="GHS",failure_code="RECIPIENT_NOT_FOUND",status="FAILED",tenant="ghana",type="`+string(pawapay.PayoutCallback)+`"} 1
+`), "test_pawapay_callbacks_total"))
+	})
+}
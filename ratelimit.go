@@ -0,0 +1,169 @@
+package pawapay
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// EndpointFamily groups pawapay endpoints that share a rate limit
+type EndpointFamily string
+
+const (
+	PayoutEndpoints  EndpointFamily = "payouts"
+	DepositEndpoints EndpointFamily = "deposits"
+	RefundEndpoints  EndpointFamily = "refunds"
+	ReadEndpoints    EndpointFamily = "read"
+)
+
+// defaultRetryAfter is how long requests are held back after a 429 that carries no Retry-After header
+const defaultRetryAfter = time.Second
+
+// Limit configures a token bucket, RequestsPerSecond of zero means no limit
+type Limit struct {
+	RequestsPerSecond float64
+	Burst             int
+}
+
+// RateLimit configures client side throttling of requests made to pawapay
+type RateLimit struct {
+	// Limit is shared by every request that has no family specific limit
+	Limit
+	// Families overrides the shared limit for an endpoint family, GET requests belong to ReadEndpoints
+	Families map[EndpointFamily]Limit
+	// MaxInFlight caps the number of concurrent requests, zero means no cap
+	MaxInFlight int
+	// MaxRetries is the number of times a request rejected with a 429 is retried after its Retry-After
+	MaxRetries int
+}
+
+type rateLimiter struct {
+	shared     *rate.Limiter
+	families   map[EndpointFamily]*rate.Limiter
+	inFlight   chan struct{}
+	maxRetries int
+
+	mu           sync.Mutex
+	blockedUntil time.Time
+}
+
+func newLimiter(l Limit) *rate.Limiter {
+	if l.RequestsPerSecond <= 0 {
+		return nil
+	}
+	burst := l.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(l.RequestsPerSecond), burst)
+}
+
+func newRateLimiter(c *RateLimit) *rateLimiter {
+	if c == nil {
+		return nil
+	}
+
+	l := &rateLimiter{
+		shared:     newLimiter(c.Limit),
+		families:   map[EndpointFamily]*rate.Limiter{},
+		maxRetries: c.MaxRetries,
+	}
+	for family, limit := range c.Families {
+		if fl := newLimiter(limit); fl != nil {
+			l.families[family] = fl
+		}
+	}
+	if c.MaxInFlight > 0 {
+		l.inFlight = make(chan struct{}, c.MaxInFlight)
+	}
+	return l
+}
+
+// endpointFamily returns the family a request belongs to
+func endpointFamily(method, resource string) EndpointFamily {
+	if method == http.MethodGet {
+		return ReadEndpoints
+	}
+	return EndpointFamily(strings.SplitN(strings.TrimPrefix(resource, "v1/"), "/", 2)[0])
+}
+
+// acquire blocks until a request of the given family may be sent. The returned func must be called once the
+// request completes
+func (l *rateLimiter) acquire(ctx context.Context, family EndpointFamily) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	wait := time.Until(l.blockedUntil)
+	l.mu.Unlock()
+	if err := sleep(ctx, wait); err != nil {
+		return nil, err
+	}
+
+	limiter := l.shared
+	if fl, ok := l.families[family]; ok {
+		limiter = fl
+	}
+	if limiter != nil {
+		if err := limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if l.inFlight == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.inFlight <- struct{}{}:
+		return func() { <-l.inFlight }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// backoff holds back every request until d has elapsed
+func (l *rateLimiter) backoff(d time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.blockedUntil) {
+		l.blockedUntil = until
+	}
+}
+
+// retryAfter reads the Retry-After header which is either a number of seconds or a http date
+func retryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return defaultRetryAfter
+	}
+	if seconds, err := strconv.Atoi(v); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return defaultRetryAfter
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,299 @@
+package pawapay
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReconciliationClass is the verdict on a single transaction
+type ReconciliationClass string
+
+const (
+	ReconciliationMatched          ReconciliationClass = "MATCHED"
+	ReconciliationStatusMismatch   ReconciliationClass = "STATUS_MISMATCH"
+	ReconciliationAmountMismatch   ReconciliationClass = "AMOUNT_MISMATCH"
+	ReconciliationMissingAtPawapay ReconciliationClass = "MISSING_AT_PAWAPAY"
+	ReconciliationUnknownLocally   ReconciliationClass = "UNKNOWN_LOCALLY"
+	// ReconciliationLookupFailed means pawapay could not be asked about the transaction, run it again later
+	ReconciliationLookupFailed ReconciliationClass = "LOOKUP_FAILED"
+)
+
+// TransactionRef identifies a transaction
+type TransactionRef struct {
+	ID   string          `json:"id"`
+	Type TransactionType `json:"type"`
+}
+
+// LocalTransaction is a transaction as recorded on the caller's side. Empty Status or Amount are not compared
+type LocalTransaction struct {
+	TransactionRef
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+	Status   string `json:"status"`
+}
+
+// ReconciliationSource provides the local side of a reconciliation
+type ReconciliationSource interface {
+	LocalTransactions() ([]LocalTransaction, error)
+}
+
+// ReconciliationSourceFunc adapts a func, eg a database query, to a ReconciliationSource
+type ReconciliationSourceFunc func() ([]LocalTransaction, error)
+
+// LocalTransactions implements ReconciliationSource
+func (f ReconciliationSourceFunc) LocalTransactions() ([]LocalTransaction, error) { return f() }
+
+// TransactionStoreSource reads the local side of a reconciliation from a TransactionStore
+type TransactionStoreSource struct {
+	Store TransactionStore
+	Query TransactionQuery
+}
+
+// LocalTransactions implements ReconciliationSource
+func (t TransactionStoreSource) LocalTransactions() ([]LocalTransaction, error) {
+	records, err := t.Store.FindTransactions(t.Query)
+	if err != nil {
+		return nil, err
+	}
+	local := make([]LocalTransaction, 0, len(records))
+	for _, r := range records {
+		local = append(local, LocalTransaction{TransactionRef: TransactionRef{ID: r.ID, Type: r.Type},
+			Amount: r.Amount, Currency: r.Currency, Status: r.Status})
+	}
+	return local, nil
+}
+
+// CSVSource reads the local side of a reconciliation from csv with a header row holding the columns type, id,
+// amount, currency and status in any order. Only type and id are required
+type CSVSource struct {
+	Reader io.Reader
+}
+
+// LocalTransactions implements ReconciliationSource
+func (c CSVSource) LocalTransactions() ([]LocalTransaction, error) {
+	reader := csv.NewReader(c.Reader)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read csv header")
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"type", "id"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("csv header has no %s column", required)
+		}
+	}
+
+	value := func(row []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(row) {
+			return ""
+		}
+		return strings.TrimSpace(row[i])
+	}
+
+	var local []LocalTransaction
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return local, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read csv line %d", line)
+		}
+		local = append(local, LocalTransaction{
+			TransactionRef: TransactionRef{ID: value(row, "id"), Type: TransactionType(strings.ToLower(value(row, "type")))},
+			Amount:         value(row, "amount"),
+			Currency:       value(row, "currency"),
+			Status:         value(row, "status"),
+		})
+	}
+}
+
+// ReconciliationEntry is the verdict on a single transaction
+type ReconciliationEntry struct {
+	TransactionRef
+	Class           ReconciliationClass `json:"class"`
+	LocalStatus     string              `json:"localStatus,omitempty"`
+	RemoteStatus    string              `json:"remoteStatus,omitempty"`
+	LocalAmount     string              `json:"localAmount,omitempty"`
+	RemoteAmount    string              `json:"remoteAmount,omitempty"`
+	RequestedAmount string              `json:"requestedAmount,omitempty"`
+	Currency        string              `json:"currency,omitempty"`
+	Detail          string              `json:"detail,omitempty"`
+}
+
+// ReconciliationReport is the outcome of a reconciliation, entries are in the order of the source
+type ReconciliationReport struct {
+	GeneratedAt time.Time                   `json:"generatedAt"`
+	Summary     map[ReconciliationClass]int `json:"summary"`
+	Entries     []ReconciliationEntry       `json:"entries"`
+}
+
+// WriteJSON writes the report as indented json
+func (r ReconciliationReport) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// remoteTransaction is what pawapay knows about a transaction
+type remoteTransaction struct {
+	found           bool
+	status          string
+	amount          string
+	requestedAmount string
+	currency        string
+}
+
+// lookupTransaction asks pawapay for a transaction of any type
+func (s *Service) lookupTransaction(ref TransactionRef) (remoteTransaction, error) {
+	switch ref.Type {
+	case PayoutTransaction:
+		payout, err := s.GetPayout(ref.ID)
+		return remoteTransaction{found: !payout.IsNotFound(), status: payout.Status, amount: payout.Amount,
+			currency: payout.Currency}, err
+	case DepositTransaction:
+		deposit, err := s.GetDeposit(ref.ID)
+		amount := deposit.DepositedAmount
+		if amount == "" {
+			amount = deposit.RequestedAmount
+		}
+		return remoteTransaction{found: !deposit.IsNotFound(), status: deposit.Status, amount: amount,
+			requestedAmount: deposit.RequestedAmount, currency: deposit.Currency}, err
+	case RefundTransaction:
+		refund, err := s.GetRefund(ref.ID)
+		return remoteTransaction{found: !refund.IsNotFound(), status: refund.Status, amount: refund.Amount,
+			currency: refund.Currency}, err
+	}
+	return remoteTransaction{}, errors.Errorf("unknown transaction type %q", ref.Type)
+}
+
+// Reconciler compares local records of transactions against pawapay
+type Reconciler struct {
+	service *Service
+	// Concurrency is the number of lookups in flight at once, defaults to DefaultBulkConcurrency
+	Concurrency int
+	now         TimeProviderFunc
+}
+
+// NewReconciler returns a reconciler that looks transactions up through s
+func NewReconciler(s *Service) *Reconciler {
+	return &Reconciler{service: s, now: time.Now}
+}
+
+// Reconcile looks up every transaction of the source. seenAtPawapay are transactions known to exist at pawapay,
+// eg from callbacks, those missing from the source are reported as unknown locally
+func (r *Reconciler) Reconcile(source ReconciliationSource, seenAtPawapay ...TransactionRef) (ReconciliationReport, error) {
+	local, err := source.LocalTransactions()
+	if err != nil {
+		return ReconciliationReport{}, errors.Wrap(err, "unable to read local transactions")
+	}
+
+	known := map[TransactionRef]bool{}
+	for _, l := range local {
+		known[l.TransactionRef] = true
+	}
+	localOnly := len(local)
+	for _, ref := range seenAtPawapay {
+		if !known[ref] {
+			known[ref] = true
+			local = append(local, LocalTransaction{TransactionRef: ref})
+		}
+	}
+
+	entries := make([]ReconciliationEntry, len(local))
+	concurrency := r.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBulkConcurrency
+	}
+
+	var (
+		wg   sync.WaitGroup
+		jobs = make(chan int)
+	)
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				entries[i] = r.reconcile(local[i], i >= localOnly)
+			}
+		}()
+	}
+	for i := range local {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	report := ReconciliationReport{GeneratedAt: r.now(), Summary: map[ReconciliationClass]int{}, Entries: entries}
+	for _, e := range entries {
+		report.Summary[e.Class]++
+	}
+	return report, nil
+}
+
+func (r *Reconciler) reconcile(local LocalTransaction, remoteOnly bool) ReconciliationEntry {
+	entry := ReconciliationEntry{TransactionRef: local.TransactionRef, LocalStatus: local.Status,
+		LocalAmount: local.Amount, Currency: local.Currency}
+
+	remote, err := r.service.lookupTransaction(local.TransactionRef)
+	if err != nil {
+		entry.Class, entry.Detail = ReconciliationLookupFailed, err.Error()
+		return entry
+	}
+	entry.RemoteStatus, entry.RemoteAmount = remote.status, remote.amount
+	if remote.currency != "" {
+		entry.Currency = remote.currency
+	}
+	if remote.requestedAmount != remote.amount {
+		entry.RequestedAmount = remote.requestedAmount
+	}
+
+	switch {
+	case !remote.found && remoteOnly:
+		entry.Class, entry.Detail = ReconciliationMissingAtPawapay, "seen at pawapay but it no longer returns it"
+	case !remote.found:
+		entry.Class = ReconciliationMissingAtPawapay
+	case remoteOnly:
+		entry.Class = ReconciliationUnknownLocally
+	case local.Amount != "" && !sameAmount(local.Amount, remote.amount):
+		entry.Class = ReconciliationAmountMismatch
+		entry.Detail = fmt.Sprintf("local amount %s, pawapay amount %s", local.Amount, remote.amount)
+	case local.Currency != "" && remote.currency != "" && !strings.EqualFold(local.Currency, remote.currency):
+		entry.Class = ReconciliationAmountMismatch
+		entry.Detail = fmt.Sprintf("local currency %s, pawapay currency %s", local.Currency, remote.currency)
+	case remote.requestedAmount != "" && remote.amount != "" && !sameAmount(remote.requestedAmount, remote.amount):
+		entry.Class = ReconciliationAmountMismatch
+		entry.Detail = fmt.Sprintf("requested %s but %s was deposited", remote.requestedAmount, remote.amount)
+	case local.Status != "" && !strings.EqualFold(local.Status, remote.status):
+		entry.Class = ReconciliationStatusMismatch
+		entry.Detail = fmt.Sprintf("local status %s, pawapay status %s", local.Status, remote.status)
+	default:
+		entry.Class = ReconciliationMatched
+	}
+	return entry
+}
+
+// sameAmount compares decimal amounts so that 100 and 100.00 are equal
+func sameAmount(a, b string) bool {
+	x, okX := new(big.Rat).SetString(a)
+	y, okY := new(big.Rat).SetString(b)
+	if !okX || !okY {
+		return a == b
+	}
+	return x.Cmp(y) == 0
+}
@@ -5,12 +5,21 @@ import (
 	"net/http"
 )
 
-// RequestRefund provides the functionality of requesting a refund for an initiated deposit
+// RequestRefund provides the functionality of requesting a refund for an initiated deposit, metadata is optional
 // See docs https://docs.pawapay.co.uk/#operation/depositWebhook for more details
-func (s *Service) RequestRefund(refundId, depositId string, amount Amount) (InitiateRefundResponse, error) {
+func (s *Service) RequestRefund(refundId, depositId string, amount Amount, metadata ...MetadataField) (InitiateRefundResponse, error) {
+
+	if err := checkRefund(refundId, depositId, metadata); err != nil {
+		return InitiateRefundResponse{}, err
+	}
+
+	return s.requestRefund(s.newRefundRequest(refundId, depositId, amount, metadata))
+}
+
+// requestRefund sends a checked refund payload
+func (s *Service) requestRefund(payload RefundRequest) (InitiateRefundResponse, error) {
 
 	resource := "refunds"
-	payload := s.newRefundRequest(refundId, depositId, amount)
 
 	var response InitiateRefundResponse
 	annotation, err := s.makeRequest(http.MethodPost, resource, payload, &response)
@@ -19,9 +28,23 @@ func (s *Service) RequestRefund(refundId, depositId string, amount Amount) (Init
 	}
 	response.Annotation = annotation
 
+	if err := checkEchoedID("RequestRefund", payload.RefundId, response.RefundId); err != nil {
+		return response, err
+	}
+
 	return response, nil
 }
 
+func checkRefund(refundId, depositId string, metadata []MetadataField) error {
+	if err := ValidateID("refundId", refundId); err != nil {
+		return err
+	}
+	if err := ValidateID("depositId", depositId); err != nil {
+		return err
+	}
+	return ValidateMetadata(metadata)
+}
+
 // GetRefund provides the functionality of retrieving an initiated refund
 // See docs https://docs.pawapay.co.uk/#operation/getRefund for more details
 func (s *Service) GetRefund(refundId string) (Refund, error) {
@@ -59,3 +82,63 @@ func (s *Service) ResendRefundCallback(refundId string) (RefundStatusResponse, e
 
 	return response, nil
 }
+
+// RequestBulkRefund provides the functionality of requesting refunds for many deposits at once. pawapay has no bulk
+// refund endpoint so the refunds are sent one by one, Config.Bulk.Concurrency at a time. The outcome of every row is
+// returned, a *BulkError is returned with it when a row was not sent or has an unknown outcome, even though the other
+// rows were sent
+func (s *Service) RequestBulkRefund(data []RefundRequest) (CreateBulkRefundResponse, error) {
+
+	ids := make([]string, 0, len(data))
+	for _, refund := range data {
+		ids = append(ids, refund.RefundId)
+	}
+	if err := checkDuplicateIDs("refundId", ids); err != nil {
+		return CreateBulkRefundResponse{}, err
+	}
+
+	items := make([]BulkRefundItem, len(data))
+	s.forEachChunk(len(data), func(_, start, end int) {
+		for i := start; i < end; i++ {
+			refund := data[i]
+			items[i] = BulkRefundItem{Index: i, Request: refund}
+
+			if err := validateRefundRequest(refund); err != nil {
+				items[i].Outcome, items[i].Err = BulkItemInvalid, err
+				continue
+			}
+
+			payload := s.newRefundRequest(refund.RefundId, refund.DepositId, Amount{Value: refund.Amount}, refund.Metadata)
+			payload.Currency = refund.Currency
+			response, err := s.requestRefund(payload)
+			items[i].Response = response
+			if err != nil {
+				items[i].Outcome, items[i].Err = BulkItemFailed, err
+				continue
+			}
+			items[i].Outcome = bulkOutcome(response.Status)
+		}
+	})
+
+	var response CreateBulkRefundResponse
+	outcomes := make([]BulkItemOutcome, 0, len(items))
+	for _, item := range items {
+		if item.Response.RefundId != "" {
+			response.Result = append(response.Result, item.Response)
+		}
+		outcomes = append(outcomes, item.Outcome)
+	}
+	response.Items = items
+
+	return response, bulkError(outcomes)
+}
+
+func validateRefundRequest(refund RefundRequest) error {
+	if err := checkRefund(refund.RefundId, refund.DepositId, refund.Metadata); err != nil {
+		return err
+	}
+	if refund.Amount == "" {
+		return fmt.Errorf("refund %s has no amount", refund.RefundId)
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package pawapay
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrDepositNotRefundable matches, with errors.Is, the *DepositNotRefundableError returned when a refund is
+// requested for a deposit that has not completed
+var ErrDepositNotRefundable = errors.New("pawapay: only completed deposits can be refunded")
+
+// DepositNotRefundableError is returned when a refund is requested for a deposit that has not completed
+type DepositNotRefundableError struct {
+	DepositId string
+	Status    string
+}
+
+func (e *DepositNotRefundableError) Error() string {
+	return fmt.Sprintf("pawapay: deposit %s is %s, only completed deposits can be refunded", e.DepositId, e.Status)
+}
+
+// Is makes the error match ErrDepositNotRefundable
+func (e *DepositNotRefundableError) Is(target error) bool { return target == ErrDepositNotRefundable }
+
+// OverRefundError is returned when a refund would take the total refunded above the deposited amount
+type OverRefundError struct {
+	DepositId  string
+	Requested  string
+	Refundable string
+}
+
+func (e *OverRefundError) Error() string {
+	return fmt.Sprintf("pawapay: refund of %s for deposit %s exceeds the refundable balance of %s",
+		e.Requested, e.DepositId, e.Refundable)
+}
+
+// RefundRecord is a refund requested against a deposit
+type RefundRecord struct {
+	RefundId  string `json:"refundId"`
+	DepositId string `json:"depositId"`
+	Amount    string `json:"amount"`
+	Currency  string `json:"currency"`
+	Status    string `json:"status"`
+}
+
+const (
+	// RefundNotSent is the status of a recorded refund that failed before it was sent to pawapay
+	RefundNotSent = "NOT_SENT"
+	// RefundNotFound is the status of a recorded refund pawapay does not know, its request may still be in flight
+	// so it is looked up again every time the balance is computed
+	RefundNotFound = "NOT_FOUND"
+)
+
+// counts reports whether the refund takes from the refundable balance, anything not known to have failed does
+func (r RefundRecord) counts() bool {
+	for _, status := range []string{"rejected", "failed", RefundNotSent, RefundNotFound} {
+		if strings.EqualFold(r.Status, status) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r RefundRecord) isFinal() bool {
+	for _, status := range []string{"rejected", "failed", "completed", RefundNotSent} {
+		if strings.EqualFold(r.Status, status) {
+			return true
+		}
+	}
+	return false
+}
+
+// RefundStore keeps track of the refunds requested against each deposit
+type RefundStore interface {
+	ListRefunds(depositId string) ([]RefundRecord, error)
+	// SaveRefund inserts a record or replaces the one with the same RefundId
+	SaveRefund(RefundRecord) error
+}
+
+// MemoryRefundStore is a RefundStore that lives for as long as the process does
+type MemoryRefundStore struct {
+	mu      sync.Mutex
+	records map[string][]RefundRecord
+}
+
+// NewMemoryRefundStore returns an empty in memory refund store
+func NewMemoryRefundStore() *MemoryRefundStore {
+	return &MemoryRefundStore{records: map[string][]RefundRecord{}}
+}
+
+// ListRefunds implements RefundStore
+func (m *MemoryRefundStore) ListRefunds(depositId string) ([]RefundRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]RefundRecord(nil), m.records[depositId]...), nil
+}
+
+// SaveRefund implements RefundStore
+func (m *MemoryRefundStore) SaveRefund(r RefundRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, existing := range m.records[r.DepositId] {
+		if existing.RefundId == r.RefundId {
+			m.records[r.DepositId][i] = r
+			return nil
+		}
+	}
+	m.records[r.DepositId] = append(m.records[r.DepositId], r)
+	return nil
+}
+
+// RefundableBalance is what is left to refund on a deposit
+type RefundableBalance struct {
+	Deposit    Deposit
+	Deposited  string
+	Refunded   string
+	Refundable string
+	Currency   string
+	Refunds    []RefundRecord
+}
+
+// RefundTracker guards refunds against over-refunding a deposit
+type RefundTracker struct {
+	service *Service
+	store   RefundStore
+	mu      sync.Mutex
+}
+
+// NewRefundTracker returns a tracker that records refunds in store. Refunds in store that are not final have
+// their status refreshed through GetRefund before they are summed
+func NewRefundTracker(s *Service, store RefundStore) *RefundTracker {
+	return &RefundTracker{service: s, store: store}
+}
+
+// RefundableBalance returns how much of a completed deposit can still be refunded
+func (t *RefundTracker) RefundableBalance(depositId string) (RefundableBalance, error) {
+	deposit, err := t.service.GetDeposit(depositId)
+	if err != nil {
+		return RefundableBalance{}, err
+	}
+	if !deposit.IsSuccessful() {
+		return RefundableBalance{Deposit: deposit}, &DepositNotRefundableError{DepositId: depositId,
+			Status: deposit.Status}
+	}
+
+	deposited, ok := new(big.Rat).SetString(deposit.DepositedAmount)
+	if !ok {
+		return RefundableBalance{Deposit: deposit}, fmt.Errorf("deposit %s has an invalid deposited amount %q",
+			depositId, deposit.DepositedAmount)
+	}
+
+	records, err := t.store.ListRefunds(depositId)
+	if err != nil {
+		return RefundableBalance{Deposit: deposit}, errors.Wrap(err, "unable to list refunds")
+	}
+
+	refunded, scale, counted := new(big.Rat), decimalScale(deposit.DepositedAmount), false
+	for i, record := range records {
+		if !record.isFinal() {
+			refund, err := t.service.GetRefund(record.RefundId)
+			if err != nil {
+				return RefundableBalance{Deposit: deposit}, err
+			}
+			status := refund.Status
+			if refund.IsNotFound() {
+				status = RefundNotFound
+			}
+			if status != "" && status != record.Status {
+				record.Status = status
+				if err := t.store.SaveRefund(record); err != nil {
+					return RefundableBalance{Deposit: deposit}, errors.Wrap(err, "unable to save refund")
+				}
+				records[i] = record
+			}
+		}
+		if !record.counts() {
+			continue
+		}
+		amount, ok := new(big.Rat).SetString(record.Amount)
+		if !ok {
+			return RefundableBalance{Deposit: deposit}, fmt.Errorf("refund %s has an invalid amount %q",
+				record.RefundId, record.Amount)
+		}
+		refunded.Add(refunded, amount)
+		counted = true
+		if s := decimalScale(record.Amount); s > scale {
+			scale = s
+		}
+	}
+
+	balance := RefundableBalance{
+		Deposit:    deposit,
+		Deposited:  deposit.DepositedAmount,
+		Refunded:   refunded.FloatString(scale),
+		Refundable: new(big.Rat).Sub(deposited, refunded).FloatString(scale),
+		Currency:   deposit.Currency,
+		Refunds:    records,
+	}
+	// a deposit nothing was taken from is refunded with the amount pawapay reported, as it reported it
+	if !counted {
+		balance.Refundable = deposit.DepositedAmount
+	}
+	return balance, nil
+}
+
+// decimalScale returns the number of decimals of a decimal amount, so that amounts computed from it are written
+// the way it was, eg without decimals for a currency that has none
+func decimalScale(amount string) int {
+	amount = strings.TrimSpace(amount)
+	if i := strings.IndexByte(amount, '.'); i >= 0 {
+		return len(amount) - i - 1
+	}
+	return 0
+}
+
+// Refund requests a refund of a completed deposit after checking it against the refundable balance. When
+// amount has no value what is left of the deposited amount is refunded
+func (t *RefundTracker) Refund(refundId, depositId string, amount Amount, metadata ...MetadataField) (InitiateRefundResponse, error) {
+	// checked before anything is recorded so that an invalid refund never takes from the balance
+	if err := checkRefund(refundId, depositId, metadata); err != nil {
+		return InitiateRefundResponse{}, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	balance, err := t.RefundableBalance(depositId)
+	if err != nil {
+		return InitiateRefundResponse{}, err
+	}
+
+	if amount.Value == "" {
+		amount = Amount{Value: balance.Refundable, Currency: balance.Currency}
+	}
+	if amount.Currency == "" {
+		amount.Currency = balance.Currency
+	}
+	if !strings.EqualFold(amount.Currency, balance.Currency) {
+		return InitiateRefundResponse{}, fmt.Errorf("refund currency %s does not match deposit currency %s",
+			amount.Currency, balance.Currency)
+	}
+
+	requested, ok := new(big.Rat).SetString(amount.Value)
+	if !ok || requested.Sign() <= 0 {
+		return InitiateRefundResponse{}, fmt.Errorf("invalid refund amount %q", amount.Value)
+	}
+	refundable, _ := new(big.Rat).SetString(balance.Refundable)
+	if requested.Cmp(refundable) > 0 {
+		return InitiateRefundResponse{}, &OverRefundError{DepositId: depositId, Requested: amount.Value,
+			Refundable: balance.Refundable}
+	}
+
+	// the refund is recorded before it is sent so a crash in between errs on the side of a smaller balance
+	record := RefundRecord{RefundId: refundId, DepositId: depositId, Amount: amount.Value, Currency: amount.Currency,
+		Status: "PENDING"}
+	if err := t.store.SaveRefund(record); err != nil {
+		return InitiateRefundResponse{}, errors.Wrap(err, "unable to save refund")
+	}
+
+	response, err := t.service.RequestRefund(refundId, depositId, amount, metadata...)
+	if err != nil {
+		// a refund whose outcome is unknown stays pending, the next balance looks it up and stops counting it
+		// when pawapay does not know it
+		var statusErr *StatusError
+		switch {
+		case IsNotSent(err):
+			record.Status = RefundNotSent
+		case errors.As(err, &statusErr) && statusErr.StatusCode >= 400 && statusErr.StatusCode < 500 &&
+			statusErr.StatusCode != http.StatusTooManyRequests:
+			record.Status = "REJECTED"
+		default:
+			return response, err
+		}
+		// the error of the request is kept as the cause so that callers can still tell it was not sent or rejected
+		if saveErr := t.store.SaveRefund(record); saveErr != nil {
+			return response, errors.Wrapf(err, "unable to save refund as %s: %s", record.Status, saveErr)
+		}
+		return response, err
+	}
+
+	record.Status = response.Status
+	if err := t.store.SaveRefund(record); err != nil {
+		return response, errors.Wrap(err, "unable to save refund")
+	}
+	return response, nil
+}
@@ -0,0 +1,250 @@
+package pawapay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pariz/gountries"
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownTenant is returned when no tenant of a registry matches a call
+var ErrUnknownTenant = errors.New("pawapay: no tenant matches")
+
+// Tenant is a pawapay merchant account. Countries (alpha3) and Currencies restrict the calls routed to it by the
+// default resolver, empty lists match everything
+type Tenant struct {
+	Key        string
+	Config     Config
+	Countries  []string
+	Currencies []string
+}
+
+func (t Tenant) matches(hint TenantHint) bool {
+	return matchesAny(t.Countries, hint.Country) && matchesAny(t.Currencies, hint.Currency)
+}
+
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// TenantHint is what is known about a call when picking the tenant it goes through
+type TenantHint struct {
+	Key           string
+	Country       string
+	Currency      string
+	Correspondent string
+}
+
+// TenantResolver picks the key of the tenant a call goes through
+type TenantResolver interface {
+	ResolveTenant(hint TenantHint, tenants []Tenant) (string, error)
+}
+
+// TenantResolverFunc adapts a func to a TenantResolver
+type TenantResolverFunc func(hint TenantHint, tenants []Tenant) (string, error)
+
+// ResolveTenant implements TenantResolver
+func (f TenantResolverFunc) ResolveTenant(hint TenantHint, tenants []Tenant) (string, error) {
+	return f(hint, tenants)
+}
+
+// MatchTenant is the default TenantResolver. It picks the tenant named by the hint's key, otherwise the first tenant
+// whose countries and currencies match the hint
+var MatchTenant = TenantResolverFunc(func(hint TenantHint, tenants []Tenant) (string, error) {
+	if hint.Key != "" {
+		return hint.Key, nil
+	}
+	for _, t := range tenants {
+		if t.matches(hint) {
+			return t.Key, nil
+		}
+	}
+	return "", ErrUnknownTenant
+})
+
+// RegistryConfig configures a Registry
+type RegistryConfig struct {
+	// HTTPClient is shared by every tenant that does not set its own, defaults to a client with a 60 second timeout
+	HTTPClient *http.Client
+	// Metrics is used by every tenant that does not set its own, observations carry the tenant's key
+	Metrics Metrics
+	// Resolver picks the tenant of a call, defaults to MatchTenant
+	Resolver TenantResolver
+	// CallbackTenant, when set, names the tenant of an incoming callback, eg from a path segment of its url. See
+	// Registry.CallbackTenant for what is tried before it and when it returns an empty key
+	CallbackTenant func(*http.Request, Callback) string
+	// TrustCallbackHints lets the tenant query parameter of a callback url and the tenant metadata field of the
+	// transaction name the tenant of callbacks no TransactionStore knows. Both can be set by whoever sends the
+	// callback, so they are ignored unless this is set
+	TrustCallbackHints bool
+}
+
+// Registry routes calls between several pawapay merchant accounts, each with their own api key and base url
+type Registry struct {
+	config   RegistryConfig
+	tenants  []Tenant
+	services map[string]*Service
+}
+
+// NewRegistry returns a registry of the given tenants, their keys must be unique
+func NewRegistry(c RegistryConfig, tenants ...Tenant) (*Registry, error) {
+	if c.HTTPClient == nil {
+		c.HTTPClient = &http.Client{Timeout: 60 * time.Second}
+	}
+	if c.Resolver == nil {
+		c.Resolver = MatchTenant
+	}
+
+	r := &Registry{config: c, services: map[string]*Service{}}
+	for _, t := range tenants {
+		if t.Key == "" {
+			return nil, errors.New("pawapay: tenant key cannot be empty")
+		}
+		if _, ok := r.services[t.Key]; ok {
+			return nil, fmt.Errorf("pawapay: tenant %s is registered twice", t.Key)
+		}
+
+		t.Config.Tenant = t.Key
+		if t.Config.HTTPClient == nil {
+			t.Config.HTTPClient = c.HTTPClient
+		}
+		if t.Config.Metrics == nil {
+			t.Config.Metrics = c.Metrics
+		}
+		service := NewService(t.Config)
+		r.services[t.Key] = &service
+		r.tenants = append(r.tenants, t)
+	}
+	return r, nil
+}
+
+// Keys returns the keys of the tenants in the order they were registered
+func (r *Registry) Keys() []string {
+	keys := make([]string, 0, len(r.tenants))
+	for _, t := range r.tenants {
+		keys = append(keys, t.Key)
+	}
+	return keys
+}
+
+// Service returns the service of a tenant
+func (r *Registry) Service(key string) (*Service, error) {
+	s, ok := r.services[key]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownTenant, "tenant %s", key)
+	}
+	return s, nil
+}
+
+// Resolve returns the service the resolver picks for hint
+func (r *Registry) Resolve(hint TenantHint) (*Service, error) {
+	key, err := r.config.Resolver.ResolveTenant(hint, r.tenants)
+	if err != nil {
+		return nil, err
+	}
+	return r.Service(key)
+}
+
+// ForPayout returns the service a payout goes through, picked from its currency and the recipient's country
+func (r *Registry) ForPayout(req PayoutRequest) (*Service, error) {
+	return r.Resolve(TenantHint{Country: callingCodeCountry(req.PhoneNumber.CountryCode),
+		Currency: req.Amount.Currency, Correspondent: req.Correspondent})
+}
+
+// ForDeposit returns the service a deposit goes through, picked from its currency and the payer's country
+func (r *Registry) ForDeposit(req DepositRequest) (*Service, error) {
+	return r.Resolve(TenantHint{Country: callingCodeCountry(req.PhoneNumber.CountryCode),
+		Currency: req.Amount.Currency, Correspondent: req.Correspondent})
+}
+
+func callingCodeCountry(callingCode string) string {
+	country, err := gountries.New().FindCountryByCallingCode(callingCode)
+	if err != nil {
+		return ""
+	}
+	return country.Alpha3
+}
+
+// CallbackTenant names the tenant a callback belongs to. It looks the transaction up in the TransactionStore of
+// every tenant, then tries RegistryConfig.CallbackTenant and, only when RegistryConfig.TrustCallbackHints is set, the
+// tenant query parameter of the callback url and the tenant metadata field of the transaction
+func (r *Registry) CallbackTenant(req *http.Request, cb Callback) (string, error) {
+	for _, t := range r.tenants {
+		if t.Config.TransactionStore == nil {
+			continue
+		}
+		_, err := t.Config.TransactionStore.GetTransaction(cb.ID())
+		if err == nil {
+			return t.Key, nil
+		}
+		if !errors.Is(err, ErrTransactionNotFound) {
+			return "", errors.Wrapf(err, "unable to look %s callback %s up in tenant %s", cb.Type, cb.ID(), t.Key)
+		}
+	}
+	if r.config.CallbackTenant != nil {
+		if key := r.config.CallbackTenant(req, cb); key != "" {
+			return key, nil
+		}
+	}
+	if r.config.TrustCallbackHints {
+		if key := req.URL.Query().Get("tenant"); key != "" {
+			return key, nil
+		}
+		if key := cb.Metadata()["tenant"]; key != "" {
+			return key, nil
+		}
+	}
+	return "", errors.Wrapf(ErrUnknownTenant, "%s callback %s", cb.Type, cb.ID())
+}
+
+// CallbackHandler returns a http handler that decodes callbacks of the given type, parses them through the service
+// of the tenant they belong to and passes them to fn. Callbacks whose tenant cannot be told are answered with a 400
+func (r *Registry) CallbackHandler(callbackType CallbackType, fn func(tenant string, cb Callback) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		cb, err := decodeCallback(callbackType, body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		key, err := r.CallbackTenant(req, cb)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		service, err := r.Service(key)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// parsed again through the tenant's service so that it is observed and recorded as that tenant
+		cb, err = service.ParseCallback(callbackType, bytes.NewReader(body))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := fn(key, cb); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
@@ -0,0 +1,399 @@
+package pawapay
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const camt053Namespace = "urn:iso:std:iso:20022:tech:xsd:camt.053.001.08"
+
+// Directions of a statement entry, as seen from the wallet
+const (
+	StatementCredit = "CRDT"
+	StatementDebit  = "DBIT"
+)
+
+// StatementEntry is a transaction as it appears on a statement
+type StatementEntry struct {
+	ID               string
+	Type             TransactionType
+	Status           string
+	Direction        string
+	Amount           string
+	Currency         string
+	Country          string
+	Correspondent    string
+	CorrespondentIds map[string]interface{}
+	BookedAt         time.Time
+}
+
+// PayoutEntry returns the statement entry of a payout, it debits the wallet
+func PayoutEntry(p Payout) StatementEntry {
+	return StatementEntry{ID: p.PayoutID, Type: PayoutTransaction, Status: p.Status, Direction: StatementDebit, Amount: p.Amount,
+		Currency: p.Currency, Country: p.Country, Correspondent: p.Correspondent, CorrespondentIds: p.CorrespondentIds,
+		BookedAt: parseTimestamp(p.Created)}
+}
+
+// DepositEntry returns the statement entry of a deposit, it credits the wallet with the deposited amount
+func DepositEntry(d Deposit) StatementEntry {
+	amount := d.DepositedAmount
+	if amount == "" {
+		amount = d.RequestedAmount
+	}
+	return StatementEntry{ID: d.DepositId, Type: DepositTransaction, Status: d.Status, Direction: StatementCredit, Amount: amount,
+		Currency: d.Currency, Country: d.Country, Correspondent: d.Correspondent, CorrespondentIds: d.CorrespondentIds,
+		BookedAt: parseTimestamp(d.Created)}
+}
+
+// RefundEntry returns the statement entry of a refund, it debits the wallet
+func RefundEntry(f Refund) StatementEntry {
+	return StatementEntry{ID: f.RefundId, Type: RefundTransaction, Status: f.Status, Direction: StatementDebit, Amount: f.Amount,
+		Currency: f.Currency, Country: f.Country, Correspondent: f.Correspondent, CorrespondentIds: f.CorrespondentIds,
+		BookedAt: parseTimestamp(f.Created)}
+}
+
+// RecordEntry returns the statement entry of a stored transaction. Stores do not keep correspondent ids, the entry
+// is booked when the transaction reached its current status
+func RecordEntry(r TransactionRecord) StatementEntry {
+	direction := StatementDebit
+	if r.Type == DepositTransaction {
+		direction = StatementCredit
+	}
+	return StatementEntry{ID: r.ID, Type: r.Type, Status: r.Status, Direction: direction, Amount: r.Amount,
+		Currency: r.Currency, Country: r.Country, Correspondent: r.Correspondent, BookedAt: r.StatusSince}
+}
+
+func parseTimestamp(value string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, value)
+	return t
+}
+
+// MissingTransactionsError is returned by StatementEntries with the entries it found when pawapay does not know
+// some of the transactions
+type MissingTransactionsError struct {
+	Refs []TransactionRef
+}
+
+func (e *MissingTransactionsError) Error() string {
+	return fmt.Sprintf("pawapay: %d transactions not found, first is %s %s", len(e.Refs), e.Refs[0].Type, e.Refs[0].ID)
+}
+
+// Is makes the error match ErrTransactionNotFound
+func (e *MissingTransactionsError) Is(target error) bool { return target == ErrTransactionNotFound }
+
+// StatementEntries fetches the transactions of refs from pawapay. Transactions pawapay does not know are skipped and
+// reported in a *MissingTransactionsError returned with the entries that were found
+func (s *Service) StatementEntries(refs []TransactionRef) ([]StatementEntry, error) {
+	var missing []TransactionRef
+	entries := make([]StatementEntry, 0, len(refs))
+	for _, ref := range refs {
+		var (
+			entry    StatementEntry
+			notFound bool
+			err      error
+		)
+		switch ref.Type {
+		case PayoutTransaction:
+			var p Payout
+			p, err = s.GetPayout(ref.ID)
+			entry, notFound = PayoutEntry(p), p.IsNotFound()
+		case DepositTransaction:
+			var d Deposit
+			d, err = s.GetDeposit(ref.ID)
+			entry, notFound = DepositEntry(d), d.IsNotFound()
+		case RefundTransaction:
+			var f Refund
+			f, err = s.GetRefund(ref.ID)
+			entry, notFound = RefundEntry(f), f.IsNotFound()
+		default:
+			return nil, errors.Errorf("unknown transaction type %q", ref.Type)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to get %s %s", ref.Type, ref.ID)
+		}
+		if notFound {
+			missing = append(missing, ref)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if len(missing) > 0 {
+		return entries, &MissingTransactionsError{Refs: missing}
+	}
+	return entries, nil
+}
+
+// StoredStatementEntries reads the transactions matching q from a TransactionStore
+func StoredStatementEntries(store TransactionStore, q TransactionQuery) ([]StatementEntry, error) {
+	records, err := store.FindTransactions(q)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to find transactions")
+	}
+	entries := make([]StatementEntry, 0, len(records))
+	for _, r := range records {
+		entries = append(entries, RecordEntry(r))
+	}
+	return entries, nil
+}
+
+// Wallet identifies a pawapay wallet
+type Wallet struct {
+	Country  string
+	Currency string
+}
+
+// StatementAccount holds the entries of a single wallet, amounts are decimal strings
+type StatementAccount struct {
+	Wallet
+	OpeningBalance string
+	ClosingBalance string
+	TotalCredits   string
+	TotalDebits    string
+	Entries        []StatementEntry
+}
+
+// Statement lists the completed transactions of a period, grouped by wallet
+type Statement struct {
+	From     time.Time
+	To       time.Time
+	Accounts []StatementAccount
+}
+
+// NewStatement groups the completed entries booked in [from, to) by wallet. Zero bounds are open. Closing balances
+// are the opening balances, which default to zero, plus the credits and minus the debits of the period. An opening
+// balance or an entry amount that is not a decimal number is an error, the statement would not add up otherwise
+func NewStatement(from, to time.Time, openingBalances map[Wallet]string, entries []StatementEntry) (Statement, error) {
+	type totals struct{ opening, credits, debits *big.Rat }
+	var (
+		accounts = map[Wallet]*StatementAccount{}
+		sums     = map[Wallet]*totals{}
+	)
+	account := func(wallet Wallet) (*StatementAccount, error) {
+		if _, ok := accounts[wallet]; !ok {
+			opening := new(big.Rat)
+			if balance, ok := openingBalances[wallet]; ok {
+				var err error
+				if opening, err = statementAmount(balance); err != nil {
+					return nil, errors.Wrapf(err, "invalid opening balance of %s %s", wallet.Country, wallet.Currency)
+				}
+			}
+			accounts[wallet] = &StatementAccount{Wallet: wallet}
+			sums[wallet] = &totals{opening: opening, credits: new(big.Rat), debits: new(big.Rat)}
+		}
+		return accounts[wallet], nil
+	}
+	// wallets with an opening balance are listed even when nothing moved through them
+	for wallet := range openingBalances {
+		if _, err := account(wallet); err != nil {
+			return Statement{}, err
+		}
+	}
+
+	for _, e := range entries {
+		if !strings.EqualFold(e.Status, "completed") {
+			continue
+		}
+		if (!from.IsZero() && e.BookedAt.Before(from)) || (!to.IsZero() && !e.BookedAt.Before(to)) {
+			continue
+		}
+
+		wallet := Wallet{Country: e.Country, Currency: e.Currency}
+		a, err := account(wallet)
+		if err != nil {
+			return Statement{}, err
+		}
+		amount, err := statementAmount(e.Amount)
+		if err != nil {
+			return Statement{}, errors.Wrapf(err, "invalid amount of %s %s", e.Type, e.ID)
+		}
+		a.Entries = append(a.Entries, e)
+		if e.Direction == StatementCredit {
+			sums[wallet].credits.Add(sums[wallet].credits, amount)
+		} else {
+			sums[wallet].debits.Add(sums[wallet].debits, amount)
+		}
+	}
+
+	statement := Statement{From: from, To: to}
+	for wallet, a := range accounts {
+		sum := sums[wallet]
+		closing := new(big.Rat).Add(sum.opening, sum.credits)
+		closing.Sub(closing, sum.debits)
+		a.OpeningBalance, a.ClosingBalance = sum.opening.FloatString(2), closing.FloatString(2)
+		a.TotalCredits, a.TotalDebits = sum.credits.FloatString(2), sum.debits.FloatString(2)
+		sort.SliceStable(a.Entries, func(i, j int) bool { return a.Entries[i].BookedAt.Before(a.Entries[j].BookedAt) })
+		statement.Accounts = append(statement.Accounts, *a)
+	}
+	sort.Slice(statement.Accounts, func(i, j int) bool {
+		a, b := statement.Accounts[i].Wallet, statement.Accounts[j].Wallet
+		if a.Currency != b.Currency {
+			return a.Currency < b.Currency
+		}
+		return a.Country < b.Country
+	})
+	return statement, nil
+}
+
+func statementAmount(amount string) (*big.Rat, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(amount))
+	if !ok {
+		return nil, errors.Errorf("%q is not a decimal amount", amount)
+	}
+	return r, nil
+}
+
+// correspondentIds flattens correspondent ids into sorted name=value pairs
+func correspondentIds(ids map[string]interface{}) []string {
+	pairs := make([]string, 0, len(ids))
+	for name, value := range ids {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", name, value))
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// WriteCSV writes the statement as csv. Every account starts with an opening row and ends with a closing row
+// holding its balances, entries carry their correspondent ids as name=value pairs separated by semicolons
+func (s Statement) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	rows := [][]string{{"record", "country", "currency", "type", "id", "direction", "amount", "booked_at",
+		"correspondent", "correspondent_ids"}}
+	for _, a := range s.Accounts {
+		rows = append(rows, []string{"opening", a.Country, a.Currency, "", "", "", a.OpeningBalance, formatTime(s.From), "", ""})
+		for _, e := range a.Entries {
+			rows = append(rows, []string{"entry", a.Country, a.Currency, string(e.Type), e.ID, e.Direction, e.Amount,
+				formatTime(e.BookedAt), e.Correspondent, strings.Join(correspondentIds(e.CorrespondentIds), ";")})
+		}
+		rows = append(rows, []string{"closing", a.Country, a.Currency, "", "", "", a.ClosingBalance, formatTime(s.To), "", ""})
+	}
+	if err := writer.WriteAll(rows); err != nil {
+		return errors.Wrap(err, "unable to write statement csv")
+	}
+	return nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+type camt053Amount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type camt053Balance struct {
+	Code      string        `xml:"Tp>CdOrPrtry>Cd"`
+	Amount    camt053Amount `xml:"Amt"`
+	Indicator string        `xml:"CdtDbtInd"`
+	Date      string        `xml:"Dt>DtTm,omitempty"`
+}
+
+type camt053Totals struct {
+	Count int    `xml:"NbOfNtries"`
+	Sum   string `xml:"Sum"`
+}
+
+type camt053Reference struct {
+	Type      string `xml:"Tp"`
+	Reference string `xml:"Ref"`
+}
+
+type camt053Entry struct {
+	Reference   string        `xml:"NtryRef"`
+	Amount      camt053Amount `xml:"Amt"`
+	Indicator   string        `xml:"CdtDbtInd"`
+	Status      string        `xml:"Sts>Cd"`
+	BookingDate string        `xml:"BookgDt>DtTm,omitempty"`
+	Code        string        `xml:"BkTxCd>Prtry>Cd"`
+	Details     struct {
+		TransactionID string             `xml:"Refs>TxId"`
+		Proprietary   []camt053Reference `xml:"Refs>Prtry"`
+		Additional    string             `xml:"AddtlTxInf,omitempty"`
+	} `xml:"NtryDtls>TxDtls"`
+}
+
+type camt053Statement struct {
+	ID      string `xml:"Id"`
+	Created string `xml:"CreDtTm"`
+	From    string `xml:"FrToDt>FrDtTm,omitempty"`
+	To      string `xml:"FrToDt>ToDtTm,omitempty"`
+	Account struct {
+		ID       string `xml:"Id>Othr>Id"`
+		Currency string `xml:"Ccy"`
+	} `xml:"Acct"`
+	Balances []camt053Balance `xml:"Bal"`
+	Credits  camt053Totals    `xml:"TxsSummry>TtlCdtNtries"`
+	Debits   camt053Totals    `xml:"TxsSummry>TtlDbtNtries"`
+	Entries  []camt053Entry   `xml:"Ntry"`
+}
+
+type camt053Document struct {
+	XMLName    xml.Name           `xml:"Document"`
+	Xmlns      string             `xml:"xmlns,attr"`
+	MessageID  string             `xml:"BkToCstmrStmt>GrpHdr>MsgId"`
+	Created    string             `xml:"BkToCstmrStmt>GrpHdr>CreDtTm"`
+	Statements []camt053Statement `xml:"BkToCstmrStmt>Stmt"`
+}
+
+// WriteCamt053 writes the statement as a camt.053 BankToCustomerStatement with a statement per wallet. Wallets are
+// identified as COUNTRY-CURRENCY and correspondent ids are carried as proprietary references of each entry
+func (s Statement) WriteCamt053(w io.Writer, messageID string, createdAt time.Time) error {
+	doc := camt053Document{Xmlns: camt053Namespace, MessageID: messageID, Created: formatTime(createdAt)}
+	for _, a := range s.Accounts {
+		accountID := a.Country + "-" + a.Currency
+		stmt := camt053Statement{ID: messageID + "-" + accountID, Created: formatTime(createdAt),
+			From: formatTime(s.From), To: formatTime(s.To)}
+		stmt.Account.ID, stmt.Account.Currency = accountID, a.Currency
+		stmt.Balances = []camt053Balance{
+			camt053Bal("OPBD", a.Currency, a.OpeningBalance, s.From),
+			camt053Bal("CLBD", a.Currency, a.ClosingBalance, s.To),
+		}
+		stmt.Credits.Sum, stmt.Debits.Sum = a.TotalCredits, a.TotalDebits
+
+		for _, e := range a.Entries {
+			if e.Direction == StatementCredit {
+				stmt.Credits.Count++
+			} else {
+				stmt.Debits.Count++
+			}
+			entry := camt053Entry{Reference: e.ID, Amount: camt053Amount{Currency: e.Currency, Value: e.Amount},
+				Indicator: e.Direction, Status: "BOOK", BookingDate: formatTime(e.BookedAt),
+				Code: strings.ToUpper(string(e.Type))}
+			entry.Details.TransactionID, entry.Details.Additional = e.ID, e.Correspondent
+			for _, pair := range correspondentIds(e.CorrespondentIds) {
+				name, value, _ := strings.Cut(pair, "=")
+				entry.Details.Proprietary = append(entry.Details.Proprietary, camt053Reference{Type: name, Reference: value})
+			}
+			stmt.Entries = append(stmt.Entries, entry)
+		}
+		doc.Statements = append(doc.Statements, stmt)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return errors.Wrap(err, "unable to write camt.053 statement")
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return errors.Wrap(encoder.Encode(doc), "unable to encode camt.053 statement")
+}
+
+// camt053Bal returns a balance, negative balances are expressed as debits
+func camt053Bal(code, currency, amount string, at time.Time) camt053Balance {
+	indicator := StatementCredit
+	if strings.HasPrefix(amount, "-") {
+		indicator, amount = StatementDebit, strings.TrimPrefix(amount, "-")
+	}
+	return camt053Balance{Code: code, Amount: camt053Amount{Currency: currency, Value: amount}, Indicator: indicator,
+		Date: formatTime(at)}
+}
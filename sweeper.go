@@ -0,0 +1,252 @@
+package pawapay
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultSweepInterval is how often Run sweeps when SweeperConfig.Interval is not set
+	DefaultSweepInterval = 5 * time.Minute
+	// DefaultEnqueuedAge is how long a payout may stay ENQUEUED before it is failed
+	DefaultEnqueuedAge = time.Hour
+	// DefaultCallbackGrace is how long a final status may go without a callback before it is resent
+	DefaultCallbackGrace = 15 * time.Minute
+	// DefaultCallbackWindow is how long after its grace a missing callback is still looked for
+	DefaultCallbackWindow = 24 * time.Hour
+)
+
+// SweeperConfig configures a Sweeper, zero fields use their defaults
+type SweeperConfig struct {
+	Interval time.Duration
+	// EnqueuedAge is how long a payout may stay ENQUEUED before FailEnqueued is called on it
+	EnqueuedAge time.Duration
+	// CorrespondentEnqueuedAge overrides EnqueuedAge for the correspondents it holds
+	CorrespondentEnqueuedAge map[string]time.Duration
+	// CallbackGrace is how long a transaction may be in a final status without its callback arriving before the
+	// callback is resent. Callbacks are only known to have arrived when they go through ParseCallback
+	CallbackGrace time.Duration
+	// CallbackWindow is how long after CallbackGrace a transaction without a callback is still looked at, older
+	// ones are left alone
+	CallbackWindow time.Duration
+	// OnStuckPayout is called for every payout failed by the sweeper, eg to reroute it or refund the customer
+	OnStuckPayout func(StuckPayout)
+}
+
+// StuckPayout is a payout the sweeper failed after it sat ENQUEUED for too long
+type StuckPayout struct {
+	Payout      Payout
+	EnqueuedFor time.Duration
+	Response    PayoutStatusResponse
+}
+
+// SweepReport is what a single sweep did
+type SweepReport struct {
+	Checked         int
+	FailedEnqueued  []StuckPayout
+	ResentCallbacks []TransactionRef
+	Errors          []error
+}
+
+// Sweeper periodically re-checks the pending payouts, deposits and refunds of the service's TransactionStore.
+// Payouts stuck in ENQUEUED are failed and callbacks that never arrived are resent
+type Sweeper struct {
+	service *Service
+	config  SweeperConfig
+	now     TimeProviderFunc
+
+	mu     sync.Mutex
+	resent map[TransactionRef]bool
+}
+
+// NewSweeper returns a sweeper working through s, which must be configured with a TransactionStore
+func NewSweeper(s *Service, config SweeperConfig) *Sweeper {
+	return &Sweeper{service: s, config: config, now: time.Now, resent: map[TransactionRef]bool{}}
+}
+
+// Run sweeps every interval until ctx is done. A sweep that fails is logged and retried on the next tick
+func (w *Sweeper) Run(ctx context.Context) error {
+	interval := w.config.Interval
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := w.Sweep(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("pawapay: sweep failed: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep re-checks every pending payout, deposit and refund once, its requests are bound to ctx and it stops early
+// when ctx is done. Failures on single transactions are collected in the report, the error is only set when the
+// store could not be read or ctx is done
+func (w *Sweeper) Sweep(ctx context.Context) (SweepReport, error) {
+	var report SweepReport
+	store := w.service.config.TransactionStore
+	if store == nil {
+		return report, errors.New("pawapay: sweeper needs a TransactionStore in Config")
+	}
+	s := w.service.WithContext(ctx)
+
+	pending, err := store.FindTransactions(TransactionQuery{Statuses: []string{"ACCEPTED", "ENQUEUED", "SUBMITTED"}})
+	if err != nil {
+		return report, errors.Wrap(err, "unable to find pending transactions")
+	}
+	for _, record := range pending {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		switch record.Type {
+		case PayoutTransaction:
+			report.Checked++
+			w.sweepPayout(s, record, &report)
+		case DepositTransaction:
+			report.Checked++
+			if _, err := s.GetDeposit(record.ID); err != nil {
+				report.Errors = append(report.Errors, errors.Wrapf(err, "unable to get deposit %s", record.ID))
+			}
+		case RefundTransaction:
+			report.Checked++
+			if _, err := s.GetRefund(record.ID); err != nil {
+				report.Errors = append(report.Errors, errors.Wrapf(err, "unable to get refund %s", record.ID))
+			}
+		}
+	}
+
+	// the gets above may have moved transactions to a final status, their callbacks are checked on a later sweep.
+	// Transactions that went without a callback for longer than the window are given up on
+	now := w.now()
+	final, err := store.FindTransactions(TransactionQuery{Statuses: []string{"COMPLETED", "FAILED"},
+		StatusBefore: now.Add(-w.callbackGrace()), StatusAfter: now.Add(-w.callbackGrace() - w.callbackWindow())})
+	if err != nil {
+		return report, errors.Wrap(err, "unable to find final transactions")
+	}
+	missing := map[TransactionRef]bool{}
+	for _, record := range final {
+		if record.CallbackAt.IsZero() {
+			missing[TransactionRef{ID: record.ID, Type: record.Type}] = true
+		}
+	}
+	w.pruneResent(missing)
+	for _, record := range final {
+		if !record.CallbackAt.IsZero() {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		w.resendCallback(s, record, &report)
+	}
+
+	return report, nil
+}
+
+func (w *Sweeper) sweepPayout(s *Service, record TransactionRecord, report *SweepReport) {
+	payout, err := s.GetPayout(record.ID)
+	if err != nil {
+		report.Errors = append(report.Errors, errors.Wrapf(err, "unable to get payout %s", record.ID))
+		return
+	}
+	if !strings.EqualFold(payout.Status, "ENQUEUED") || !strings.EqualFold(record.Status, "ENQUEUED") {
+		return
+	}
+
+	enqueuedFor := w.now().Sub(record.StatusSince)
+	if enqueuedFor < w.enqueuedAge(record.Correspondent) {
+		return
+	}
+
+	response, err := s.FailEnqueued(record.ID)
+	if err != nil {
+		report.Errors = append(report.Errors, errors.Wrapf(err, "unable to fail enqueued payout %s", record.ID))
+		return
+	}
+	stuck := StuckPayout{Payout: payout, EnqueuedFor: enqueuedFor, Response: response}
+	report.FailedEnqueued = append(report.FailedEnqueued, stuck)
+	if w.config.OnStuckPayout != nil {
+		w.config.OnStuckPayout(stuck)
+	}
+}
+
+// pruneResent forgets the transactions whose callback arrived or that fell out of the callback window
+func (w *Sweeper) pruneResent(missing map[TransactionRef]bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ref := range w.resent {
+		if !missing[ref] {
+			delete(w.resent, ref)
+		}
+	}
+}
+
+// resendCallback asks pawapay to resend the callback of a transaction, once per sweeper
+func (w *Sweeper) resendCallback(s *Service, record TransactionRecord, report *SweepReport) {
+	switch record.Type {
+	case PayoutTransaction, DepositTransaction, RefundTransaction:
+	default:
+		return
+	}
+	ref := TransactionRef{ID: record.ID, Type: record.Type}
+	w.mu.Lock()
+	done := w.resent[ref]
+	w.resent[ref] = true
+	w.mu.Unlock()
+	if done {
+		return
+	}
+
+	var err error
+	switch record.Type {
+	case PayoutTransaction:
+		_, err = s.ResendPayoutCallback(record.ID)
+	case DepositTransaction:
+		_, err = s.ResendDepositCallback(record.ID)
+	case RefundTransaction:
+		_, err = s.ResendRefundCallback(record.ID)
+	}
+	if err != nil {
+		w.mu.Lock()
+		delete(w.resent, ref)
+		w.mu.Unlock()
+		report.Errors = append(report.Errors, errors.Wrapf(err, "unable to resend %s callback %s", record.Type, record.ID))
+		return
+	}
+	report.ResentCallbacks = append(report.ResentCallbacks, ref)
+}
+
+func (w *Sweeper) enqueuedAge(correspondent string) time.Duration {
+	if age, ok := w.config.CorrespondentEnqueuedAge[correspondent]; ok && age > 0 {
+		return age
+	}
+	if w.config.EnqueuedAge > 0 {
+		return w.config.EnqueuedAge
+	}
+	return DefaultEnqueuedAge
+}
+
+func (w *Sweeper) callbackWindow() time.Duration {
+	if w.config.CallbackWindow > 0 {
+		return w.config.CallbackWindow
+	}
+	return DefaultCallbackWindow
+}
+
+func (w *Sweeper) callbackGrace() time.Duration {
+	if w.config.CallbackGrace > 0 {
+		return w.config.CallbackGrace
+	}
+	return DefaultCallbackGrace
+}
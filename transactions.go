@@ -0,0 +1,306 @@
+package pawapay
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrTransactionNotFound is returned by a TransactionStore that holds no record of a transaction
+var ErrTransactionNotFound = errors.New("pawapay: transaction not found")
+
+// Sources of a transaction event
+const (
+	SourceCreate   = "create"
+	SourceGet      = "get"
+	SourceCallback = "callback"
+)
+
+// TransactionEvent is a status of a transaction as seen on a response or a callback
+type TransactionEvent struct {
+	ID            string
+	Type          TransactionType
+	Correspondent string
+	Currency      string
+	Country       string
+	Amount        string
+	Status        string
+	Source        string
+	At            time.Time
+	Annotation    APIAnnotation
+}
+
+// StatusTransition is a change in the status of a transaction
+type StatusTransition struct {
+	Status     string        `json:"status"`
+	At         time.Time     `json:"at"`
+	Source     string        `json:"source"`
+	Annotation APIAnnotation `json:"annotation"`
+}
+
+// TransactionRecord is everything known about a transaction, History is ordered oldest first
+type TransactionRecord struct {
+	ID            string          `json:"id"`
+	Type          TransactionType `json:"type"`
+	Correspondent string          `json:"correspondent"`
+	Currency      string          `json:"currency"`
+	Country       string          `json:"country"`
+	Amount        string          `json:"amount"`
+	Status        string          `json:"status"`
+	StatusSince   time.Time       `json:"statusSince"`
+	UpdatedAt     time.Time       `json:"updatedAt"`
+	// CallbackAt is when the last callback about the transaction arrived, zero if none did
+	CallbackAt time.Time          `json:"callbackAt,omitempty"`
+	History    []StatusTransition `json:"history"`
+}
+
+// finalStatuses are the statuses a transaction never leaves
+var finalStatuses = []string{"COMPLETED", "FAILED", "REJECTED"}
+
+func isFinalStatus(status string) bool {
+	for _, final := range finalStatuses {
+		if strings.EqualFold(status, final) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply folds an event into the record, it is meant for TransactionStore implementations. A transition is only
+// added when the status changes. A final status is never left, eg for a get answered before a callback that arrived
+// first, and DUPLICATE_IGNORED is not a status of the transaction but pawapay's answer to a create it already knew
+func (r *TransactionRecord) Apply(e TransactionEvent) {
+	r.ID, r.Type = e.ID, e.Type
+	if e.Correspondent != "" {
+		r.Correspondent = e.Correspondent
+	}
+	if e.Currency != "" {
+		r.Currency = e.Currency
+	}
+	if e.Country != "" {
+		r.Country = e.Country
+	}
+	if e.Amount != "" {
+		r.Amount = e.Amount
+	}
+	r.UpdatedAt = e.At
+	if e.Source == SourceCallback {
+		r.CallbackAt = e.At
+	}
+
+	if e.Status == "" || strings.EqualFold(e.Status, r.Status) || strings.EqualFold(e.Status, "DUPLICATE_IGNORED") ||
+		isFinalStatus(r.Status) {
+		return
+	}
+	r.Status, r.StatusSince = e.Status, e.At
+	r.History = append(r.History, StatusTransition{Status: e.Status, At: e.At, Source: e.Source, Annotation: e.Annotation})
+}
+
+// TransactionQuery filters transactions, zero fields match everything
+type TransactionQuery struct {
+	Type          TransactionType
+	Statuses      []string
+	Correspondent string
+	// StatusBefore only matches transactions that have been in their current status since before it, eg
+	// time.Now().Add(-time.Hour) finds transactions stuck for longer than an hour
+	StatusBefore time.Time
+	// StatusAfter only matches transactions that have been in their current status since after it
+	StatusAfter time.Time
+}
+
+// Matches reports whether a record satisfies the query
+func (q TransactionQuery) Matches(r TransactionRecord) bool {
+	if q.Type != "" && q.Type != r.Type {
+		return false
+	}
+	if q.Correspondent != "" && q.Correspondent != r.Correspondent {
+		return false
+	}
+	if !q.StatusBefore.IsZero() && !r.StatusSince.Before(q.StatusBefore) {
+		return false
+	}
+	if !q.StatusAfter.IsZero() && !r.StatusSince.After(q.StatusAfter) {
+		return false
+	}
+	if len(q.Statuses) == 0 {
+		return true
+	}
+	for _, status := range q.Statuses {
+		if strings.EqualFold(status, r.Status) {
+			return true
+		}
+	}
+	return false
+}
+
+// TransactionStore keeps the status history of transactions. Implementations must be safe for concurrent use
+type TransactionStore interface {
+	RecordEvent(TransactionEvent) error
+	// GetTransaction returns ErrTransactionNotFound for unknown transactions
+	GetTransaction(id string) (TransactionRecord, error)
+	// FindTransactions returns the matching transactions, oldest status change first
+	FindTransactions(TransactionQuery) ([]TransactionRecord, error)
+}
+
+// MemoryTransactionStore is a TransactionStore that lives for as long as the process does
+type MemoryTransactionStore struct {
+	mu      sync.Mutex
+	records map[string]TransactionRecord
+}
+
+// NewMemoryTransactionStore returns an empty in memory transaction store
+func NewMemoryTransactionStore() *MemoryTransactionStore {
+	return &MemoryTransactionStore{records: map[string]TransactionRecord{}}
+}
+
+// RecordEvent implements TransactionStore
+func (m *MemoryTransactionStore) RecordEvent(e TransactionEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.records[e.ID]
+	r.History = append([]StatusTransition(nil), r.History...)
+	r.Apply(e)
+	m.records[e.ID] = r
+	return nil
+}
+
+// GetTransaction implements TransactionStore
+func (m *MemoryTransactionStore) GetTransaction(id string) (TransactionRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.records[id]
+	if !ok {
+		return TransactionRecord{}, ErrTransactionNotFound
+	}
+	return r, nil
+}
+
+// FindTransactions implements TransactionStore
+func (m *MemoryTransactionStore) FindTransactions(q TransactionQuery) ([]TransactionRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var found []TransactionRecord
+	for _, r := range m.records {
+		if q.Matches(r) {
+			found = append(found, r)
+		}
+	}
+	sortTransactions(found)
+	return found, nil
+}
+
+func sortTransactions(records []TransactionRecord) {
+	sort.Slice(records, func(i, j int) bool { return records[i].StatusSince.Before(records[j].StatusSince) })
+}
+
+// transactionEvents extracts the status of every transaction found in a request and its decoded response
+func transactionEvents(reqBody, resp interface{}, annotation APIAnnotation, at time.Time) []TransactionEvent {
+	var events []TransactionEvent
+	add := func(e TransactionEvent) {
+		if e.ID == "" {
+			return
+		}
+		e.At, e.Annotation = at, annotation
+		events = append(events, e)
+	}
+
+	switch body := reqBody.(type) {
+	case CreatePayoutRequest:
+		if r, ok := resp.(*CreatePayoutResponse); ok {
+			add(TransactionEvent{ID: body.PayoutId, Type: PayoutTransaction, Correspondent: body.Correspondent,
+				Currency: body.Currency, Country: body.Country, Amount: body.Amount, Status: r.Status, Source: SourceCreate})
+		}
+	case []CreatePayoutRequest:
+		if r, ok := resp.(*[]CreatePayoutResponse); ok {
+			statuses := map[string]string{}
+			for _, result := range *r {
+				statuses[strings.ToLower(result.PayoutID)] = result.Status
+			}
+			for _, item := range body {
+				add(TransactionEvent{ID: item.PayoutId, Type: PayoutTransaction, Correspondent: item.Correspondent,
+					Currency: item.Currency, Country: item.Country, Amount: item.Amount, Status: statuses[strings.ToLower(item.PayoutId)],
+					Source: SourceCreate})
+			}
+		}
+	case CreateDepositRequest:
+		if r, ok := resp.(*CreateDepositResponse); ok {
+			add(TransactionEvent{ID: body.DepositId, Type: DepositTransaction, Correspondent: body.Correspondent,
+				Currency: body.Currency, Country: body.Country, Amount: body.Amount, Status: r.Status, Source: SourceCreate})
+		}
+	case []CreateDepositRequest:
+		if r, ok := resp.(*[]CreateDepositResponse); ok {
+			statuses := map[string]string{}
+			for _, result := range *r {
+				statuses[strings.ToLower(result.DepositId)] = result.Status
+			}
+			for _, item := range body {
+				add(TransactionEvent{ID: item.DepositId, Type: DepositTransaction, Correspondent: item.Correspondent,
+					Currency: item.Currency, Country: item.Country, Amount: item.Amount, Status: statuses[strings.ToLower(item.DepositId)],
+					Source: SourceCreate})
+			}
+		}
+	case RefundRequest:
+		if r, ok := resp.(*InitiateRefundResponse); ok {
+			add(TransactionEvent{ID: body.RefundId, Type: RefundTransaction, Amount: body.Amount, Status: r.Status,
+				Source: SourceCreate})
+		}
+	}
+
+	switch r := resp.(type) {
+	case *[]Payout:
+		for _, p := range *r {
+			add(payoutEvent(p, SourceGet))
+		}
+	case *[]Deposit:
+		for _, d := range *r {
+			add(depositEvent(d, SourceGet))
+		}
+	case *[]Refund:
+		for _, f := range *r {
+			add(refundEvent(f, SourceGet))
+		}
+	}
+	return events
+}
+
+func payoutEvent(p Payout, source string) TransactionEvent {
+	return TransactionEvent{ID: p.PayoutID, Type: PayoutTransaction, Correspondent: p.Correspondent,
+		Currency: p.Currency, Country: p.Country, Amount: p.Amount, Status: p.Status, Source: source}
+}
+
+func depositEvent(d Deposit, source string) TransactionEvent {
+	amount := d.DepositedAmount
+	if amount == "" {
+		amount = d.RequestedAmount
+	}
+	return TransactionEvent{ID: d.DepositId, Type: DepositTransaction, Correspondent: d.Correspondent,
+		Currency: d.Currency, Country: d.Country, Amount: amount, Status: d.Status, Source: source}
+}
+
+func refundEvent(f Refund, source string) TransactionEvent {
+	return TransactionEvent{ID: f.RefundId, Type: RefundTransaction, Correspondent: f.Correspondent,
+		Currency: f.Currency, Country: f.Country, Amount: f.Amount, Status: f.Status, Source: source}
+}
+
+// recordEvents writes events to the configured transaction store. A failing store never fails the call that
+// produced the events, it is logged instead
+func (s *Service) recordEvents(events []TransactionEvent) {
+	if s.config.TransactionStore == nil {
+		return
+	}
+	for _, e := range events {
+		if e.ID == "" {
+			continue
+		}
+		if e.At.IsZero() {
+			e.At = time.Now()
+		}
+		if err := s.config.TransactionStore.RecordEvent(e); err != nil {
+			log.Printf("pawapay: unable to record %s %s status %s: %s", e.Type, e.ID, e.Status, err)
+		}
+	}
+}
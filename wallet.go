@@ -0,0 +1,138 @@
+package pawapay
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type WalletBalance struct {
+	Country  string `json:"country"`
+	Balance  string `json:"balance"`
+	Currency string `json:"currency"`
+	Mno      string `json:"mno"`
+}
+
+type WalletBalancesResponse struct {
+	Balances   []WalletBalance `json:"balances"`
+	Annotation APIAnnotation
+}
+
+// WalletAffordability compares what a batch needs from a wallet against what the wallet holds
+type WalletAffordability struct {
+	Country    string
+	Currency   string
+	Required   string
+	Available  string
+	Sufficient bool
+}
+
+type AffordabilityResponse struct {
+	CanAfford  bool
+	Wallets    []WalletAffordability
+	Annotation APIAnnotation
+}
+
+// GetWalletBalances provides the functionality of retrieving the balances of all wallets
+// See docs https://docs.pawapay.co.uk/#operation/getAllBalances for more details
+func (s *Service) GetWalletBalances() (WalletBalancesResponse, error) {
+
+	resource := "wallet-balances"
+
+	var response WalletBalancesResponse
+	annotation, err := s.makeRequest(http.MethodGet, resource, nil, &response)
+	if err != nil {
+		return WalletBalancesResponse{}, err
+	}
+	response.Annotation = annotation
+
+	return response, nil
+}
+
+// GetWalletBalance provides the functionality of retrieving the wallet balances of a country, eg GHA
+// See docs https://docs.pawapay.co.uk/#operation/getCountryBalances for more details
+func (s *Service) GetWalletBalance(country string) (WalletBalancesResponse, error) {
+
+	resource := fmt.Sprintf("wallet-balances/%s", country)
+
+	var response WalletBalancesResponse
+	annotation, err := s.makeRequest(http.MethodGet, resource, nil, &response)
+	if err != nil {
+		return WalletBalancesResponse{}, err
+	}
+	response.Annotation = annotation
+
+	return response, nil
+}
+
+// CanAfford totals a batch of payouts per wallet, ie country and currency, and checks it against the current
+// wallet balances. Use it as a pre-flight check before CreateBulkPayout
+func (s *Service) CanAfford(payouts []PayoutRequest) (AffordabilityResponse, error) {
+
+	type walletKey struct{ country, currency string }
+	required := map[walletKey]*big.Rat{}
+
+	for _, payout := range payouts {
+		se, err := countryByCallingCode(payout.PhoneNumber.CountryCode)
+		if err != nil {
+			return AffordabilityResponse{}, err
+		}
+
+		amount, ok := new(big.Rat).SetString(payout.Amount.Value)
+		if !ok {
+			return AffordabilityResponse{}, fmt.Errorf("payout %s has an invalid amount %q", payout.PayoutId, payout.Amount.Value)
+		}
+
+		key := walletKey{se.Alpha3, strings.ToUpper(payout.Amount.Currency)}
+		if required[key] == nil {
+			required[key] = new(big.Rat)
+		}
+		required[key].Add(required[key], amount)
+	}
+
+	balances, err := s.GetWalletBalances()
+	if err != nil {
+		return AffordabilityResponse{Annotation: balances.Annotation}, err
+	}
+
+	available := map[walletKey]*big.Rat{}
+	for _, b := range balances.Balances {
+		amount, ok := new(big.Rat).SetString(b.Balance)
+		if !ok {
+			continue
+		}
+		key := walletKey{b.Country, strings.ToUpper(b.Currency)}
+		if available[key] == nil {
+			available[key] = new(big.Rat)
+		}
+		available[key].Add(available[key], amount)
+	}
+
+	response := AffordabilityResponse{CanAfford: true, Annotation: balances.Annotation}
+	for key, need := range required {
+		have := available[key]
+		if have == nil {
+			have = new(big.Rat)
+		}
+
+		sufficient := have.Cmp(need) >= 0
+		response.CanAfford = response.CanAfford && sufficient
+		response.Wallets = append(response.Wallets, WalletAffordability{
+			Country:    key.country,
+			Currency:   key.currency,
+			Required:   need.FloatString(2),
+			Available:  have.FloatString(2),
+			Sufficient: sufficient,
+		})
+	}
+	sort.Slice(response.Wallets, func(i, j int) bool {
+		if response.Wallets[i].Country != response.Wallets[j].Country {
+			return response.Wallets[i].Country < response.Wallets[j].Country
+		}
+		return response.Wallets[i].Currency < response.Wallets[j].Currency
+	})
+
+	return response, nil
+}